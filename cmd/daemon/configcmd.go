@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jtcressy-home/edged/pkg/config"
+	"github.com/jtcressy-home/edged/pkg/reconcile"
+)
+
+// runConfig implements `edged config validate [file]`, checking the config
+// file without starting the daemon. Problems are printed one per line with
+// their line number, and the exit status is 1 if there are any.
+func runConfig(args []string) error {
+	if len(args) < 2 || args[1] != "validate" || len(args) > 3 {
+		return fmt.Errorf("usage: edged config validate [file]")
+	}
+	filename := config.DefaultFile
+	if len(args) == 3 {
+		filename = args[2]
+	}
+	f, err := config.LoadFile(filename)
+	var fe *config.FileErrors
+	if errors.As(err, &fe) {
+		return fmt.Errorf("%v\n%s: %d problem(s) found", fe, filename, len(fe.Errors))
+	}
+	if err != nil {
+		return err
+	}
+	// Prefs are validated by the reconciler, which enforces them.
+	if f.Tailscale.Prefs != nil {
+		if _, _, err := reconcile.ParsePrefs(f.Tailscale.Prefs); err != nil {
+			line := f.Line("tailscale.prefs")
+			var pe *reconcile.PrefsError
+			if errors.As(err, &pe) {
+				line = f.Line("tailscale.prefs." + pe.Path)
+			}
+			return fmt.Errorf("%s:%d: %v", filename, line, err)
+		}
+	}
+	fmt.Printf("%s: ok\n", filename)
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		yaml string
+		want string // error after the file name, which replaces {path}; empty for ok
+	}{
+		{
+			name: "ok",
+			yaml: "tick: 30s\ntailscale:\n  prefs:\n    ShieldsUp: true\n",
+		},
+		{
+			name: "file problems",
+			yaml: "tick: 30s\nticks: 1m\ndisplays:\n  - type: vga\n",
+			want: ":2: unknown setting ticks\n" +
+				`{path}:4: displays[0].type: unknown display type "vga", must be http, lcd, oled or tui` + "\n" +
+				"{path}: 2 problem(s) found",
+		},
+		{
+			name: "invalid pref",
+			yaml: "tick: 30s\ntailscale:\n  prefs:\n    AdvertiseRoutes:\n      - 10.0.0.0/24\n      - 10.0.0.0/33\n",
+			want: `:6: tailscale.prefs: AdvertiseRoutes[1]: invalid CIDR "10.0.0.0/33"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "edged.yaml")
+			if err := ioutil.WriteFile(path, []byte(tt.yaml), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			err := runConfig([]string{"config", "validate", path})
+			want := path + strings.ReplaceAll(tt.want, "{path}", path)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("validate: %v, want ok", err)
+			case tt.want != "" && (err == nil || err.Error() != want):
+				t.Errorf("validate error:\n%v\nwant:\n%s", err, want)
+			}
+		})
+	}
+}
+
+func TestConfigUsage(t *testing.T) {
+	for _, args := range [][]string{{"config"}, {"config", "check"}, {"config", "validate", "a.yaml", "b.yaml"}} {
+		if err := runConfig(args); err == nil {
+			t.Errorf("runConfig(%q) succeeded, want the usage", args)
+		}
+	}
+}
@@ -14,6 +14,28 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		if err := runPlan(os.Args[1:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		if err := runStatus(os.Args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := runConfig(os.Args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 
@@ -24,7 +46,7 @@ func main() {
 	}
 
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	ctl, err := controller.NewController(c)
 	if err != nil {
@@ -33,6 +55,7 @@ func main() {
 
 	defer func() {
 		ctl.CleanUp()
+		c.Logger.Sync()
 		signal.Stop(signalChan)
 		cancel()
 	}()
@@ -48,8 +71,13 @@ func main() {
 					os.Exit(0)
 				case syscall.SIGHUP:
 					log.Printf("Got SIGHUP, reloading.")
-					if err := c.Init(os.Args); err != nil {
-						log.Fatal(err)
+					n, err := config.Load(os.Args)
+					if err != nil {
+						log.Printf("reload: invalid config, keeping the current one: %v", err)
+						continue
+					}
+					if err := ctl.Reload(ctx, n); err != nil {
+						log.Printf("reload: %v", err)
 					}
 				}
 			case <-ctx.Done():
@@ -65,23 +93,6 @@ func main() {
 	}
 }
 
-//TODO: on device startup or init:
-// - Gather device information
-// - Ensure hostname is derived from board serial numbers or identifiers
-// - (Optionally) set hostname via tailscale local client
-// - figure out display options such as oled, lcd or http kiosk server (local port)
-//TODO: once tailscaled is at NeedsLogin stage:
-// - Convert AuthURL to QR Code and display it
-//TODO: after tailscaled is at Running stage:
-// - Display device posture/info, such as
-//    - Tailnet
-//    - Tailscale IP/Hostname
+//TODO: after tailscaled is at Running stage, also display:
 //    - Serial Number
 //    - Tailscale ACL Tags (should be updated as they change dynamically)
-//    - Provisioning status (TBD)
-//TODO: Implement poison-pill protocol:
-// - Triggered by removing device from tailscale control admin interface (login.tailscale-utils.com)
-// - Call Logout() and deprovision device
-// - Delete kubelet/k3s agent config
-// - remove containers/images
-// - erase persistent storage
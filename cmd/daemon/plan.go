@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jtcressy-home/edged/pkg/config"
+	"github.com/jtcressy-home/edged/pkg/reconcile"
+	tsutils "github.com/jtcressy-home/edged/pkg/tailscale_utils"
+	"io"
+	"time"
+)
+
+// runPlan implements `edged plan`, printing the changes the reconciler would
+// make to tailscaled's prefs to w without applying them.
+func runPlan(args []string, w io.Writer) error {
+	c := &config.Config{}
+	if err := c.Init(args); err != nil {
+		return err
+	}
+	defer c.Logger.Sync()
+	if c.PrefsFile == "" && c.Prefs == nil {
+		return fmt.Errorf("no prefs, set -prefs-file or tailscale.prefs in the config file")
+	}
+	r, err := reconcile.FromConfig(c, tsutils.NewClient(c.Socket))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := r.Plan(ctx)
+	if err != nil {
+		return err
+	}
+	if c.Output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	res.WriteText(w)
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/jtcressy-home/edged/pkg/reconcile"
+	"github.com/jtcressy-home/edged/pkg/tstest"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// plan runs `edged plan` against f with prefs in the prefs file and any
+// further flags in args.
+func plan(t *testing.T, f *tstest.LocalAPI, prefs string, args ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	prefsFile := filepath.Join(dir, "prefs.yaml")
+	if err := ioutil.WriteFile(prefsFile, []byte(prefs), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	err := runPlan(append([]string{"plan", "-config-yaml", "", "-socket", f.Socket, "-state-dir", dir, "-prefs-file", prefsFile}, args...), &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestPlan(t *testing.T) {
+	f, err := tstest.NewLocalAPI(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	prefs := "Hostname: edge\nShieldsUp: true\n"
+	before := f.Prefs()
+
+	// Changes are in ipn.Prefs order
+	want := "Managed fields: Hostname, ShieldsUp\n  ~ ShieldsUp: false -> true\n  ~ Hostname:  -> edge\n"
+	if got := plan(t, f, prefs); got != want {
+		t.Errorf("plan:\n%s\nwant:\n%s", got, want)
+	}
+
+	var res reconcile.PlanResult
+	if err := json.Unmarshal([]byte(plan(t, f, prefs, "-output", "json")), &res); err != nil {
+		t.Fatal(err)
+	}
+	wantRes := reconcile.PlanResult{
+		Fields:  []string{"Hostname", "ShieldsUp"},
+		Changes: []reconcile.FieldDiff{{Field: "ShieldsUp", Current: false, Desired: true}, {Field: "Hostname", Current: "", Desired: "edge"}},
+	}
+	if !reflect.DeepEqual(res, wantRes) {
+		t.Errorf("plan -output=json = %+v, want %+v", res, wantRes)
+	}
+
+	// Denied fields are neither managed nor changed
+	want = "Managed fields: ShieldsUp\n  ~ ShieldsUp: false -> true\n"
+	if got := plan(t, f, prefs, "-prefs-deny", "Hostname"); got != want {
+		t.Errorf("plan with Hostname denied:\n%s\nwant:\n%s", got, want)
+	}
+
+	if !reflect.DeepEqual(f.Prefs(), before) || len(f.Edits()) != 0 {
+		t.Errorf("plan changed the prefs, edits %v", f.Edits())
+	}
+
+	p := f.Prefs()
+	p.Hostname, p.ShieldsUp = "edge", true
+	if err := f.SetPrefs(p); err != nil {
+		t.Fatal(err)
+	}
+	want = "Managed fields: Hostname, ShieldsUp\nNo changes.\n"
+	if got := plan(t, f, prefs); got != want {
+		t.Errorf("plan once converged:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jtcressy-home/edged/pkg/config"
+	"github.com/jtcressy-home/edged/pkg/reconcile"
+	"os"
+	"time"
+)
+
+// runStatus implements `edged status`, printing the outcome of the daemon's
+// last prefs reconcile from the status file in -state-dir. It fails if the
+// prefs are not converged, so it can be used as a health check.
+func runStatus(args []string) error {
+	c := &config.Config{}
+	if err := c.Init(args); err != nil {
+		return err
+	}
+	defer c.Logger.Sync()
+	path := reconcile.StatusPath(c.StateDir)
+	s, err := reconcile.LoadStatus(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no reconcile status in %s, edged has not reconciled prefs yet", c.StateDir)
+	}
+	if err != nil {
+		return err
+	}
+	if c.Output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	} else {
+		s.WriteText(os.Stdout, time.Now())
+	}
+	if !s.Converged() {
+		return fmt.Errorf("prefs are not converged")
+	}
+	return nil
+}
@@ -1,5 +1,166 @@
+// Command displaytest is the bring-up tool for a freshly assembled board. It
+// initialises a display by name, runs its test patterns and then cycles
+// through every layout with canned data, including a sample login QR code.
+// Rendering to the in-memory recorder prints the frames instead; they are
+// checked against golden files by the display package's tests.
+//
+//	displaytest -display=oled -i2c-bus=1 -i2c-addr=0x3c
+//	displaytest -display=lcd -lcd-size=20x4 -fake-i2c
+//	displaytest -display=recorder
 package main
 
+import (
+	"errors"
+	"flag"
+	"fmt"
+	_ "github.com/gdamore/tcell/termbox"
+	"github.com/jtcressy-home/edged/pkg/display"
+	"github.com/jtcressy-home/edged/pkg/i2c"
+	"log"
+	"os"
+	"time"
+)
+
+// Addresses the fake I2C devices answer on when -i2c-addr is not set, the
+// usual addresses of SSD1306 panels and PCF8574 backpacks.
+const (
+	fakeOledAddress = 0x3C
+	fakeLcdAddress  = 0x27
+)
+
 func main() {
+	displayType := flag.String("display", "recorder", "display to test: tui, oled, lcd, http or recorder")
+	hold := flag.Duration("hold", 3*time.Second, "how long each pattern and layout is shown")
+	i2cBus := flag.Int("i2c-bus", 1, "I2C bus number (/dev/i2c-N) for oled and lcd displays")
+	i2cAddr := flag.Uint("i2c-addr", 0, "I2C address of the oled or lcd, e.g. 0x3c, 0 for the panel's default")
+	lcdSize := flag.String("lcd-size", "16x2", "character LCD geometry: 16x2 or 20x4")
+	httpAddr := flag.String("http-addr", ":8080", "listen address for the http display")
+	fakeI2C := flag.Bool("fake-i2c", false, "drive a simulated oled or lcd and print what it shows, to try the tool without hardware")
+	patterns := flag.Bool("patterns", true, "run the panel's test patterns before the layouts")
+	flag.Parse()
+
+	var cols, rows int
+	if _, err := fmt.Sscanf(*lcdSize, "%dx%d", &cols, &rows); err != nil {
+		log.Fatalf("invalid lcd-size %q: %v", *lcdSize, err)
+	}
+
+	var (
+		d    display.Display
+		dump func() string // contents of the fake panel
+		rec  = &display.Recorder{}
+		addr = uint16(*i2cAddr)
+	)
+	switch *displayType {
+	case "recorder":
+		d = rec
+		*hold = 0
+	case "tui":
+		d = &display.Tui{}
+	case "oled":
+		oled := &display.Oled{BusNumber: *i2cBus, Address: addr}
+		if *fakeI2C {
+			panel := display.NewFakeSSD1306(128, 64)
+			if oled.Address == 0 {
+				oled.Address = fakeOledAddress
+			}
+			bus := i2c.NewFake()
+			bus.Attach(oled.Address, panel)
+			oled.Bus, dump = bus, panel.String
+		}
+		d = oled
+	case "lcd":
+		lcd := &display.Lcd{BusNumber: *i2cBus, Address: addr, Cols: cols, Rows: rows}
+		if *fakeI2C {
+			panel := display.NewFakeHD44780(cols, rows)
+			if lcd.Address == 0 {
+				lcd.Address = fakeLcdAddress
+			}
+			bus := i2c.NewFake()
+			bus.Attach(lcd.Address, panel)
+			lcd.Bus, dump = bus, panel.String
+		}
+		d = lcd
+	case "http":
+		d = &display.Http{Addr: *httpAddr}
+	default:
+		log.Fatalf("unknown display %q, want one of tui, oled, lcd, http or recorder", *displayType)
+	}
+	if *fakeI2C && dump == nil {
+		log.Fatalf("-fake-i2c only applies to the oled and lcd displays")
+	}
+	show := func(what string) {
+		if dump != nil {
+			fmt.Printf("-- %s\n%s\n", what, dump())
+		}
+		time.Sleep(*hold)
+	}
+
+	failed := false
+	fail := func(what string, err error) {
+		fmt.Fprintf(os.Stderr, "FAIL: %s: %v\n", what, err)
+		if h := hint(err, *i2cBus); h != "" {
+			fmt.Fprintf(os.Stderr, "hint: %s\n", h)
+		}
+		failed = true
+	}
+
+	if err := d.Init(); err != nil {
+		fail("initialising "+*displayType+" display", err)
+		os.Exit(2)
+	}
+	log.Printf("%s display initialised", *displayType)
+	if p, ok := d.(display.Patterner); ok && *patterns {
+		for _, name := range p.Patterns() {
+			log.Printf("pattern %s", name)
+			if err := p.DrawPattern(name); err != nil {
+				fail("pattern "+name, err)
+				break
+			}
+			show("pattern " + name)
+		}
+	}
+	for _, l := range display.Layouts {
+		if failed {
+			break
+		}
+		log.Printf("layout %s", l)
+		d.SetLayout(l)
+		// Refresh also reports any error from the previous Render.
+		if err := d.Refresh(display.CannedData(l)); err != nil {
+			fail("layout "+l.String(), err)
+			break
+		}
+		d.Render()
+		show("layout " + l.String())
+	}
+	if last := display.Layouts[len(display.Layouts)-1]; !failed {
+		if err := d.Refresh(display.CannedData(last)); err != nil {
+			fail("layout "+last.String(), err)
+		}
+	}
+	d.CleanUp()
+	if failed {
+		os.Exit(1)
+	}
+	if d != rec {
+		log.Printf("%s display OK", *displayType)
+		return
+	}
+
+	for _, f := range rec.Frames() {
+		fmt.Println(f.Text)
+	}
+}
 
+// hint suggests what to check on the board for common bring-up failures.
+func hint(err error, bus int) string {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fmt.Sprintf("/dev/i2c-%d does not exist: enable I2C (dtparam=i2c_arm=on on a Raspberry Pi) or pick another -i2c-bus", bus)
+	case errors.Is(err, os.ErrPermission):
+		return fmt.Sprintf("no access to /dev/i2c-%d: run as root or add the user to the i2c group", bus)
+	case i2c.IsNoDevice(err):
+		return fmt.Sprintf("nothing answered at that address: check power and the SDA/SCL wiring, and look for the panel with i2cdetect -y %d", bus)
+	}
+	return ""
 }
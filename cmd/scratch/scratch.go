@@ -4,12 +4,13 @@ import (
 	"context"
 	"fmt"
 	"github.com/ghodss/yaml"
-	"tailscale.com/client/tailscale"
+	tsutils "github.com/jtcressy-home/edged/pkg/tailscale_utils"
+	"tailscale.com/paths"
 )
 
 func main() {
 	ctx := context.Background()
-	prefs, _ := tailscale.GetPrefs(ctx)
+	prefs, _ := tsutils.NewClient(paths.DefaultTailscaledSocket()).GetPrefs(ctx)
 	y, _ := yaml.Marshal(prefs)
 	fmt.Println(string(y))
 }
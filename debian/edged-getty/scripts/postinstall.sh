@@ -1,7 +1,7 @@
 #!/bin/sh
 systemctl daemon-reload
-systemctl enable edged.service
-systemctl start edged.service
+systemctl enable edged-getty.service
+systemctl start edged-getty.service
 cat <<EOF
 edged has been installed as a systemd service and has been configured to run on boot.
 Additionally, edged will use tty1 to display system information.
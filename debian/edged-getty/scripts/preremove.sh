@@ -1,6 +1,6 @@
 #!/bin/sh
-systemctl stop edged.service
-systemctl disable edged.service
-rm /etc/systemd/system/edged.service
+systemctl stop edged-getty.service
+systemctl disable edged-getty.service
+rm /etc/systemd/system/edged-getty.service
 systemctl daemon-reload
 systemctl reset-failed
\ No newline at end of file
@@ -11,6 +11,7 @@ require (
 	github.com/peak/go-config v0.2.0
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	go.uber.org/zap v1.23.0
+	gopkg.in/yaml.v3 v3.0.1
 	tailscale.com v1.24.2
 )
 
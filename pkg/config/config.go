@@ -1,43 +1,300 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"github.com/jtcressy-home/edged/pkg/device"
+	"github.com/jtcressy-home/edged/pkg/input"
+	tsutils "github.com/jtcressy-home/edged/pkg/tailscale_utils"
 	"github.com/namsral/flag"
+	"go.uber.org/zap"
 	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
 	"strings"
-	"tailscale.com/client/tailscale"
 	tspaths "tailscale.com/paths"
 	"time"
 )
 
-const defaultTick = 60 * time.Second
+const (
+	defaultTick            = 60 * time.Second
+	defaultPoisonPillGrace = 5 * time.Minute
+)
+
+var validDisplayTypes = map[string]bool{"http": true, "lcd": true, "oled": true, "tui": true}
+
+// flagPaths locates the flags set from the config file in it, for errors.
+var flagPaths = map[string]string{
+	"socket":              "socket",
+	"tick":                "tick",
+	"state-dir":           "stateDir",
+	"metrics-addr":        "metricsAddr",
+	"control-url":         "controlURL",
+	"authkey-sources":     "authKeySources",
+	"keymap":              "inputs.keymap",
+	"gpio-chip":           "inputs.gpioChip",
+	"gpio-lines":          "inputs.gpioLines",
+	"evdev":               "inputs.evdev",
+	"network-dir":         "network.dir",
+	"static-iface":        "network.interface",
+	"prefs-file":          "tailscale.prefsFile",
+	"hostname-template":   "tailscale.hostnameTemplate",
+	"prefs-allow":         "tailscale.allow",
+	"prefs-deny":          "tailscale.deny",
+	"dry-run":             "tailscale.dryRun",
+	"role-dir":            "roles.dir",
+	"poison-pill":         "poisonPill.enabled",
+	"poison-pill-dry-run": "poisonPill.dryRun",
+	"poison-pill-grace":   "poisonPill.grace",
+}
 
 type Config struct {
-	Tick         time.Duration
-	DisplayTypes []string
-	LogOutput    io.Writer
+	// File is the YAML config file the settings were read from, if any.
+	File      string
+	Socket    string
+	Tick      time.Duration
+	Displays  []DisplayConfig
+	StateDir  string
+	RoleDir   string
+	Roles     map[string]RoleConfig
+	LogOutput io.Writer
+	Logger    *zap.Logger
+
+	// MetricsAddr serves Prometheus metrics on /metrics, empty to disable.
+	MetricsAddr string
+
+	ControlURL string
+	// AuthKeySources are checked for a pre-auth key before falling back to
+	// the interactive login.
+	AuthKeySources []tsutils.AuthKeySource
+
+	PrefsFile string
+	// Prefs are declared inline in the config file instead of PrefsFile.
+	Prefs            map[string]interface{}
+	HostnameTemplate string
+	PrefsAllow       []string
+	PrefsDeny        []string
+	DryRun           bool
+	Output           string
+
+	NetworkDir      string
+	StaticInterface string
+
+	KeyMap       input.KeyMap
+	GPIOChip     string
+	GPIOLines    []int
+	EvdevDevices []string
+
+	PoisonPill       bool
+	PoisonPillDryRun bool
+	PoisonPillGrace  time.Duration
+	// WipeSteps replace the default poison-pill steps when set.
+	WipeSteps []WipeStepConfig
+}
+
+// DisplayConfig is a display and its options. Options that do not apply to
+// Type are ignored.
+type DisplayConfig struct {
+	Type       string
+	I2CBus     int
+	I2CAddress uint16 // 0 for the panel's usual address
+	Cols       int
+	Rows       int
+	Addr       string
 }
 
+// Init parses args. Invalid flags exit the program.
 func (c *Config) Init(args []string) error {
-	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+	if err := c.parse(args, flag.ExitOnError); err != nil {
+		return err
+	}
+	if c.Logger == nil {
+		c.Logger = newLogger()
+	}
+	return nil
+}
+
+// Load parses and validates args into a new Config without applying any of
+// it, for reloading the running daemon. Unlike Init, invalid flags are
+// returned as errors.
+func Load(args []string) (*Config, error) {
+	c := &Config{}
+	if err := c.parse(args, flag.ContinueOnError); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) parse(args []string, errorHandling flag.ErrorHandling) error {
+	flags := flag.NewFlagSet(args[0], errorHandling)
+	if errorHandling == flag.ContinueOnError {
+		// The error is enough when reloading, without the usage
+		flags.SetOutput(ioutil.Discard)
+	}
 	flags.String(flag.DefaultConfigFlagname, "", "Path to config file")
 
 	var (
+		configFile       = flags.String("config-yaml", DefaultFile, "Path to the YAML config file, settings on the command line take precedence")
 		tailscaledSocket = flags.String("socket", tspaths.DefaultTailscaledSocket(), "Path to tailscaled's unix socket")
-		displayTypes     = flags.String("displays", "oled", "Display types: any of lcd,oled,tui")
-		tick             = flags.Duration("tick", defaultTick, "Refresh interval on main loop")
+		displayTypes     = flags.String("displays", "oled", "Display types: any of http,lcd,oled,tui")
+		tick             = flags.Duration("tick", defaultTick, "Safety resync interval on main loop, changes from tailscaled are shown immediately")
+		i2cBus           = flags.Int("i2c-bus", 1, "I2C bus number (/dev/i2c-N) for oled and lcd displays")
+		lcdSize          = flags.String("lcd-size", "16x2", "Character LCD geometry: 16x2 or 20x4")
+		controlURL       = flags.String("control-url", "", "Control server to log in to, e.g. a Headscale server, empty for Tailscale's")
+		authKeySources   = flags.String("authkey-sources", "", "Comma separated file:, nocloud: and cmdline: sources of a pre-auth key for unattended login, e.g. file:/boot/edged-authkey, a used key is destroyed")
+		httpAddr         = flags.String("http-addr", "localhost:8080", "Listen address for the http kiosk display, e.g. :8080 to serve the login link to the LAN")
+		metricsAddr      = flags.String("metrics-addr", "localhost:9494", "Listen address for Prometheus metrics on /metrics, empty to disable")
+		stateDir         = flags.String("state-dir", "/var/lib/edged", "Directory for persistent edged state")
+		roleDir          = flags.String("role-dir", "/etc/edged/roles", "Directory of role definitions, one <tag>.yaml per ACL tag")
+		prefsFile        = flags.String("prefs-file", "", "Tailscale preferences to enforce, e.g. /etc/edged/tailscale-prefs.yaml, empty to disable")
+		hostnameTemplate = flags.String("hostname-template", "", "Template deriving the tailscale hostname from device identifiers, e.g. "+device.DefaultHostnameTemplate+", empty to leave the hostname alone")
+		prefsAllow       = flags.String("prefs-allow", "", "Comma separated tailscale prefs fields edged may manage, empty for all")
+		prefsDeny        = flags.String("prefs-deny", "LoggedOut", "Comma separated tailscale prefs fields edged must never manage")
+		dryRun           = flags.Bool("dry-run", false, "Log the tailscale prefs changes the reconciler would make without applying them")
+		output           = flags.String("output", "text", "Output format for subcommands: text or json")
+		networkDir       = flags.String("network-dir", "/etc/systemd/network", "systemd-networkd directory for the static address set on the configuration screen")
+		staticInterface  = flags.String("static-iface", "eth0", "Interface given the static address set on the configuration screen")
+		keyMap           = flags.String("keymap", "", "Comma separated source:key=action mappings added to the defaults, e.g. gpio:17=logout,evdev:KEY_LEFT=configure")
+		gpioChip         = flags.String("gpio-chip", "/dev/gpiochip0", "GPIO character device for button inputs")
+		gpioLines        = flags.String("gpio-lines", "", "Comma separated GPIO line offsets with buttons to ground, empty to disable")
+		evdevDevices     = flags.String("evdev", "", "Comma separated input devices to read keys from, e.g. /dev/input/event0")
+		poisonPill       = flags.Bool("poison-pill", false, "Wipe the device when it is removed from the tailnet")
+		poisonPillDryRun = flags.Bool("poison-pill-dry-run", false, "Log poison-pill wipe steps instead of running them")
+		poisonPillGrace  = flags.Duration("poison-pill-grace", defaultPoisonPillGrace, "Confirmation grace period before the poison-pill wipes the device")
 	)
 
 	if err := flags.Parse(args[1:]); err != nil {
 		return err
 	}
-
-	if tailscale.TailscaledSocket != *tailscaledSocket {
-		tailscale.TailscaledSocket = *tailscaledSocket
-		tailscale.TailscaledSocketSetExplicitly = true
+	explicit := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	var file *File
+	if *configFile != "" {
+		var err error
+		file, err = LoadFile(*configFile)
+		if errors.Is(err, os.ErrNotExist) && !explicit["config-yaml"] {
+			file, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	c.File, c.Roles, c.Prefs, c.WipeSteps = "", nil, nil, nil
+	if file != nil {
+		c.File = *configFile
+		for name, value := range file.flagValues() {
+			if explicit[name] {
+				continue
+			}
+			if err := flags.Set(name, value); err != nil {
+				return fmt.Errorf("%s:%d: %v", *configFile, file.Line(flagPaths[name]), err)
+			}
+		}
+		c.Roles = file.Roles.Definitions
+		if !explicit["prefs-file"] {
+			c.Prefs = file.Tailscale.Prefs
+		}
+		c.WipeSteps = file.PoisonPill.Steps
 	}
 
+	c.Socket = *tailscaledSocket
 	c.Tick = *tick
-	c.DisplayTypes = strings.Split(*displayTypes, ",")
-
+	c.ControlURL = strings.TrimSuffix(*controlURL, "/")
+	c.StateDir = *stateDir
+	c.MetricsAddr = *metricsAddr
+	c.RoleDir = *roleDir
+	c.PrefsFile = *prefsFile
+	c.HostnameTemplate = *hostnameTemplate
+	c.PrefsAllow = splitList(*prefsAllow)
+	c.PrefsDeny = splitList(*prefsDeny)
+	c.DryRun = *dryRun
+	c.Output = *output
+	c.NetworkDir = *networkDir
+	c.StaticInterface = *staticInterface
+	c.GPIOChip = *gpioChip
+	c.EvdevDevices = splitList(*evdevDevices)
+	c.PoisonPill = *poisonPill
+	c.PoisonPillDryRun = *poisonPillDryRun
+	c.PoisonPillGrace = *poisonPillGrace
+	cols, rows, err := parseSize(*lcdSize)
+	if err != nil {
+		return fmt.Errorf("invalid lcd-size: %v", err)
+	}
+	defaults := DisplayConfig{I2CBus: *i2cBus, Cols: cols, Rows: rows, Addr: *httpAddr}
+	c.Displays = nil
+	if file != nil && len(file.Displays) > 0 && !explicit["displays"] {
+		c.Displays = file.displays(defaults)
+	} else {
+		for _, dt := range strings.Split(*displayTypes, ",") {
+			if !validDisplayTypes[dt] {
+				return fmt.Errorf("invalid display type %q, must be any of http,lcd,oled,tui", dt)
+			}
+			d := defaults
+			d.Type = dt
+			c.Displays = append(c.Displays, d)
+		}
+	}
+	km, err := input.ParseKeyMap(*keyMap)
+	if err != nil {
+		return err
+	}
+	c.KeyMap = km
+	c.GPIOLines = nil
+	for _, l := range splitList(*gpioLines) {
+		n, err := strconv.Atoi(strings.TrimSpace(l))
+		if err != nil {
+			return fmt.Errorf("invalid gpio line %q: %v", l, err)
+		}
+		c.GPIOLines = append(c.GPIOLines, n)
+	}
+	if c.ControlURL != "" {
+		u, err := url.Parse(c.ControlURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid control-url %q, want https://host", c.ControlURL)
+		}
+	}
+	if c.AuthKeySources, err = tsutils.ParseAuthKeySources(*authKeySources); err != nil {
+		return err
+	}
+	if c.Output != "text" && c.Output != "json" {
+		return fmt.Errorf("invalid output %q, must be text or json", c.Output)
+	}
+	if c.Tick <= 0 {
+		return fmt.Errorf("invalid tick %v, must be positive", c.Tick)
+	}
 	return nil
 }
+
+// Diff returns the names of the fields that differ between a and b, except
+// for the logger.
+func Diff(a, b *Config) []string {
+	var changed []string
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		name := va.Type().Field(i).Name
+		if name == "Logger" || name == "LogOutput" {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+func newLogger() *zap.Logger {
+	cfg := zap.NewProductionConfig()
+	cfg.Encoding = "console"
+	l, _ := cfg.Build()
+	return l
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
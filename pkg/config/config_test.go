@@ -0,0 +1,161 @@
+package config
+
+import (
+	"go.uber.org/zap"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// writeFile writes a config file for a test and returns its path.
+func writeFile(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "edged.yaml")
+	if err := ioutil.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, `socket: /run/file.sock
+tick: 10s
+displays:
+  - type: lcd
+    size: 20x4
+tailscale:
+  prefsFile: /etc/edged/file-prefs.yaml
+`)
+	c, err := Load([]string{"edged", "-config-yaml", path, "-socket", "/run/flag.sock", "-prefs-file", "/etc/edged/flag-prefs.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.File != path {
+		t.Errorf("File = %q, want %q", c.File, path)
+	}
+	// Flags on the command line take precedence over the file
+	if c.Socket != "/run/flag.sock" || c.PrefsFile != "/etc/edged/flag-prefs.yaml" {
+		t.Errorf("Socket = %q, PrefsFile = %q, want the flags' values", c.Socket, c.PrefsFile)
+	}
+	// Settings without a flag come from the file, the rest from the defaults
+	if c.Tick != 10*time.Second {
+		t.Errorf("Tick = %v, want the file's 10s", c.Tick)
+	}
+	if c.StateDir != "/var/lib/edged" {
+		t.Errorf("StateDir = %q, want the default", c.StateDir)
+	}
+	want := []DisplayConfig{{Type: "lcd", I2CBus: 1, Cols: 20, Rows: 4, Addr: "localhost:8080"}}
+	if !reflect.DeepEqual(c.Displays, want) {
+		t.Errorf("Displays = %+v, want %+v", c.Displays, want)
+	}
+
+	c, err = Load([]string{"edged", "-config-yaml", path, "-displays", "tui"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Displays) != 1 || c.Displays[0].Type != "tui" {
+		t.Errorf("Displays = %+v with -displays=tui, want only the tui", c.Displays)
+	}
+}
+
+func TestLoadInlinePrefs(t *testing.T) {
+	path := writeFile(t, `tailscale:
+  prefs:
+    ShieldsUp: true
+`)
+	c, err := Load([]string{"edged", "-config-yaml", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.PrefsFile != "" || c.Prefs["ShieldsUp"] != true {
+		t.Errorf("PrefsFile = %q, Prefs = %v, want the inline prefs", c.PrefsFile, c.Prefs)
+	}
+	c, err = Load([]string{"edged", "-config-yaml", path, "-prefs-file", "/etc/edged/tailscale-prefs.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.PrefsFile != "/etc/edged/tailscale-prefs.yaml" || c.Prefs != nil {
+		t.Errorf("PrefsFile = %q, Prefs = %v, want -prefs-file to replace the inline prefs", c.PrefsFile, c.Prefs)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "edged.yaml")
+	if _, err := Load([]string{"edged", "-config-yaml", missing}); err == nil {
+		t.Error("loaded a config file that does not exist")
+	}
+
+	path := writeFile(t, "tick: 30s\ndisplays:\n  - type: vga\n")
+	_, err := Load([]string{"edged", "-config-yaml", path})
+	if want := path + `:3: displays[0].type: unknown display type "vga", must be http, lcd, oled or tui`; err == nil || err.Error() != want {
+		t.Errorf("Load error = %v, want %s", err, want)
+	}
+}
+
+func TestLoadErrorsKeepRunningConfig(t *testing.T) {
+	path := writeFile(t, "tick: 30s\n")
+	running, err := Load([]string{"edged", "-config-yaml", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := *running
+
+	if err := ioutil.WriteFile(path, []byte("tick: 30s\ncolour: blue\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"edged", "-config-yaml", path},
+		{"edged", "-tick", "soon"},
+		{"edged", "-tick", "0s"},
+		{"edged", "-bogus"},
+	} {
+		if c, err := Load(args); err == nil || c != nil {
+			t.Errorf("Load(%q) = %+v, %v, want only an error", args[1:], c, err)
+		}
+	}
+	if changed := Diff(&before, running); len(changed) != 0 {
+		t.Errorf("failed loads changed %v in the running config", changed)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	base := func() *Config {
+		return &Config{
+			Socket:   "/run/tailscale/tailscaled.sock",
+			Tick:     30 * time.Second,
+			Displays: []DisplayConfig{{Type: "oled", I2CBus: 1}},
+		}
+	}
+	for _, tt := range []struct {
+		name string
+		edit func(c *Config)
+		want []string
+	}{
+		{"same", func(c *Config) {}, nil},
+		{"logger", func(c *Config) {
+			c.Logger = zap.NewNop()
+			c.LogOutput = ioutil.Discard
+		}, nil},
+		{"tick and socket", func(c *Config) {
+			c.Tick = time.Minute
+			c.Socket = "/tmp/tailscaled.sock"
+		}, []string{"Socket", "Tick"}},
+		{"display setting", func(c *Config) { c.Displays[0].I2CBus = 2 }, []string{"Displays"}},
+		{"display added", func(c *Config) {
+			c.Displays = append(c.Displays, DisplayConfig{Type: "tui"})
+		}, []string{"Displays"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := base()
+			tt.edit(c)
+			got := Diff(base(), c)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,462 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/jtcressy-home/edged/pkg/input"
+	tsutils "github.com/jtcressy-home/edged/pkg/tailscale_utils"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultFile is where edged looks for its YAML configuration.
+const DefaultFile = "/etc/edged/edged.yaml"
+
+// File is the structured YAML configuration of edged. Every setting is
+// optional: those left out keep their flag's value, and flags given on the
+// command line take precedence over the file.
+type File struct {
+	Socket         string         `yaml:"socket"`
+	Tick           time.Duration  `yaml:"tick"`
+	StateDir       string         `yaml:"stateDir"`
+	MetricsAddr    *string        `yaml:"metricsAddr"` // "" to disable
+	ControlURL     string         `yaml:"controlURL"`
+	AuthKeySources []string       `yaml:"authKeySources"`
+	Displays       []FileDisplay  `yaml:"displays"`
+	Inputs         FileInputs     `yaml:"inputs"`
+	Network        FileNetwork    `yaml:"network"`
+	Tailscale      FileTailscale  `yaml:"tailscale"`
+	Roles          FileRoles      `yaml:"roles"`
+	PoisonPill     FilePoisonPill `yaml:"poisonPill"`
+
+	root *yaml.Node
+}
+
+// FileDisplay is a display and its options. Options that do not apply to
+// its type are ignored.
+type FileDisplay struct {
+	Type       string `yaml:"type"`
+	I2CBus     *int   `yaml:"i2cBus"`
+	I2CAddress uint16 `yaml:"i2cAddress"` // 0 for the panel's usual address
+	Size       string `yaml:"size"`       // lcd geometry, e.g. 20x4
+	Addr       string `yaml:"addr"`       // http listen address
+}
+
+type FileInputs struct {
+	KeyMap    map[string]string `yaml:"keymap"`
+	GPIOChip  string            `yaml:"gpioChip"`
+	GPIOLines []int             `yaml:"gpioLines"`
+	Evdev     []string          `yaml:"evdev"`
+}
+
+type FileNetwork struct {
+	Dir       string `yaml:"dir"`
+	Interface string `yaml:"interface"`
+}
+
+type FileTailscale struct {
+	// PrefsFile and Prefs are alternatives: prefs enforced from a separate
+	// file, which the configuration screen can edit, or declared inline.
+	PrefsFile        *string                `yaml:"prefsFile"`
+	Prefs            map[string]interface{} `yaml:"prefs"`
+	HostnameTemplate *string                `yaml:"hostnameTemplate"`
+	Allow            []string               `yaml:"allow"`
+	Deny             []string               `yaml:"deny"`
+	DryRun           *bool                  `yaml:"dryRun"`
+}
+
+type FileRoles struct {
+	Dir string `yaml:"dir"`
+	// Definitions are roles by name, taking precedence over role files.
+	Definitions map[string]RoleConfig `yaml:"definitions"`
+}
+
+type FilePoisonPill struct {
+	Enabled *bool         `yaml:"enabled"`
+	DryRun  *bool         `yaml:"dryRun"`
+	Grace   time.Duration `yaml:"grace"`
+	// Steps replace the default wipe steps.
+	Steps []WipeStepConfig `yaml:"steps"`
+}
+
+// RoleConfig is a role declared in the config file, in the same form as a
+// role file.
+type RoleConfig struct {
+	Steps []RoleStepConfig `yaml:"steps"`
+}
+
+type RoleStepConfig struct {
+	Name    string   `yaml:"name"`
+	Command []string `yaml:"command"`
+	Timeout string   `yaml:"timeout"`
+}
+
+// WipeStepConfig is a poison-pill wipe step: a tailscale logout, a command
+// or paths to remove.
+type WipeStepConfig struct {
+	Name    string   `yaml:"name"`
+	Logout  bool     `yaml:"logout"`
+	Command []string `yaml:"command"`
+	Paths   []string `yaml:"paths"`
+}
+
+// FileError is a problem with the setting at Path, e.g. displays[1].type,
+// on Line of the config file.
+type FileError struct {
+	Line int
+	Path string
+	Msg  string
+}
+
+// FileErrors are all the problems found in a config file.
+type FileErrors struct {
+	Filename string
+	Errors   []FileError
+}
+
+func (e *FileErrors) Error() string {
+	var lines []string
+	for _, fe := range e.Errors {
+		if fe.Path == "" {
+			lines = append(lines, fmt.Sprintf("%s:%d: %s", e.Filename, fe.Line, fe.Msg))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s:%d: %s: %s", e.Filename, fe.Line, fe.Path, fe.Msg))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+var (
+	yamlLineError  = regexp.MustCompile(`line (\d+): (.*)`)
+	yamlFieldError = regexp.MustCompile(`field (\S+) not found in type \S+`)
+)
+
+// LoadFile reads and validates the config file. Problems are reported
+// together as *FileErrors, with the line of each.
+func LoadFile(filename string) (*File, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFile(filename, b)
+}
+
+// ParseFile parses and validates a config file read from filename.
+func ParseFile(filename string, b []byte) (*File, error) {
+	f := &File{root: &yaml.Node{}}
+	errs := &FileErrors{Filename: filename}
+	if err := yaml.Unmarshal(b, f.root); err != nil {
+		errs.Errors = yamlErrors(err)
+		return nil, errs
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(f); err != nil && !errors.Is(err, io.EOF) {
+		errs.Errors = yamlErrors(err)
+		// The rest of the file is still decoded after a type error, so
+		// report its problems too.
+		var te *yaml.TypeError
+		if !errors.As(err, &te) {
+			return nil, errs
+		}
+	}
+	// A setting that failed to decode is not validated again, e.g. a tick
+	// of "soon" is not also reported as not positive.
+	failed := map[int]bool{}
+	for _, fe := range errs.Errors {
+		failed[fe.Line] = true
+	}
+	for _, fe := range f.validate() {
+		if !failed[fe.Line] {
+			errs.Errors = append(errs.Errors, fe)
+		}
+	}
+	sort.SliceStable(errs.Errors, func(i, j int) bool { return errs.Errors[i].Line < errs.Errors[j].Line })
+	if len(errs.Errors) > 0 {
+		return nil, errs
+	}
+	return f, nil
+}
+
+// yamlErrors splits a yaml error into one FileError per line it mentions.
+func yamlErrors(err error) []FileError {
+	msgs := []string{err.Error()}
+	var te *yaml.TypeError
+	if errors.As(err, &te) {
+		msgs = te.Errors
+	}
+	var errs []FileError
+	for _, msg := range msgs {
+		m := yamlLineError.FindStringSubmatch(msg)
+		if m == nil {
+			errs = append(errs, FileError{Msg: msg})
+			continue
+		}
+		line, _ := strconv.Atoi(m[1])
+		errs = append(errs, FileError{Line: line, Msg: yamlFieldError.ReplaceAllString(m[2], "unknown setting $1")})
+	}
+	return errs
+}
+
+// Line returns the line of the setting at path, a dotted path with
+// sequence indexes in brackets such as "displays[1].type". Settings that
+// are not in the file return the line of their closest parent.
+func (f *File) Line(path string) int {
+	n, _ := f.node(path)
+	if n == nil {
+		return 0
+	}
+	return n.Line
+}
+
+// node returns the node at path, or its closest parent and false if path is
+// not in the file.
+func (f *File) node(path string) (*yaml.Node, bool) {
+	n := f.root
+	if n == nil {
+		return nil, false
+	}
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '.' || r == '[' }) {
+		next := (*yaml.Node)(nil)
+		if i, err := strconv.Atoi(strings.TrimSuffix(part, "]")); err == nil && strings.HasSuffix(part, "]") {
+			if n.Kind == yaml.SequenceNode && i < len(n.Content) {
+				next = n.Content[i]
+			}
+		} else if n.Kind == yaml.MappingNode {
+			for j := 0; j+1 < len(n.Content); j += 2 {
+				if n.Content[j].Value == part {
+					next = n.Content[j+1]
+				}
+			}
+		}
+		if next == nil {
+			return n, false
+		}
+		n = next
+	}
+	return n, true
+}
+
+func (f *File) validate() []FileError {
+	var errs []FileError
+	fail := func(path, format string, args ...interface{}) {
+		errs = append(errs, FileError{Line: f.Line(path), Path: path, Msg: fmt.Sprintf(format, args...)})
+	}
+	if _, set := f.node("tick"); f.Tick < 0 || (f.Tick == 0 && set) {
+		fail("tick", "must be positive")
+	}
+	if f.ControlURL != "" {
+		if u, err := url.Parse(f.ControlURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			fail("controlURL", "want https://host, got %q", f.ControlURL)
+		}
+	}
+	for i, s := range f.AuthKeySources {
+		if _, err := tsutils.ParseAuthKeySources(s); err != nil {
+			fail(fmt.Sprintf("authKeySources[%d]", i), "%v", err)
+		}
+	}
+
+	seen := map[string]bool{}
+	for i, d := range f.Displays {
+		path := fmt.Sprintf("displays[%d]", i)
+		switch {
+		case !validDisplayTypes[d.Type]:
+			fail(path+".type", "unknown display type %q, must be http, lcd, oled or tui", d.Type)
+		case seen[d.Type]:
+			fail(path+".type", "%s is configured twice", d.Type)
+		}
+		seen[d.Type] = true
+		if d.I2CBus != nil && *d.I2CBus < 0 {
+			fail(path+".i2cBus", "must not be negative")
+		}
+		if d.I2CAddress > 0x7f {
+			fail(path+".i2cAddress", "0x%x is not a 7-bit I2C address", d.I2CAddress)
+		}
+		if d.Size != "" {
+			if _, _, err := parseSize(d.Size); err != nil {
+				fail(path+".size", "%v", err)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(f.Inputs.KeyMap))
+	for k := range f.Inputs.KeyMap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, err := input.ParseKeyMap(k + "=" + f.Inputs.KeyMap[k]); err != nil {
+			fail("inputs.keymap."+k, "%v", err)
+		}
+	}
+	for i, l := range f.Inputs.GPIOLines {
+		if l < 0 {
+			fail(fmt.Sprintf("inputs.gpioLines[%d]", i), "must not be negative")
+		}
+	}
+
+	if f.Tailscale.Prefs != nil && f.Tailscale.PrefsFile != nil && *f.Tailscale.PrefsFile != "" {
+		fail("tailscale.prefs", "set either prefs or prefsFile, not both")
+	}
+
+	for name, role := range f.Roles.Definitions {
+		path := "roles.definitions." + name
+		if len(role.Steps) == 0 {
+			fail(path, "role has no steps")
+		}
+		for i, s := range role.Steps {
+			stepPath := fmt.Sprintf("%s.steps[%d]", path, i)
+			if s.Name == "" {
+				fail(stepPath+".name", "step needs a name")
+			}
+			if len(s.Command) == 0 {
+				fail(stepPath+".command", "step needs a command")
+			}
+			if s.Timeout != "" {
+				if _, err := time.ParseDuration(s.Timeout); err != nil {
+					fail(stepPath+".timeout", "%v", err)
+				}
+			}
+		}
+	}
+
+	if f.PoisonPill.Grace < 0 {
+		fail("poisonPill.grace", "must not be negative")
+	}
+	names := map[string]bool{}
+	for i, s := range f.PoisonPill.Steps {
+		path := fmt.Sprintf("poisonPill.steps[%d]", i)
+		switch {
+		case s.Name == "":
+			fail(path+".name", "step needs a name")
+		case names[s.Name]:
+			fail(path+".name", "step %s is declared twice", s.Name)
+		}
+		names[s.Name] = true
+		kinds := 0
+		for _, set := range []bool{s.Logout, len(s.Command) > 0, len(s.Paths) > 0} {
+			if set {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			fail(path, "step needs exactly one of logout, command or paths")
+		}
+	}
+	return errs
+}
+
+// flagValues returns the settings that have a flag, as flag values.
+func (f *File) flagValues() map[string]string {
+	v := map[string]string{}
+	set := func(name, value string) {
+		if value != "" {
+			v[name] = value
+		}
+	}
+	set("socket", f.Socket)
+	if f.Tick != 0 {
+		set("tick", f.Tick.String())
+	}
+	set("state-dir", f.StateDir)
+	if f.MetricsAddr != nil {
+		v["metrics-addr"] = *f.MetricsAddr
+	}
+	set("control-url", f.ControlURL)
+	if f.AuthKeySources != nil {
+		v["authkey-sources"] = strings.Join(f.AuthKeySources, ",")
+	}
+
+	var keymap []string
+	for k, action := range f.Inputs.KeyMap {
+		keymap = append(keymap, k+"="+action)
+	}
+	sort.Strings(keymap)
+	set("keymap", strings.Join(keymap, ","))
+	set("gpio-chip", f.Inputs.GPIOChip)
+	var lines []string
+	for _, l := range f.Inputs.GPIOLines {
+		lines = append(lines, strconv.Itoa(l))
+	}
+	set("gpio-lines", strings.Join(lines, ","))
+	set("evdev", strings.Join(f.Inputs.Evdev, ","))
+
+	set("network-dir", f.Network.Dir)
+	set("static-iface", f.Network.Interface)
+
+	t := f.Tailscale
+	if t.PrefsFile != nil {
+		v["prefs-file"] = *t.PrefsFile
+	}
+	if t.Prefs != nil {
+		// Inline prefs replace the prefs file
+		v["prefs-file"] = ""
+	}
+	if t.HostnameTemplate != nil {
+		v["hostname-template"] = *t.HostnameTemplate
+	}
+	if t.Allow != nil {
+		v["prefs-allow"] = strings.Join(t.Allow, ",")
+	}
+	if t.Deny != nil {
+		v["prefs-deny"] = strings.Join(t.Deny, ",")
+	}
+	if t.DryRun != nil {
+		v["dry-run"] = strconv.FormatBool(*t.DryRun)
+	}
+
+	set("role-dir", f.Roles.Dir)
+
+	p := f.PoisonPill
+	if p.Enabled != nil {
+		v["poison-pill"] = strconv.FormatBool(*p.Enabled)
+	}
+	if p.DryRun != nil {
+		v["poison-pill-dry-run"] = strconv.FormatBool(*p.DryRun)
+	}
+	if p.Grace != 0 {
+		set("poison-pill-grace", p.Grace.String())
+	}
+	return v
+}
+
+// displays returns the file's displays, with options left out taken from
+// defaults, the flags' values.
+func (f *File) displays(defaults DisplayConfig) []DisplayConfig {
+	var displays []DisplayConfig
+	for _, fd := range f.Displays {
+		d := defaults
+		d.Type = fd.Type
+		if fd.I2CBus != nil {
+			d.I2CBus = *fd.I2CBus
+		}
+		d.I2CAddress = fd.I2CAddress
+		if fd.Size != "" {
+			d.Cols, d.Rows, _ = parseSize(fd.Size)
+		}
+		if fd.Addr != "" {
+			d.Addr = fd.Addr
+		}
+		displays = append(displays, d)
+	}
+	return displays
+}
+
+// parseSize parses a character display geometry such as 16x2.
+func parseSize(s string) (cols, rows int, err error) {
+	if _, err := fmt.Sscanf(s, "%dx%d", &cols, &rows); err != nil || cols <= 0 || rows <= 0 {
+		return 0, 0, fmt.Errorf("invalid size %q, want e.g. 16x2 or 20x4", s)
+	}
+	return cols, rows, nil
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"errors"
+	"testing"
+)
+
+const validFile = `socket: /run/tailscale/tailscaled.sock
+tick: 30s
+displays:
+  - type: oled
+  - type: lcd
+    size: 20x4
+roles:
+  definitions:
+    web:
+      steps:
+        - name: install
+          command: [apt-get, install, -y, nginx]
+        - name: start
+          command: [systemctl, start, nginx]
+          timeout: 1m
+`
+
+func TestParseFileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{
+			name: "syntax",
+			yaml: "tick: 30s\nsocket: a: b\n",
+			want: "edged.yaml:2: mapping values are not allowed in this context",
+		},
+		{
+			name: "unknown key",
+			yaml: "tick: 30s\ncolour: blue\n",
+			want: "edged.yaml:2: unknown setting colour",
+		},
+		{
+			name: "nested unknown key",
+			yaml: "displays:\n  - type: lcd\n    colour: blue\n",
+			want: "edged.yaml:3: unknown setting colour",
+		},
+		{
+			name: "invalid value",
+			yaml: "displays:\n  - type: oled\n  - type: vga\n",
+			want: `edged.yaml:3: displays[1].type: unknown display type "vga", must be http, lcd, oled or tui`,
+		},
+		{
+			name: "nested invalid value",
+			yaml: "roles:\n  definitions:\n    web:\n      steps:\n        - name: start\n          command: [true]\n          timeout: soon\n",
+			want: `edged.yaml:7: roles.definitions.web.steps[0].timeout: time: invalid duration "soon"`,
+		},
+		{
+			name: "type error and invalid values, in line order",
+			yaml: "controlURL: ftp://example.com\ntick: soon\ninputs:\n  gpioLines: [-1]\n",
+			want: "edged.yaml:1: controlURL: want https://host, got \"ftp://example.com\"\n" +
+				"edged.yaml:2: cannot unmarshal !!str `soon` into time.Duration\n" +
+				"edged.yaml:4: inputs.gpioLines[0]: must not be negative",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseFile("edged.yaml", []byte(tt.yaml))
+			var fe *FileErrors
+			if !errors.As(err, &fe) {
+				t.Fatalf("ParseFile error = %v, want *FileErrors", err)
+			}
+			if got := err.Error(); got != tt.want {
+				t.Errorf("ParseFile error:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileLine(t *testing.T) {
+	f, err := ParseFile("edged.yaml", []byte(validFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]int{
+		"tick":                                   2,
+		"displays[1]":                            5,
+		"displays[1].size":                       6,
+		"roles.definitions.web.steps[1].timeout": 15,
+		// Settings left out are on their closest parent's line
+		"displays[1].addr": 5,
+		"displays[7].type": 4,
+		"inputs.keymap":    1,
+	} {
+		if got := f.Line(path); got != want {
+			t.Errorf("Line(%q) = %d, want %d", path, got, want)
+		}
+	}
+}
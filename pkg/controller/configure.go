@@ -0,0 +1,450 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jtcressy-home/edged/pkg/display"
+	"github.com/jtcressy-home/edged/pkg/input"
+	"github.com/jtcressy-home/edged/pkg/netconf"
+	"github.com/jtcressy-home/edged/pkg/reconcile"
+	tsutils "github.com/jtcressy-home/edged/pkg/tailscale_utils"
+	"inet.af/netaddr"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"tailscale.com/ipn"
+)
+
+// editCharset is what the up and down keys cycle through when a value is
+// entered without a keyboard, e.g. with a joystick.
+const editCharset = "abcdefghijklmnopqrstuvwxyz0123456789.-/:,"
+
+var validHostname = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+type configKind int
+
+const (
+	configText configKind = iota
+	configBool
+	configButton
+)
+
+// configField is a setting on the configuration screen. Prefs fields are
+// saved to the prefs file, the rest configure the network.
+type configField struct {
+	label string
+	kind  configKind
+	pref  string // ipn.Prefs field, if any
+	value string
+	orig  string
+}
+
+// ConfigEditor is the on-device configuration screen. It edits the prefs
+// enforced by the reconciler, writing them back to the prefs file, and the
+// static address of the wired interface.
+type ConfigEditor struct {
+	PrefsFile string
+	Network   *netconf.Networkd
+	// OnControlURL is called with a Control URL once it is saved, "" when
+	// released, so that logins go to the new control server.
+	OnControlURL func(url string)
+
+	client  *tsutils.Client
+	active  bool
+	fields  []*configField
+	static  *netconf.Static // as read from networkd when opened
+	cursor  int
+	editing bool
+	edit    []rune
+	pos     int
+	message string
+}
+
+// Field indexes, in the order they are shown.
+const (
+	cfgHostname = iota
+	cfgRunSSH
+	cfgRoutes
+	cfgExitNode
+	cfgControlURL
+	cfgAddress
+	cfgGateway
+	cfgSave
+	cfgCancel
+)
+
+func NewConfigEditor(client *tsutils.Client, prefsFile string, network *netconf.Networkd) *ConfigEditor {
+	return &ConfigEditor{client: client, PrefsFile: prefsFile, Network: network}
+}
+
+// Active reports whether the configuration screen is open.
+func (e *ConfigEditor) Active() bool {
+	return e.active
+}
+
+// Open loads the current settings and shows the configuration screen. Prefs
+// declared in the prefs file are shown as declared, the rest as tailscaled
+// has them.
+func (e *ConfigEditor) Open(ctx context.Context) {
+	e.active, e.cursor, e.editing, e.message = true, 0, false, ""
+	current, err := e.client.GetPrefs(ctx)
+	if err != nil {
+		log.Printf("configure: error getting prefs: %v", err)
+		current = ipn.NewPrefs()
+	}
+	prefs := current
+	exitNode := ""
+	if e.PrefsFile != "" {
+		declared, fields, err := reconcile.LoadPrefsFile(e.PrefsFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			e.message = "Prefs file: " + err.Error()
+		}
+		if err == nil {
+			prefs = current.Clone()
+			for _, f := range fields {
+				copyPref(prefs, declared.Prefs, f)
+			}
+			exitNode = declared.ExitNode
+		}
+	}
+	var routes []string
+	for _, r := range prefs.AdvertiseRoutes {
+		routes = append(routes, r.String())
+	}
+	if exitNode == "" && !prefs.ExitNodeIP.IsZero() {
+		exitNode = prefs.ExitNodeIP.String()
+	}
+	if exitNode == "" && prefs.ExitNodeID != "" {
+		exitNode = string(prefs.ExitNodeID)
+		if status, err := e.client.Status(ctx); err == nil {
+			for _, peer := range status.Peer {
+				if peer.ID == prefs.ExitNodeID {
+					exitNode = peer.HostName
+				}
+			}
+		}
+	}
+	address, gateway := "dhcp", ""
+	e.static = nil
+	if e.Network != nil {
+		static, err := e.Network.Read()
+		if err != nil {
+			e.message = err.Error()
+		} else if static != nil {
+			e.static = static
+			address = static.Address.String()
+			if !static.Gateway.IsZero() {
+				gateway = static.Gateway.String()
+			}
+		}
+	}
+
+	e.fields = []*configField{
+		cfgHostname:   {label: "Hostname", kind: configText, pref: "Hostname", value: prefs.Hostname},
+		cfgRunSSH:     {label: "Run SSH", kind: configBool, pref: "RunSSH", value: onOff(prefs.RunSSH)},
+		cfgRoutes:     {label: "Routes", kind: configText, pref: "AdvertiseRoutes", value: strings.Join(routes, ",")},
+		cfgExitNode:   {label: "Exit node", kind: configText, pref: reconcile.ExitNodeKey, value: exitNode},
+		cfgControlURL: {label: "Control URL", kind: configText, pref: "ControlURL", value: prefs.ControlURL},
+		cfgAddress:    {label: "Address", kind: configText, value: address},
+		cfgGateway:    {label: "Gateway", kind: configText, value: gateway},
+		cfgSave:       {label: "Save", kind: configButton},
+		cfgCancel:     {label: "Cancel", kind: configButton},
+	}
+	if e.PrefsFile == "" {
+		e.message = "No prefs file, prefs are read-only"
+	}
+	for _, f := range e.fields {
+		f.orig = f.value
+	}
+}
+
+// Handle acts on an input event while the screen is open. Events it has no
+// use for, like quitting, are left to the caller.
+func (e *ConfigEditor) Handle(ctx context.Context, ev input.Event) bool {
+	if !e.active {
+		return false
+	}
+	if e.editing {
+		return e.handleEdit(ev)
+	}
+	f := e.fields[e.cursor]
+	switch ev.Action {
+	case input.Up:
+		e.cursor = (e.cursor + len(e.fields) - 1) % len(e.fields)
+	case input.Down:
+		e.cursor = (e.cursor + 1) % len(e.fields)
+	case input.Left, input.Right:
+		if f.kind == configBool {
+			f.value = onOff(f.value != "on")
+		}
+	case input.Select:
+		switch {
+		case f.kind == configBool:
+			f.value = onOff(f.value != "on")
+		case f.kind == configText:
+			e.editing = true
+			e.edit = []rune(f.value)
+			e.pos = len(e.edit)
+		case e.cursor == cfgSave:
+			if err := e.save(ctx); err != nil {
+				e.message = err.Error()
+				return true
+			}
+			e.active = false
+		case e.cursor == cfgCancel:
+			e.active = false
+		}
+	case input.Cancel:
+		e.active = false
+	default:
+		return false
+	}
+	e.message = ""
+	return true
+}
+
+// handleEdit edits the selected value. With a keyboard it is typed as usual,
+// without one the up and down keys cycle the character under the cursor and
+// left at the end of the value erases.
+func (e *ConfigEditor) handleEdit(ev input.Event) bool {
+	if ev.Source == "tui" && len([]rune(ev.Key)) == 1 {
+		// Typed characters may also be mapped, like q to quit
+		ev.Action = input.Type
+	}
+	switch ev.Action {
+	case input.Type:
+		r := []rune(ev.Key)[0]
+		e.edit = append(e.edit[:e.pos], append([]rune{r}, e.edit[e.pos:]...)...)
+		e.pos++
+	case input.Erase:
+		if e.pos > 0 {
+			e.edit = append(e.edit[:e.pos-1], e.edit[e.pos:]...)
+			e.pos--
+		}
+	case input.Up, input.Down:
+		step := 1
+		if ev.Action == input.Down {
+			step = -1
+		}
+		charset := []rune(editCharset)
+		i := -1
+		if e.pos == len(e.edit) {
+			e.edit = append(e.edit, 0)
+		} else {
+			for j, r := range charset {
+				if r == e.edit[e.pos] {
+					i = j
+				}
+			}
+		}
+		if i < 0 && step < 0 {
+			i = 0
+		}
+		e.edit[e.pos] = charset[(i+step+len(charset))%len(charset)]
+	case input.Right:
+		if e.pos < len(e.edit) {
+			e.pos++
+		}
+	case input.Left:
+		if e.pos == len(e.edit) && e.pos > 0 {
+			e.edit = e.edit[:e.pos-1]
+		}
+		if e.pos > 0 {
+			e.pos--
+		}
+	case input.Select:
+		f := e.fields[e.cursor]
+		value := strings.TrimSpace(string(e.edit))
+		if err := e.validateField(e.cursor, value); err != nil {
+			e.message = err.Error()
+			return true
+		}
+		f.value = value
+		e.editing = false
+	case input.Cancel:
+		e.editing = false
+	default:
+		return false
+	}
+	e.message = ""
+	return true
+}
+
+// Status is the screen as shown on the displays.
+func (e *ConfigEditor) Status() *display.ConfigStatus {
+	s := &display.ConfigStatus{Cursor: e.cursor, Editing: e.editing, Message: e.message}
+	for i, f := range e.fields {
+		value := f.value
+		switch {
+		case e.editing && i == e.cursor:
+			if e.pos == len(e.edit) {
+				value = string(e.edit) + "_"
+			} else {
+				value = string(e.edit[:e.pos]) + "[" + string(e.edit[e.pos]) + "]" + string(e.edit[e.pos+1:])
+			}
+		case f.kind == configButton:
+			value = ""
+		case value == "" && i == cfgHostname:
+			value = "<from template>"
+		case value == "" && i == cfgControlURL:
+			value = "<default>"
+		case value == "":
+			value = "<none>"
+		}
+		s.Rows = append(s.Rows, display.ConfigRow{Label: f.label, Value: value})
+	}
+	return s
+}
+
+// save writes the changed prefs to the prefs file for the reconciler to
+// apply, and the network settings to networkd. Everything is validated
+// before anything is written, and an error says which part was not saved.
+func (e *ConfigEditor) save(ctx context.Context) error {
+	for i, f := range e.fields {
+		if err := e.validateField(i, f.value); err != nil {
+			return err
+		}
+	}
+	edits := map[string]interface{}{}
+	for _, f := range e.fields {
+		if f.pref == "" || f.value == f.orig {
+			continue
+		}
+		switch f.pref {
+		case "RunSSH":
+			edits[f.pref] = f.value == "on"
+		case "AdvertiseRoutes":
+			routes := []string{}
+			for _, r := range strings.Split(f.value, ",") {
+				if r = strings.TrimSpace(r); r != "" {
+					routes = append(routes, r)
+				}
+			}
+			edits[f.pref] = routes
+		case "Hostname", "ControlURL":
+			// Empty releases the pref, back to the template or default
+			if f.value == "" {
+				edits[f.pref] = nil
+			} else {
+				edits[f.pref] = f.value
+			}
+		default:
+			edits[f.pref] = f.value
+		}
+	}
+	if len(edits) > 0 && e.PrefsFile == "" {
+		return fmt.Errorf("no prefs file to save to")
+	}
+	address, gateway := e.fields[cfgAddress], e.fields[cfgGateway]
+	network := e.Network != nil && (address.value != address.orig || gateway.value != gateway.orig)
+	var static *netconf.Static
+	if network && address.value != "dhcp" {
+		// Only the address and gateway are edited here, DNS servers and
+		// the like in the file are kept.
+		static = &netconf.Static{}
+		if e.static != nil {
+			*static = *e.static
+		}
+		static.Address = netaddr.MustParseIPPrefix(address.value)
+		static.Gateway = netaddr.IP{}
+		if gateway.value != "" {
+			static.Gateway = netaddr.MustParseIP(gateway.value)
+		}
+	}
+
+	if len(edits) > 0 {
+		if err := reconcile.UpdatePrefsFile(e.PrefsFile, edits); err != nil {
+			return fmt.Errorf("Prefs not saved: %v", err)
+		}
+		log.Printf("configure: saved %d prefs to %s", len(edits), e.PrefsFile)
+		if f := e.fields[cfgControlURL]; f.value != f.orig && e.OnControlURL != nil {
+			e.OnControlURL(f.value)
+		}
+		// Saving again after a network error does not write them twice
+		for _, f := range e.fields {
+			if f.pref != "" {
+				f.orig = f.value
+			}
+		}
+	}
+	if network {
+		if err := e.Network.Write(static); err != nil {
+			return fmt.Errorf("Network not saved: %v", err)
+		}
+		if err := e.Network.Reload(ctx); err != nil {
+			return fmt.Errorf("Network saved, not applied: %v", err)
+		}
+		e.static = static
+		address.orig, gateway.orig = address.value, gateway.value
+		log.Printf("configure: set %s address to %s", e.Network.Interface, address.value)
+	}
+	return nil
+}
+
+// validateField checks value for the field at i, in the context of the
+// other fields, e.g. a gateway needs a static address.
+func (e *ConfigEditor) validateField(i int, value string) error {
+	if value == "" {
+		if i == cfgAddress {
+			return fmt.Errorf("Address: dhcp or a CIDR")
+		}
+		return nil
+	}
+	switch i {
+	case cfgHostname:
+		if !validHostname.MatchString(value) {
+			return fmt.Errorf("Hostname: only a-z, 0-9 and -")
+		}
+	case cfgRoutes:
+		for _, r := range strings.Split(value, ",") {
+			if _, err := netaddr.ParseIPPrefix(strings.TrimSpace(r)); err != nil {
+				return fmt.Errorf("Routes: bad CIDR %q", r)
+			}
+		}
+	case cfgExitNode:
+		if _, err := netaddr.ParseIP(value); err == nil {
+			return nil
+		}
+		for _, label := range strings.Split(strings.TrimSuffix(value, "."), ".") {
+			if !validHostname.MatchString(label) {
+				return fmt.Errorf("Exit node: IP or hostname")
+			}
+		}
+	case cfgGateway:
+		if _, err := netaddr.ParseIP(value); err != nil {
+			return fmt.Errorf("Not an IP: %q", value)
+		}
+		if e.fields[cfgAddress].value == "dhcp" {
+			return fmt.Errorf("Gateway: set a static Address first")
+		}
+	case cfgControlURL:
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("Control URL: want https://host")
+		}
+	case cfgAddress:
+		if value == "dhcp" {
+			return nil
+		}
+		if _, err := netaddr.ParseIPPrefix(value); err != nil {
+			return fmt.Errorf("Address: dhcp or ip/len")
+		}
+	}
+	return nil
+}
+
+// copyPref copies field from src to dst.
+func copyPref(dst, src *ipn.Prefs, field string) {
+	reflect.ValueOf(dst).Elem().FieldByName(field).Set(reflect.ValueOf(src).Elem().FieldByName(field))
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
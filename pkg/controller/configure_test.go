@@ -0,0 +1,181 @@
+package controller
+
+import (
+	"context"
+	"github.com/jtcressy-home/edged/pkg/input"
+	"github.com/jtcressy-home/edged/pkg/netconf"
+	"github.com/jtcressy-home/edged/pkg/reconcile"
+	tsutils "github.com/jtcressy-home/edged/pkg/tailscale_utils"
+	"github.com/jtcressy-home/edged/pkg/tstest"
+	"inet.af/netaddr"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// openEditor opens a configuration screen on a fake tailscaled, with a
+// prefs file and a .network file in a temporary directory.
+func openEditor(t *testing.T, prefs, network string) *ConfigEditor {
+	t.Helper()
+	dir := t.TempDir()
+	f, err := tstest.NewLocalAPI(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	n := &netconf.Networkd{Dir: filepath.Join(dir, "network"), Interface: "eth0", Networkctl: "true"}
+	if network != "" {
+		writeFile(t, filepath.Join(n.Dir, "05-edged-eth0.network"), network)
+	}
+	prefsFile := filepath.Join(dir, "prefs.yaml")
+	writeFile(t, prefsFile, prefs)
+	e := NewConfigEditor(tsutils.NewClient(f.Socket), prefsFile, n)
+	e.Open(context.Background())
+	if e.message != "" {
+		t.Fatalf("opening the screen: %s", e.message)
+	}
+	return e
+}
+
+func writeFile(t *testing.T, filename, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// enter edits the field at i to value, as typed on a keyboard.
+func enter(e *ConfigEditor, i int, value string) {
+	e.cursor = i
+	e.Handle(context.Background(), input.Event{Action: input.Select})
+	for range e.edit {
+		e.Handle(context.Background(), input.Event{Action: input.Erase})
+	}
+	for _, r := range value {
+		e.Handle(context.Background(), input.Event{Source: "tui", Key: string(r)})
+	}
+	e.Handle(context.Background(), input.Event{Action: input.Select})
+}
+
+func saveEditor(e *ConfigEditor) {
+	e.cursor = cfgSave
+	e.Handle(context.Background(), input.Event{Action: input.Select})
+}
+
+func TestConfigEditorSave(t *testing.T) {
+	network := "[Match]\nName=eth0\n\n[Network]\nAddress=192.168.1.10/24\nGateway=192.168.1.1\nDNS=1.1.1.1\n"
+	e := openEditor(t, "Hostname: edge1\nShieldsUp: true\n", network)
+	var controlURL []string
+	e.OnControlURL = func(url string) { controlURL = append(controlURL, url) }
+
+	enter(e, cfgHostname, "")
+	e.cursor = cfgRunSSH
+	e.Handle(context.Background(), input.Event{Action: input.Select})
+	enter(e, cfgRoutes, "10.0.0.0/24, 10.1.0.0/16")
+	enter(e, cfgAddress, "10.0.0.5/8")
+	enter(e, cfgGateway, "10.0.0.1")
+	saveEditor(e)
+	if e.Active() || e.message != "" {
+		t.Fatalf("screen still open after saving: %s", e.message)
+	}
+
+	declared, fields, err := reconcile.LoadPrefsFile(e.PrefsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"AdvertiseRoutes", "RunSSH", "ShieldsUp"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("prefs file declares %v, want %v", fields, want)
+	}
+	if !declared.RunSSH || len(declared.AdvertiseRoutes) != 2 {
+		t.Errorf("saved RunSSH %v and AdvertiseRoutes %v", declared.RunSSH, declared.AdvertiseRoutes)
+	}
+	if controlURL != nil {
+		t.Errorf("OnControlURL called with %q, the Control URL was not changed", controlURL)
+	}
+
+	static, err := e.Network.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &netconf.Static{
+		Address: netaddr.MustParseIPPrefix("10.0.0.5/8"),
+		Gateway: netaddr.MustParseIP("10.0.0.1"),
+		DNS:     []netaddr.IP{netaddr.MustParseIP("1.1.1.1")},
+	}
+	if !reflect.DeepEqual(static, want) {
+		t.Errorf("saved network %+v, want %+v", static, want)
+	}
+
+	// Back to DHCP removes the .network file
+	e.Open(context.Background())
+	enter(e, cfgGateway, "")
+	enter(e, cfgAddress, "dhcp")
+	saveEditor(e)
+	if static, err := e.Network.Read(); static != nil || err != nil {
+		t.Errorf("network after going back to dhcp = %+v, %v, want no file", static, err)
+	}
+}
+
+func TestConfigEditorSaveNetworkError(t *testing.T) {
+	e := openEditor(t, "", "")
+	e.Network.Networkctl = "false"
+	enter(e, cfgHostname, "edge2")
+	enter(e, cfgAddress, "10.0.0.5/8")
+	saveEditor(e)
+	if !e.Active() || !strings.HasPrefix(e.message, "Network saved, not applied: ") {
+		t.Errorf("saving with networkctl failing: active %v, message %q", e.Active(), e.message)
+	}
+	if declared, _, err := reconcile.LoadPrefsFile(e.PrefsFile); err != nil || declared.Hostname != "edge2" {
+		t.Errorf("prefs were not saved before the network: %v", err)
+	}
+
+	// Prefs that don't load are not half saved
+	e = openEditor(t, "", "")
+	writeFile(t, e.PrefsFile, "Hostname: [")
+	enter(e, cfgHostname, "edge2")
+	enter(e, cfgAddress, "10.0.0.5/8")
+	saveEditor(e)
+	if !strings.HasPrefix(e.message, "Prefs not saved: ") {
+		t.Errorf("saving to a broken prefs file: message %q", e.message)
+	}
+	if static, _ := e.Network.Read(); static != nil {
+		t.Errorf("network saved although the prefs were not: %+v", static)
+	}
+}
+
+func TestConfigEditorValidate(t *testing.T) {
+	for _, tt := range []struct {
+		field int
+		value string
+		want  string
+	}{
+		{cfgHostname, "Edge_1", "Hostname: only a-z, 0-9 and -"},
+		{cfgRoutes, "10.0.0.0/24,bogus", `Routes: bad CIDR "bogus"`},
+		{cfgExitNode, "exit node", "Exit node: IP or hostname"},
+		{cfgControlURL, "ftp://example.com", "Control URL: want https://host"},
+		{cfgAddress, "", "Address: dhcp or a CIDR"},
+		{cfgAddress, "10.0.0.5", "Address: dhcp or ip/len"},
+		{cfgGateway, "10.0.0", `Not an IP: "10.0.0"`},
+		{cfgGateway, "10.0.0.1", "Gateway: set a static Address first"},
+	} {
+		e := openEditor(t, "", "")
+		enter(e, tt.field, tt.value)
+		if !e.editing || e.message != tt.want {
+			t.Errorf("entering %q in %s: editing %v, message %q, want %q", tt.value, e.fields[tt.field].label, e.editing, e.message, tt.want)
+		}
+	}
+
+	// A gateway left behind going back to dhcp is caught on save
+	e := openEditor(t, "", "[Network]\nAddress=10.0.0.5/8\nGateway=10.0.0.1\n")
+	enter(e, cfgAddress, "dhcp")
+	saveEditor(e)
+	if !e.Active() || e.message != "Gateway: set a static Address first" {
+		t.Errorf("saving a gateway with dhcp: active %v, message %q", e.Active(), e.message)
+	}
+}
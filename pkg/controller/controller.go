@@ -2,107 +2,196 @@ package controller
 
 import (
 	"context"
-	ui "github.com/gizak/termui/v3"
 	"github.com/jtcressy-home/edged/pkg/config"
 	"github.com/jtcressy-home/edged/pkg/display"
+	"github.com/jtcressy-home/edged/pkg/input"
+	"github.com/jtcressy-home/edged/pkg/netconf"
+	"github.com/jtcressy-home/edged/pkg/reconcile"
 	tsutils "github.com/jtcressy-home/edged/pkg/tailscale_utils"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"reflect"
 	"syscall"
-	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
 	"time"
 )
 
+// authKeysStateFile records the pre-auth keys the login manager has used or
+// had rejected, in the state dir.
+const authKeysStateFile = "authkeys.json"
+
 type Controller struct {
 	c             *config.Config
 	d             *display.Set
 	Mode          Mode
 	ticker        *time.Ticker
-	cw            *tsutils.CliWrapper
+	client        *tsutils.Client
+	watcher       *tsutils.Watcher
+	login         *tsutils.LoginManager
+	pp            *PoisonPill
+	prov          *ProvisioningController
+	rec           *reconcile.Reconciler
+	cfg           *ConfigEditor
+	input         *input.Mux
+	inputs        []input.Source
 	interruptChan chan os.Signal
+	reloads       chan reload
+
+	// displaysFromConfig is set when the displays are the ones named in
+	// the config, so a reload can change them.
+	displaysFromConfig bool
+	// pollingTerminal is set once the terminal's keys are read, which can
+	// only be done once.
+	pollingTerminal bool
+	// savedControlURL is the Control URL saved on the configuration
+	// screen. It is used over the config's until that changes, so a reload
+	// of the same config keeps it.
+	savedControlURL string
+
+	// lastState is the BackendState seen on the previous loop, used to
+	// detect the device being removed from the tailnet.
+	lastState string
+	// loggingOut is set while a locally requested logout is in progress so
+	// it is not mistaken for a removal from the tailnet.
+	loggingOut bool
+	// dropped is set when tailscaled fell from Running to NeedsLogin without
+	// a local logout, until it is back to Running.
+	dropped bool
+	removal removalDetector
+
+	// status is tailscaled's status from the last resync and data what was
+	// last sent to the displays, reused to redraw and animate them.
+	status *ipnstate.Status
+	data   display.RefreshData
+	// progressAt is when the progress of local work is next redrawn, zero
+	// when none is shown.
+	progressAt time.Time
 }
 
 func (c *Controller) Run(ctx context.Context) error {
 	log.Println("Starting edged controller")
-	defer c.cw.WaitForAll()
 	defer c.ticker.Stop()
 	signal.Notify(c.interruptChan, os.Interrupt)
-loop:
-	for {
-		tailscaleStatus, err := tailscale.Status(ctx)
-		if err != nil {
-			return err
-		}
-		if tailscaleStatus.BackendState == ipn.NeedsLogin.String() && tailscaleStatus.AuthURL == "" {
-			//Trigger interactive login
-			//TODO: This is VERY hacky and should be replaced with an official api once it's implemented
-			if !c.cw.IsRunning() {
-				if err := c.cw.Run([]string{"up"}); err != nil {
-					return err
-				}
+	if c.pp != nil {
+		if _, err := c.pp.Resume(ctx); err != nil {
+			log.Printf("error resuming poison-pill: %v", err)
+		}
+	}
+	go func() {
+		if err := c.watcher.Run(ctx); err != nil {
+			log.Printf("error watching tailscaled: %v", err)
+		}
+	}()
+	go func() {
+		if err := c.login.Run(ctx); err != nil {
+			log.Printf("error running login manager: %v", err)
+		}
+	}()
+	c.pollTerminal(ctx)
+	for _, src := range c.inputs {
+		go c.input.Run(ctx, src)
+	}
+	if c.rec != nil {
+		go func() {
+			if err := c.rec.Run(ctx); err != nil {
+				log.Printf("error running reconciler: %v", err)
 			}
+		}()
+		if c.c.MetricsAddr != "" {
+			go c.serveMetrics(ctx)
 		}
-
-		switch tailscaleStatus.BackendState {
-		case ipn.Running.String():
-			if c.Mode == Bootstrap {
-				c.Mode = Running
+	}
+	next := nextResync
+loop:
+	for {
+		switch next {
+		case nextResync:
+			if err := c.resync(ctx); err != nil {
+				return err
 			}
-		case ipn.NeedsLogin.String():
-			if c.Mode != Bootstrap {
-				c.Mode = Bootstrap
+		case nextRedraw:
+			if err := c.redraw(); err != nil {
+				return err
 			}
+		case nextAnimate:
+			c.d.Animate(c.data)
 		}
+		next = nextResync
 
-		//TODO: Figure out what needs to trigger Provisioning mode
-
-		if c.Mode == Bootstrap {
-			c.d.SetLayout(display.Bootstrap)
-		} else if c.Mode == ConfigurationPending {
-			c.d.SetLayout(display.Configuration)
-		} else {
-			c.d.SetLayout(display.Running)
+		//Progress of local work is not reported on the IPN bus, redraw it while shown.
+		//Displays that scroll or page on their own ask for their next frame.
+		var progress, frame <-chan time.Time
+		if !c.progressAt.IsZero() {
+			progress = time.After(time.Until(c.progressAt))
 		}
-
-		//Refresh all status info and send to displays
-		if err := c.d.Refresh(display.RefreshData{
-			TailscaleStatus: tailscaleStatus,
-		}); err != nil {
-			return err
+		if at := c.d.NextFrame(); !at.IsZero() {
+			frame = time.After(time.Until(at))
 		}
 
-		//Render displays
-		c.d.Clear()
-		c.d.Render()
+		var reconciled <-chan struct{}
+		if c.rec != nil {
+			reconciled = c.rec.Changes()
+		}
 
 		//Handle end of loop
 		select {
 		case <-ctx.Done():
 			return nil
-		case <-c.ticker.C:
+		case <-c.ticker.C: //Safety resync, changes normally arrive on the IPN bus
+			continue
+		case <-c.watcher.Changes():
+			continue
+		case <-progress:
+			next = nextRedraw
+			continue
+		case <-frame:
+			next = nextAnimate
+			continue
+		case <-c.login.AuthURLs():
+			continue
+		case <-reconciled:
 			continue
 		case <-c.interruptChan:
 			break loop
-		case e := <-c.d.PollEvents():
-			switch e.ID {
-			case "q", "<C-c>":
-				log.Default().Println("Received quit command from TUI")
+		case r := <-c.reloads:
+			c.applyConfig(ctx, r.config)
+			close(r.done)
+		case e := <-c.input.Events():
+			//Input only changes local state, tailscaled reports its own changes on the bus
+			next = nextRedraw
+			if c.Mode == ConfigurationPending && c.cfg.Handle(ctx, e) {
+				if !c.cfg.Active() {
+					c.Mode = Bootstrap
+				}
+				continue
+			}
+			switch e.Action {
+			case input.Quit:
+				log.Printf("Received quit command from %s", e)
 				return syscall.Kill(syscall.Getpid(), syscall.SIGINT)
-			case "<L-l>": //Logout
+			case input.Logout:
 				if c.Mode == Running {
-					if err := tailscale.Logout(ctx); err != nil {
+					c.loggingOut = true
+					if err := c.client.Logout(ctx); err != nil {
 						log.Fatalf("error running logout command: %v", err)
 						return err
 					}
 				}
-			case "<F2>": //Configure
-				c.Mode = ConfigurationPending
-				c.d.SetLayout(display.Configuration)
-			case "<Resize>": //TODO: Capture this inside display.go instead somehow
-				payload := e.Payload.(ui.Resize)
-				c.d.Resize(payload.Width, payload.Height)
+			case input.Cancel: //Cancel a pending poison-pill, or give up on a failed one
+				if c.pp != nil && (c.pp.Cancel() || c.pp.Acknowledge()) {
+					c.Mode = Bootstrap
+				}
+			case input.Configure:
+				if c.Mode != Deprovisioning && c.Mode != ConfigurationPending {
+					c.cfg.Open(ctx)
+					c.Mode = ConfigurationPending
+				}
+			case input.Resize:
+				c.d.Resize(e.Width, e.Height)
 				c.d.Clear()
 				c.d.Render()
 			}
@@ -111,43 +200,357 @@ loop:
 	return nil
 }
 
-func (c *Controller) CleanUp() {
-	c.d.CleanUp()
+// What the controller loop does next: resync asks tailscaled for its status,
+// redraw shows the progress of local work with the last status and animate
+// only moves the displays that scroll or page on to their next frame.
+const (
+	nextResync = iota
+	nextRedraw
+	nextAnimate
+)
+
+// resync gets tailscaled's status and acts on it before redrawing.
+func (c *Controller) resync(ctx context.Context) error {
+	status, err := c.client.Status(ctx)
+	if err != nil {
+		return err
+	}
+	c.status = status
+	c.checkPoisonPill(ctx, status.BackendState)
+	deprovisioning := c.pp != nil && c.pp.Active()
+	if !deprovisioning && status.BackendState == ipn.Running.String() {
+		c.prov.Observe(ctx, status)
+	}
+	return c.redraw()
 }
 
-func NewController(c *config.Config) (*Controller, error) {
-	displays, err := func() (d []display.Display, err error) {
-		for _, dt := range c.DisplayTypes {
-			if dt == "tui" {
-				d = append(d, &display.Tui{})
+// redraw works out the mode from the last status and the progress of local
+// work, and refreshes and renders every display.
+func (c *Controller) redraw() error {
+	tailscaleStatus := c.status
+	deprovisioning := c.pp != nil && c.pp.Active()
+	c.login.SetPaused(deprovisioning)
+
+	switch tailscaleStatus.BackendState {
+	case ipn.Running.String():
+		if c.Mode == Bootstrap {
+			c.Mode = Running
+		}
+	case ipn.NeedsLogin.String():
+		if c.Mode != Bootstrap && c.Mode != ConfigurationPending {
+			c.Mode = Bootstrap
+		}
+	}
+
+	if deprovisioning {
+		c.Mode = Deprovisioning
+	} else if c.Mode == Deprovisioning {
+		c.Mode = Bootstrap
+	}
+
+	if !deprovisioning && tailscaleStatus.BackendState == ipn.Running.String() {
+		switch c.prov.State() {
+		case Configuring, ProvisioningFailed:
+			if c.Mode == Running {
+				c.Mode = Provisioning
+			}
+		default:
+			if c.Mode == Provisioning {
+				c.Mode = Running
 			}
-			//TODO:
-			//if dt == "oled" {
-			//	d = append(d, &display.Oled{})
-			//}
-			//if dt == "lcd" {
-			//	d = append(d, &display.Lcd{})
-			//}
 		}
+	}
+
+	if c.Mode == Deprovisioning {
+		c.d.SetLayout(display.Deprovisioning)
+	} else if c.Mode == Provisioning {
+		c.d.SetLayout(display.Provisioning)
+	} else if c.Mode == Bootstrap {
+		c.d.SetLayout(display.Bootstrap)
+	} else if c.Mode == ConfigurationPending {
+		c.d.SetLayout(display.Configuration)
+	} else {
+		c.d.SetLayout(display.Running)
+	}
+
+	//Refresh all status info and send to displays
+	refreshData := display.RefreshData{
+		TailscaleStatus: tailscaleStatus,
+		AuthURLExpires:  c.login.Current().Expires,
+		ControlURL:      c.controlURL(),
+		Provisioning:    c.prov.Status(),
+	}
+	if c.pp != nil {
+		refreshData.Deprovision = c.pp.Status()
+	}
+	if c.rec != nil {
+		refreshData.Reconcile = c.rec.Status()
+	}
+	if c.Mode == ConfigurationPending {
+		refreshData.Config = c.cfg.Status()
+	}
+	if err := c.d.Refresh(refreshData); err != nil {
+		return err
+	}
+	c.data = refreshData
+
+	//Render displays
+	c.d.Clear()
+	c.d.Render()
+
+	c.progressAt = time.Time{}
+	if c.Mode == Deprovisioning || c.Mode == Provisioning {
+		c.progressAt = time.Now().Add(time.Second)
+	}
+	return nil
+}
+
+// pollTerminal feeds the terminal's keys to the input mux, if a display
+// provides them.
+func (c *Controller) pollTerminal(ctx context.Context) {
+	if c.pollingTerminal {
+		return
+	}
+	if events := c.d.PollEvents(); events != nil {
+		c.pollingTerminal = true
+		go c.input.Run(ctx, input.Termui{Events: events})
+	}
+}
+
+// reload is a new configuration handed to the controller loop.
+type reload struct {
+	config *config.Config
+	done   chan struct{}
+}
+
+// Reload applies n, a validated configuration, to the running controller:
+// the ticker is retimed, displays are added, removed or re-initialised and
+// the tailscaled socket is swapped. Other changes are logged and only take
+// effect after a restart.
+func (c *Controller) Reload(ctx context.Context, n *config.Config) error {
+	r := reload{config: n, done: make(chan struct{})}
+	select {
+	case c.reloads <- r:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// applyConfig runs on the controller loop, so nothing else is using the
+// ticker or displays while they are changed.
+func (c *Controller) applyConfig(ctx context.Context, n *config.Config) {
+	changed := config.Diff(c.c, n)
+	if len(changed) == 0 {
+		log.Printf("reload: no changes")
+		return
+	}
+	displaysChanged := false
+	for _, field := range changed {
+		switch field {
+		case "Tick":
+			c.ticker.Reset(n.Tick)
+			c.c.Tick = n.Tick
+			log.Printf("reload: tick is now %v", n.Tick)
+		case "Socket":
+			c.watcher.SetSocket(n.Socket)
+			c.c.Socket = n.Socket
+			log.Printf("reload: using tailscaled socket %s", n.Socket)
+		case "ControlURL":
+			c.c.ControlURL = n.ControlURL
+			c.setControlURL("")
+			log.Printf("reload: control URL is now %q", n.ControlURL)
+		case "Displays":
+			displaysChanged = true
+		default:
+			log.Printf("reload: %s changed, restart edged to apply it", field)
+		}
+	}
+	if !displaysChanged {
+		return
+	}
+	if !c.displaysFromConfig {
+		log.Printf("reload: displays were not set up from the config, ignoring changes to them")
 		return
+	}
+	current, wanted := displaysFor(c.c), displaysFor(n)
+	for name := range current {
+		if _, ok := wanted[name]; !ok {
+			c.d.Remove(name)
+			log.Printf("reload: removed display %s", name)
+		}
+	}
+	for name, d := range wanted {
+		// Fresh displays compare equal when their settings are the same
+		if old, ok := current[name]; ok && reflect.DeepEqual(old, d) {
+			continue
+		}
+		c.d.Add(d)
+		log.Printf("reload: (re)started display %s", name)
+	}
+	c.c.Displays = n.Displays
+	c.pollTerminal(ctx)
+}
+
+// setControlURL points logins, and the control server shown while logging
+// in, at url saved on the configuration screen, or back at the config's
+// when url is "". It runs on the controller loop.
+func (c *Controller) setControlURL(url string) {
+	c.savedControlURL = url
+	c.login.SetControlURL(c.controlURL())
+}
+
+// controlURL is the Control URL logins go to.
+func (c *Controller) controlURL() string {
+	if c.savedControlURL != "" {
+		return c.savedControlURL
+	}
+	return c.c.ControlURL
+}
+
+// serveMetrics serves the reconciler's metrics on MetricsAddr until ctx is
+// cancelled.
+func (c *Controller) serveMetrics(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c.rec.MetricsHandler())
+	srv := &http.Server{Addr: c.c.MetricsAddr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
 	}()
-	if err != nil {
-		return nil, err
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("error serving metrics: %v", err)
 	}
-	d, err := display.NewSet(displays...)
+}
+
+// checkPoisonPill triggers the poison-pill when tailscaled drops from Running
+// back to NeedsLogin because the device was deleted from the tailnet admin
+// panel. A drop is only taken for a removal when control says so, see
+// removalDetector, so an expired node key or `tailscale logout` on the CLI
+// never wipes the device. If the device comes back to Running during the
+// grace period, the wipe is called off.
+func (c *Controller) checkPoisonPill(ctx context.Context, state string) {
+	defer func() { c.lastState = state }()
+	if c.pp == nil {
+		return
+	}
+	switch state {
+	case ipn.Running.String():
+		c.loggingOut, c.dropped = false, false
+		c.pp.Cancel()
+	case ipn.NeedsLogin.String():
+		if c.lastState == ipn.Running.String() && !c.loggingOut {
+			c.dropped = true
+			if c.removal.removed() == "" {
+				log.Printf("poison-pill: tailscaled needs login but nothing says the device was removed from the tailnet, not wiping")
+			}
+		}
+		c.loggingOut = false
+		if !c.dropped {
+			return
+		}
+		// The removal signal may arrive after the state change
+		if reason := c.removal.removed(); reason != "" {
+			log.Printf("poison-pill: device removed from the tailnet (%s)", reason)
+			c.dropped = false
+			c.pp.Trigger(ctx)
+		}
+	}
+}
+
+func (c *Controller) CleanUp() {
+	c.d.CleanUp()
+}
+
+func NewController(c *config.Config) (*Controller, error) {
+	byType := displaysFor(c)
+	var displays []display.Display
+	for _, dc := range c.Displays {
+		displays = append(displays, byType[dc.Type])
+	}
+	ctl, err := NewControllerWithDisplays(c, displays...)
 	if err != nil {
 		return nil, err
 	}
+	ctl.displaysFromConfig = true
+	return ctl, nil
+}
+
+// displaysFor creates the displays in the config, by type.
+func displaysFor(c *config.Config) map[string]display.Display {
+	d := map[string]display.Display{}
+	for _, dc := range c.Displays {
+		switch dc.Type {
+		case "tui":
+			d[dc.Type] = &display.Tui{}
+		case "oled":
+			d[dc.Type] = &display.Oled{BusNumber: dc.I2CBus, Address: dc.I2CAddress}
+		case "lcd":
+			d[dc.Type] = &display.Lcd{BusNumber: dc.I2CBus, Address: dc.I2CAddress, Cols: dc.Cols, Rows: dc.Rows}
+		case "http":
+			d[dc.Type] = &display.Http{Addr: dc.Addr}
+		}
+	}
+	return d
+}
+
+// NewControllerWithDisplays creates a controller rendering to the given
+// displays instead of the ones named in the config, e.g. fakes in tests.
+func NewControllerWithDisplays(c *config.Config, displays ...display.Display) (*Controller, error) {
+	d := display.NewSet(displays...)
+	client := tsutils.NewClient(c.Socket)
+	watcher := tsutils.NewWatcher(client)
 	ctl := &Controller{
-		c:      c,
-		d:      d,
-		Mode:   Bootstrap,
-		ticker: time.NewTicker(c.Tick),
-		cw: &tsutils.CliWrapper{
-			StdErr: log.Writer(),
-			StdOut: log.Writer(),
-		},
+		c:             c,
+		d:             d,
+		Mode:          Bootstrap,
+		ticker:        time.NewTicker(c.Tick),
+		client:        client,
+		watcher:       watcher,
+		login:         tsutils.NewLoginManager(watcher),
+		prov:          NewProvisioningController(c.RoleDir, c.StateDir),
+		input:         input.NewMux(c.KeyMap),
+		cfg:           NewConfigEditor(client, c.PrefsFile, &netconf.Networkd{Dir: c.NetworkDir, Interface: c.StaticInterface}),
 		interruptChan: make(chan os.Signal, 1),
+		reloads:       make(chan reload),
+	}
+	watcher.OnNotify(ctl.removal.handle)
+	ctl.cfg.OnControlURL = ctl.setControlURL
+	ctl.login.ControlURL = c.ControlURL
+	ctl.login.AuthKeys = c.AuthKeySources
+	ctl.login.KeysPath = filepath.Join(c.StateDir, authKeysStateFile)
+	for name, r := range c.Roles {
+		role := &Role{Name: name}
+		for _, s := range r.Steps {
+			role.Steps = append(role.Steps, RoleStep{Name: s.Name, Command: s.Command, Timeout: s.Timeout})
+		}
+		if ctl.prov.Roles == nil {
+			ctl.prov.Roles = map[string]*Role{}
+		}
+		ctl.prov.Roles[name] = role
+	}
+	if c.PrefsFile != "" || c.Prefs != nil {
+		var err error
+		if ctl.rec, err = reconcile.FromConfig(c, client); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.GPIOLines) > 0 {
+		ctl.inputs = append(ctl.inputs, input.GPIO{Chip: c.GPIOChip, Lines: c.GPIOLines})
+	}
+	for _, path := range c.EvdevDevices {
+		ctl.inputs = append(ctl.inputs, input.Evdev{Path: path})
+	}
+	if c.PoisonPill {
+		ctl.pp = NewPoisonPill(client, c.StateDir, c.PoisonPillGrace, c.PoisonPillDryRun)
+		if len(c.WipeSteps) > 0 {
+			ctl.pp.Steps = WipeStepsFromConfig(client, c.WipeSteps)
+		}
 	}
 	return ctl, nil
 }
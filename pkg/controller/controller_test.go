@@ -0,0 +1,341 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	ui "github.com/gizak/termui/v3"
+	"github.com/jtcressy-home/edged/pkg/config"
+	"github.com/jtcressy-home/edged/pkg/display"
+	"github.com/jtcressy-home/edged/pkg/tstest"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startController runs a controller against a fake tailscaled, with a
+// poison-pill that only logs its steps and waits an hour to wipe, and any
+// further flags in args.
+func startController(t *testing.T, args ...string) (*tstest.LocalAPI, *tstest.Display) {
+	t.Helper()
+	_, _, f, d := runController(t, args...)
+	return f, d
+}
+
+// runController is startController, also returning the controller and its
+// config.
+func runController(t *testing.T, args ...string) (*Controller, *config.Config, *tstest.LocalAPI, *tstest.Display) {
+	t.Helper()
+	dir := t.TempDir()
+	f, err := tstest.NewLocalAPI(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	c := &config.Config{}
+	err = c.Init(append([]string{"edged", "-socket", f.Socket, "-state-dir", dir, "-role-dir", dir, "-tick", "1h",
+		"-poison-pill", "-poison-pill-dry-run", "-poison-pill-grace", "1h"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := tstest.NewDisplay()
+	ctl, err := NewControllerWithDisplays(c, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, ctl)
+	return ctl, c, f, d
+}
+
+// run runs ctl until the test ends.
+func run(t *testing.T, ctl *Controller) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ctl.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		ctl.CleanUp()
+	})
+}
+
+func waitForLayout(t *testing.T, d *tstest.Display, layout display.Layout) {
+	t.Helper()
+	if err := d.WaitForLayout(layout, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitForAuthURL(t *testing.T, f *tstest.LocalAPI, d *tstest.Display, url string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Last().TailscaleStatus == nil || d.Last().TailscaleStatus.AuthURL != url {
+		if time.Now().After(deadline) {
+			t.Fatalf("Bootstrap never showed the login URL %s, commands %v", url, f.Commands())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// press sends keys from the terminal, each a key name like "<Down>" or
+// text typed a character at a time.
+func press(d *tstest.Display, keys ...string) {
+	for _, k := range keys {
+		if strings.HasPrefix(k, "<") {
+			d.Events <- ui.Event{ID: k}
+			continue
+		}
+		for _, r := range k {
+			d.Events <- ui.Event{ID: string(r)}
+		}
+	}
+}
+
+// loggedIn starts a controller and takes it through the login shown on
+// the Bootstrap screen.
+func loggedIn(t *testing.T) (*tstest.LocalAPI, *tstest.Display) {
+	t.Helper()
+	f, d := startController(t)
+	waitForLayout(t, d, display.Bootstrap)
+	waitForAuthURL(t, f, d, tstest.DefaultLoginURL)
+	if err := f.Login(); err != nil {
+		t.Fatal(err)
+	}
+	waitForLayout(t, d, display.Running)
+	if got := d.Last().TailscaleStatus.BackendState; got != "Running" {
+		t.Errorf("Running screen shows state %q", got)
+	}
+	return f, d
+}
+
+// neverDeprovisions checks that d settles in Bootstrap without the
+// poison-pill being triggered.
+func neverDeprovisions(t *testing.T, f *tstest.LocalAPI, d *tstest.Display) {
+	t.Helper()
+	waitForLayout(t, d, display.Bootstrap)
+	time.Sleep(100 * time.Millisecond)
+	for _, l := range d.Layouts() {
+		if l == display.Deprovisioning {
+			t.Fatalf("poison-pill triggered, layouts %v", d.Layouts())
+		}
+	}
+	if dp := d.Last().Deprovision; dp != nil {
+		t.Errorf("deprovision status %+v, want none", dp)
+	}
+}
+
+func TestControllerRemoval(t *testing.T) {
+	f, d := loggedIn(t)
+	if err := f.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	waitForLayout(t, d, display.Deprovisioning)
+	dp := d.Last().Deprovision
+	if dp == nil || dp.Phase != "Pending" || !dp.DryRun || dp.Deadline.IsZero() {
+		t.Fatalf("deprovision status %+v, want a pending dry run with a deadline", dp)
+	}
+
+	// Esc during the grace period cancels the wipe
+	d.Events <- ui.Event{ID: "<Escape>"}
+	waitForLayout(t, d, display.Bootstrap)
+	if dp := d.Last().Deprovision; dp != nil {
+		t.Errorf("deprovision status %+v after cancelling, want none", dp)
+	}
+	if n := f.Logouts(); n != 0 {
+		t.Errorf("%d logouts after cancelling, want none", n)
+	}
+}
+
+func TestControllerExpiry(t *testing.T) {
+	f, d := loggedIn(t)
+	if err := f.Expire(); err != nil {
+		t.Fatal(err)
+	}
+	neverDeprovisions(t, f, d)
+}
+
+func TestControllerLogout(t *testing.T) {
+	f, d := loggedIn(t)
+	// `tailscale logout` on the device
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", f.Socket)
+		},
+	}}
+	resp, err := hc.Post("http://local-tailscaled.sock/localapi/v0/logout", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("logout: %s", resp.Status)
+	}
+	neverDeprovisions(t, f, d)
+}
+
+func TestControllerConfigControlURL(t *testing.T) {
+	prefsFile := filepath.Join(t.TempDir(), "prefs.yaml")
+	ctl, c, f, d := runController(t, "-prefs-file", prefsFile)
+	loaded := *c
+	waitForLayout(t, d, display.Bootstrap)
+	waitForAuthURL(t, f, d, tstest.DefaultLoginURL)
+
+	// Control URL is the fifth setting on the configuration screen
+	press(d, "<F2>", "<Down>", "<Down>", "<Down>", "<Down>", "<Enter>", "https://ctl.example.com", "<Enter>")
+	waitForLayout(t, d, display.Configuration)
+	press(d, "<Down>", "<Down>", "<Down>", "<Enter>")
+	waitForLayout(t, d, display.Bootstrap)
+	if b, err := ioutil.ReadFile(prefsFile); err != nil || !strings.Contains(string(b), "https://ctl.example.com") {
+		t.Fatalf("prefs file %q (%v), want the control URL saved", b, err)
+	}
+
+	// The pending login is started again on the new control server
+	waitForAuthURL(t, f, d, "https://ctl.example.com"+tstest.RegisterPath+"fake")
+	if got := d.Last().ControlURL; got != "https://ctl.example.com" {
+		t.Errorf("Bootstrap shows control URL %q, want the saved one", got)
+	}
+
+	// Reloading the config keeps it, with the displays redrawn on a
+	// shorter tick to show it
+	loaded.Tick = 20 * time.Millisecond
+	if err := ctl.Reload(context.Background(), &loaded); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := d.Last(); got.ControlURL != "https://ctl.example.com" || got.TailscaleStatus.AuthURL != "https://ctl.example.com"+tstest.RegisterPath+"fake" {
+		t.Errorf("after a reload Bootstrap shows control URL %q and login %q, want the saved one", got.ControlURL, got.TailscaleStatus.AuthURL)
+	}
+
+	// Changing the config's Control URL replaces it
+	changed := loaded
+	changed.ControlURL = "https://other.example.com"
+	if err := ctl.Reload(context.Background(), &changed); err != nil {
+		t.Fatal(err)
+	}
+	waitForAuthURL(t, f, d, "https://other.example.com"+tstest.RegisterPath+"fake")
+}
+
+// logBuffer collects what is logged during a test.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func captureLog(t *testing.T) *logBuffer {
+	b := &logBuffer{}
+	log.SetOutput(b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return b
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitForHttpState waits for the http kiosk on addr to show state.
+func waitForHttpState(t *testing.T, addr, state string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var st struct{ BackendState string }
+		resp, err := http.Get("http://" + addr + "/status")
+		if err == nil {
+			json.NewDecoder(resp.Body).Decode(&st)
+			resp.Body.Close()
+			if st.BackendState == state {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("http kiosk on %s shows %q (%v), want %s", addr, st.BackendState, err, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestControllerReload(t *testing.T) {
+	logs := captureLog(t)
+	dir := t.TempDir()
+	var fakes []*tstest.LocalAPI
+	for i := 0; i < 2; i++ {
+		f, err := tstest.NewLocalAPI(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		fakes = append(fakes, f)
+	}
+	if err := fakes[1].Login(); err != nil {
+		t.Fatal(err)
+	}
+	addrs := []string{freeAddr(t), freeAddr(t)}
+	c := &config.Config{}
+	err := c.Init([]string{"edged", "-socket", fakes[0].Socket, "-state-dir", dir, "-role-dir", dir, "-tick", "1h",
+		"-displays", "http", "-http-addr", addrs[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl, err := NewController(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, ctl)
+	waitForHttpState(t, addrs[0], "NeedsLogin")
+
+	n, err := config.Load([]string{"edged", "-socket", fakes[1].Socket, "-state-dir", filepath.Join(dir, "new"), "-role-dir", dir,
+		"-tick", "20ms", "-displays", "http", "-http-addr", addrs[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctl.Reload(context.Background(), n); err != nil {
+		t.Fatal(err)
+	}
+	if ctl.c != c || c.Tick != 20*time.Millisecond || c.Socket != fakes[1].Socket || !reflect.DeepEqual(c.Displays, n.Displays) {
+		t.Errorf("after the reload the config is %+v, want %+v applied in place", c, n)
+	}
+	if got := ctl.client.Socket(); got != fakes[1].Socket {
+		t.Errorf("client on socket %s after the reload, want %s", got, fakes[1].Socket)
+	}
+	// The kiosk moved to the new address, and shows the new tailscaled
+	waitForHttpState(t, addrs[1], "Running")
+	if _, err := http.Get("http://" + addrs[0] + "/status"); err == nil {
+		t.Errorf("http kiosk still served on %s after moving it", addrs[0])
+	}
+
+	// Restart-only settings are only logged
+	if c.StateDir != dir {
+		t.Errorf("StateDir changed to %s by a reload, want it kept until a restart", c.StateDir)
+	}
+	if !strings.Contains(logs.String(), "reload: StateDir changed, restart edged to apply it") {
+		t.Errorf("reload did not log the StateDir change, logs:\n%s", logs)
+	}
+}
@@ -7,6 +7,7 @@ const (
 	Provisioning
 	ConfigurationPending
 	Running
+	Deprovisioning
 )
 
 func (m Mode) String() string {
@@ -15,5 +16,6 @@ func (m Mode) String() string {
 		"Provisioning",
 		"ConfigurationPending",
 		"Running",
+		"Deprovisioning",
 	}[m]
 }
@@ -0,0 +1,427 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jtcressy-home/edged/pkg/config"
+	"github.com/jtcressy-home/edged/pkg/display"
+	tsutils "github.com/jtcressy-home/edged/pkg/tailscale_utils"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const poisonPillJournalFile = "poisonpill.json"
+
+// A failed wipe is retried with exponential backoff between these bounds.
+var (
+	wipeRetryMin = 30 * time.Second
+	wipeRetryMax = 30 * time.Minute
+)
+
+type PoisonPillPhase int
+
+const (
+	PoisonPillIdle = PoisonPillPhase(iota)
+	PoisonPillPending
+	PoisonPillWiping
+	PoisonPillFailed
+)
+
+func (p PoisonPillPhase) String() string {
+	return [...]string{
+		"Idle",
+		"Pending",
+		"Wiping",
+		"Failed",
+	}[p]
+}
+
+// WipeStep is one destructive action taken when the device is deprovisioned.
+// Name must be stable across releases, it is how the journal records progress.
+type WipeStep interface {
+	Name() string
+	Run(ctx context.Context) error
+}
+
+// LogoutStep logs tailscaled out of the tailnet.
+type LogoutStep struct {
+	Client *tsutils.Client
+}
+
+func (s *LogoutStep) Name() string {
+	return "tailscale-logout"
+}
+
+func (s *LogoutStep) Run(ctx context.Context) error {
+	return s.Client.Logout(ctx)
+}
+
+// RemovePathsStep deletes files and directory trees. Paths that do not exist
+// are ignored.
+type RemovePathsStep struct {
+	Label string
+	Paths []string
+}
+
+func (s *RemovePathsStep) Name() string {
+	return s.Label
+}
+
+func (s *RemovePathsStep) Run(ctx context.Context) error {
+	for _, p := range s.Paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CommandStep runs an external command. It is skipped when the command is
+// not installed, since not every device runs every workload.
+type CommandStep struct {
+	Label   string
+	Command []string
+}
+
+func (s *CommandStep) Name() string {
+	return s.Label
+}
+
+func (s *CommandStep) Run(ctx context.Context) error {
+	path, err := exec.LookPath(s.Command[0])
+	if err != nil {
+		log.Printf("poison-pill: skipping %s, %s is not installed", s.Label, s.Command[0])
+		return nil
+	}
+	out, err := exec.CommandContext(ctx, path, s.Command[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", strings.Join(s.Command, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// DefaultWipeSteps returns the deprovisioning steps for a k3s edge node,
+// logging out of the tailscaled client talks to.
+func DefaultWipeSteps(client *tsutils.Client) []WipeStep {
+	return []WipeStep{
+		&LogoutStep{Client: client},
+		&CommandStep{
+			Label:   "remove-containers",
+			Command: []string{"crictl", "rm", "--all", "--force"},
+		},
+		&CommandStep{
+			Label:   "remove-images",
+			Command: []string{"crictl", "rmi", "--all"},
+		},
+		&CommandStep{
+			Label:   "stop-k3s",
+			Command: []string{"k3s-killall.sh"},
+		},
+		&RemovePathsStep{
+			Label: "remove-kubelet-config",
+			Paths: []string{
+				"/etc/rancher/k3s",
+				"/var/lib/rancher/k3s/agent",
+				"/var/lib/kubelet",
+				"/etc/kubernetes",
+			},
+		},
+		&RemovePathsStep{
+			Label: "erase-storage",
+			Paths: []string{
+				"/var/lib/rancher",
+				"/var/lib/containerd",
+				"/var/lib/longhorn",
+			},
+		},
+	}
+}
+
+// WipeStepsFromConfig returns the wipe steps declared in the config file.
+func WipeStepsFromConfig(client *tsutils.Client, steps []config.WipeStepConfig) []WipeStep {
+	var wipe []WipeStep
+	for _, s := range steps {
+		switch {
+		case s.Logout:
+			wipe = append(wipe, &LogoutStep{Client: client})
+		case len(s.Command) > 0:
+			wipe = append(wipe, &CommandStep{Label: s.Name, Command: s.Command})
+		default:
+			wipe = append(wipe, &RemovePathsStep{Label: s.Name, Paths: s.Paths})
+		}
+	}
+	return wipe
+}
+
+// poisonPillJournal is persisted before and after every step so a reboot in
+// the middle of a wipe resumes where it left off rather than starting over or
+// leaving the device half-deprovisioned.
+type poisonPillJournal struct {
+	TriggeredAt time.Time
+	Completed   []string
+	Done        bool
+}
+
+// PoisonPill deprovisions the device when it has been removed from the
+// tailnet. Once triggered it waits out a grace period, shown on the displays,
+// during which it can be cancelled, and then runs each WipeStep in order. A
+// failed wipe is retried with backoff until it succeeds or is acknowledged.
+type PoisonPill struct {
+	Steps       []WipeStep
+	DryRun      bool
+	Grace       time.Duration
+	JournalPath string
+
+	mu        sync.Mutex
+	phase     PoisonPillPhase
+	deadline  time.Time
+	step      string
+	completed int
+	err       error
+	failures  int
+	retryAt   time.Time
+	cancel    context.CancelFunc
+}
+
+func NewPoisonPill(client *tsutils.Client, stateDir string, grace time.Duration, dryRun bool) *PoisonPill {
+	return &PoisonPill{
+		Steps:       DefaultWipeSteps(client),
+		DryRun:      dryRun,
+		Grace:       grace,
+		JournalPath: filepath.Join(stateDir, poisonPillJournalFile),
+	}
+}
+
+// Resume continues a wipe that was interrupted, e.g. by a reboot. The grace
+// period is not repeated since it was already confirmed before the journal
+// was first written.
+func (p *PoisonPill) Resume(ctx context.Context) (bool, error) {
+	j, err := p.readJournal()
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if j.Done {
+		return false, nil
+	}
+	log.Printf("poison-pill: resuming wipe triggered at %v, %d steps already done", j.TriggeredAt, len(j.Completed))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.phase != PoisonPillIdle {
+		return false, nil
+	}
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.phase = PoisonPillWiping
+	go p.wipe(ctx, j)
+	return true, nil
+}
+
+// Trigger starts the grace period. It is a no-op if the poison-pill is
+// already pending or running.
+func (p *PoisonPill) Trigger(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.phase != PoisonPillIdle {
+		return
+	}
+	log.Printf("poison-pill: triggered, wiping in %v unless cancelled", p.Grace)
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.phase = PoisonPillPending
+	p.deadline = time.Now().Add(p.Grace)
+	p.completed = 0
+	p.err = nil
+	p.failures = 0
+	go p.wipeAfter(ctx, p.Grace, PoisonPillPending, &poisonPillJournal{TriggeredAt: time.Now()})
+}
+
+// wipeAfter starts wiping after d unless ctx is cancelled or the phase has
+// moved on from phase in the meantime.
+func (p *PoisonPill) wipeAfter(ctx context.Context, d time.Duration, phase PoisonPillPhase, j *poisonPillJournal) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-t.C:
+	}
+	p.mu.Lock()
+	if ctx.Err() != nil || p.phase != phase {
+		p.mu.Unlock()
+		return
+	}
+	p.phase = PoisonPillWiping
+	p.err = nil
+	p.mu.Unlock()
+	p.wipe(ctx, j)
+}
+
+// Cancel aborts a pending poison-pill. Once wiping has started it can no
+// longer be cancelled and Cancel returns false.
+func (p *PoisonPill) Cancel() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.phase != PoisonPillPending {
+		return false
+	}
+	log.Printf("poison-pill: cancelled")
+	p.cancel()
+	p.phase = PoisonPillIdle
+	return true
+}
+
+// Acknowledge gives up on a failed wipe: it is no longer retried and its
+// journal is removed so it is not resumed on the next boot either. It
+// returns false unless the wipe has failed.
+func (p *PoisonPill) Acknowledge() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.phase != PoisonPillFailed {
+		return false
+	}
+	log.Printf("poison-pill: failed wipe acknowledged, giving up: %v", p.err)
+	p.cancel()
+	if err := os.Remove(p.JournalPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("poison-pill: error removing journal: %v", err)
+	}
+	p.phase = PoisonPillIdle
+	p.err = nil
+	p.failures = 0
+	return true
+}
+
+// Active reports whether the poison-pill is pending, wiping or has failed.
+func (p *PoisonPill) Active() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.phase != PoisonPillIdle
+}
+
+// Status returns the current progress for the displays, or nil when idle.
+func (p *PoisonPill) Status() *display.DeprovisionStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.phase == PoisonPillIdle {
+		return nil
+	}
+	s := &display.DeprovisionStatus{
+		Phase:     p.phase.String(),
+		DryRun:    p.DryRun,
+		Deadline:  p.deadline,
+		Step:      p.step,
+		Completed: p.completed,
+		Total:     len(p.Steps),
+	}
+	if p.phase == PoisonPillFailed {
+		s.Error = p.err.Error()
+		s.RetryAt = p.retryAt
+	}
+	return s
+}
+
+func (p *PoisonPill) wipe(ctx context.Context, j *poisonPillJournal) {
+	done := map[string]bool{}
+	for _, name := range j.Completed {
+		done[name] = true
+	}
+	for i, step := range p.Steps {
+		p.mu.Lock()
+		p.step = step.Name()
+		p.completed = i
+		p.mu.Unlock()
+		if done[step.Name()] {
+			continue
+		}
+		if err := p.writeJournal(j); err != nil {
+			p.fail(ctx, j, fmt.Errorf("writing journal: %v", err))
+			return
+		}
+		if p.DryRun {
+			log.Printf("poison-pill: dry-run, would run step %s", step.Name())
+		} else {
+			log.Printf("poison-pill: running step %s", step.Name())
+			if err := step.Run(ctx); err != nil {
+				p.fail(ctx, j, fmt.Errorf("%s: %v", step.Name(), err))
+				return
+			}
+		}
+		j.Completed = append(j.Completed, step.Name())
+	}
+	j.Done = true
+	if err := p.writeJournal(j); err != nil {
+		p.fail(ctx, j, fmt.Errorf("writing journal: %v", err))
+		return
+	}
+	log.Printf("poison-pill: device wiped")
+	p.mu.Lock()
+	p.phase = PoisonPillIdle
+	p.step = ""
+	p.completed = len(p.Steps)
+	p.failures = 0
+	p.mu.Unlock()
+}
+
+// fail records a failed wipe and schedules a retry of the steps left in j.
+func (p *PoisonPill) fail(ctx context.Context, j *poisonPillJournal, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ctx.Err() != nil {
+		// Acknowledged or shutting down
+		return
+	}
+	backoff := wipeRetryMin << p.failures
+	if backoff > wipeRetryMax || backoff <= 0 {
+		backoff = wipeRetryMax
+	} else {
+		p.failures++
+	}
+	log.Printf("poison-pill: %v, retrying in %v", err, backoff)
+	p.phase = PoisonPillFailed
+	p.err = err
+	p.retryAt = time.Now().Add(backoff)
+	go p.wipeAfter(ctx, backoff, PoisonPillFailed, j)
+}
+
+func (p *PoisonPill) readJournal() (*poisonPillJournal, error) {
+	b, err := ioutil.ReadFile(p.JournalPath)
+	if err != nil {
+		return nil, err
+	}
+	j := &poisonPillJournal{}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", p.JournalPath, err)
+	}
+	return j, nil
+}
+
+// writeJournal replaces the journal atomically so a crash never leaves a
+// truncated file behind. Dry runs are never journaled.
+func (p *PoisonPill) writeJournal(j *poisonPillJournal) error {
+	if p.DryRun {
+		return nil
+	}
+	b, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.JournalPath), 0700); err != nil {
+		return err
+	}
+	tmp := p.JournalPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.JournalPath)
+}
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStep fails the first failures times it is run.
+type fakeStep struct {
+	name     string
+	failures int
+
+	mu   sync.Mutex
+	runs int
+}
+
+func (s *fakeStep) Name() string {
+	return s.name
+}
+
+func (s *fakeStep) Run(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs++
+	if s.runs <= s.failures {
+		return errors.New("device busy")
+	}
+	return nil
+}
+
+func (s *fakeStep) Runs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.runs
+}
+
+func fastWipeRetries(t *testing.T) {
+	min, max := wipeRetryMin, wipeRetryMax
+	wipeRetryMin, wipeRetryMax = 10*time.Millisecond, 40*time.Millisecond
+	t.Cleanup(func() { wipeRetryMin, wipeRetryMax = min, max })
+}
+
+func waitForPhase(t *testing.T, p *PoisonPill, phase PoisonPillPhase) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		got := p.phase
+		p.mu.Unlock()
+		if got == phase {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("poison-pill is %v, want %v", got, phase)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoisonPillRetry(t *testing.T) {
+	fastWipeRetries(t)
+	first := &fakeStep{name: "first"}
+	flaky := &fakeStep{name: "flaky", failures: 2}
+	p := NewPoisonPill(nil, t.TempDir(), time.Millisecond, false)
+	p.Steps = []WipeStep{first, flaky}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p.Trigger(ctx)
+	waitForPhase(t, p, PoisonPillFailed)
+	s := p.Status()
+	if s.Error == "" || s.RetryAt.IsZero() || s.Step != "flaky" {
+		t.Errorf("failed status = %+v, want the error, step and retry time", s)
+	}
+	if p.Cancel() {
+		t.Error("Cancel of a failed wipe = true, want false")
+	}
+	waitForPhase(t, p, PoisonPillIdle)
+	if first.Runs() != 1 || flaky.Runs() != 3 {
+		t.Errorf("steps ran %d and %d times, want 1 and 3", first.Runs(), flaky.Runs())
+	}
+	j, err := p.readJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.Done {
+		t.Errorf("journal = %+v, want done", j)
+	}
+}
+
+func TestPoisonPillAcknowledge(t *testing.T) {
+	fastWipeRetries(t)
+	wipeRetryMin = time.Hour
+	broken := &fakeStep{name: "broken", failures: 1 << 30}
+	p := NewPoisonPill(nil, t.TempDir(), time.Millisecond, false)
+	p.Steps = []WipeStep{broken}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if p.Acknowledge() {
+		t.Error("Acknowledge while idle = true, want false")
+	}
+	p.Trigger(ctx)
+	waitForPhase(t, p, PoisonPillFailed)
+	if !p.Acknowledge() {
+		t.Fatal("Acknowledge of a failed wipe = false, want true")
+	}
+	if p.Active() || p.Status() != nil {
+		t.Errorf("poison-pill still active after Acknowledge: %+v", p.Status())
+	}
+	if _, err := os.Stat(p.JournalPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("journal left behind after Acknowledge: %v", err)
+	}
+	if resumed, err := p.Resume(ctx); resumed || err != nil {
+		t.Errorf("Resume after Acknowledge = %v, %v, want nothing to resume", resumed, err)
+	}
+}
+
+func TestPoisonPillResume(t *testing.T) {
+	dir := t.TempDir()
+	done := &fakeStep{name: "done"}
+	left := &fakeStep{name: "left"}
+	p := NewPoisonPill(nil, dir, time.Hour, false)
+	p.Steps = []WipeStep{done, left}
+	if err := p.writeJournal(&poisonPillJournal{TriggeredAt: time.Now(), Completed: []string{"done"}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if resumed, err := p.Resume(ctx); !resumed || err != nil {
+		t.Fatalf("Resume = %v, %v, want the journaled wipe resumed", resumed, err)
+	}
+	waitForPhase(t, p, PoisonPillIdle)
+	if done.Runs() != 0 || left.Runs() != 1 {
+		t.Errorf("steps ran %d and %d times, want 0 and 1", done.Runs(), left.Runs())
+	}
+	if _, err := os.Stat(filepath.Join(dir, poisonPillJournalFile)); err != nil {
+		t.Error(err)
+	}
+}
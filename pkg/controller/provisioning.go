@@ -0,0 +1,343 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ghodss/yaml"
+	"github.com/jtcressy-home/edged/pkg/display"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"tailscale.com/ipn/ipnstate"
+	"time"
+)
+
+const (
+	provisioningStateFile  = "provisioning.json"
+	defaultRoleStepTimeout = 10 * time.Minute
+)
+
+// Failed role steps are retried with exponential backoff between these
+// bounds.
+var (
+	provisioningRetryMin = 30 * time.Second
+	provisioningRetryMax = 30 * time.Minute
+)
+
+type ProvisioningState int
+
+const (
+	WaitingForConfig = ProvisioningState(iota)
+	Configuring
+	Configured
+	ProvisioningFailed
+)
+
+func (s ProvisioningState) String() string {
+	return [...]string{
+		"WaitingForConfig",
+		"Configuring",
+		"Configured",
+		"Failed",
+	}[s]
+}
+
+// Role is the definition of a device role, loaded from <role dir>/<name>.yaml
+// where name is an ACL tag without its "tag:" prefix.
+type Role struct {
+	Name  string     `json:"name"`
+	Steps []RoleStep `json:"steps"`
+}
+
+// RoleStep is a command run while assuming a role. Steps are re-run whenever
+// the device's tags or role definitions change, so they must be idempotent.
+type RoleStep struct {
+	Name    string   `json:"name"`
+	Command []string `json:"command"`
+	Timeout string   `json:"timeout,omitempty"`
+}
+
+// provisioningRecord is persisted once every role has been applied so a
+// restart does not re-run steps for an unchanged configuration.
+type provisioningRecord struct {
+	Tags         []string
+	Digest       string
+	ConfiguredAt time.Time
+}
+
+// ProvisioningController configures the device based on its ACL tags from the
+// Tailscale admin panel, treating each tag as a role to assume.
+type ProvisioningController struct {
+	RoleDir   string
+	StatePath string
+	// Roles are declared in the config file, by name. They take precedence
+	// over role files of the same name.
+	Roles map[string]*Role
+
+	mu        sync.Mutex
+	state     ProvisioningState
+	roles     []string
+	step      string
+	completed int
+	total     int
+	err       error
+	// loadErr is set while the role definitions cannot be loaded. It is
+	// reported as ProvisioningFailed without losing the state underneath.
+	loadErr  error
+	failures int
+	retryAt  time.Time
+	// digest identifies the tags and role definitions last acted on, so
+	// Observe only starts configuring again once something changed or a
+	// failed step is due to be retried.
+	digest string
+}
+
+func NewProvisioningController(roleDir, stateDir string) *ProvisioningController {
+	p := &ProvisioningController{
+		RoleDir:   roleDir,
+		StatePath: filepath.Join(stateDir, provisioningStateFile),
+	}
+	if rec, err := p.readRecord(); err == nil {
+		p.state = Configured
+		p.digest = rec.Digest
+		p.roles = roleNames(rec.Tags)
+	}
+	return p
+}
+
+// Observe reconciles the device's roles against the tags in status. It must
+// only be called while tailscaled is Running, so the tags are authoritative.
+func (p *ProvisioningController) Observe(ctx context.Context, status *ipnstate.Status) {
+	var tags []string
+	if status.Self != nil && status.Self.Tags != nil {
+		tags = status.Self.Tags.AsSlice()
+	}
+	sort.Strings(tags)
+	roles, digest, err := p.loadRoles(tags)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state == Configuring {
+		return
+	}
+	if err != nil {
+		if p.loadErr == nil || p.loadErr.Error() != err.Error() {
+			log.Printf("provisioning: %v", err)
+		}
+		p.loadErr = err
+		return
+	}
+	if p.loadErr != nil {
+		log.Printf("provisioning: role definitions loaded")
+		p.loadErr = nil
+	}
+	switch {
+	case digest != p.digest:
+		if p.state == Configured {
+			log.Printf("provisioning: configuration changed, tags: %v", tags)
+		}
+		p.failures = 0
+	case p.state == ProvisioningFailed && !time.Now().Before(p.retryAt):
+		log.Printf("provisioning: retrying %s", p.step)
+	default:
+		return
+	}
+	p.state = WaitingForConfig
+	p.roles = roleNames(tags)
+	p.err = nil
+	if len(roles) == 0 {
+		p.digest = digest
+		return
+	}
+	p.state = Configuring
+	p.completed = 0
+	p.total = 0
+	for _, r := range roles {
+		p.total += len(r.Steps)
+	}
+	go p.configure(ctx, tags, roles, digest)
+}
+
+// State returns the current provisioning state.
+func (p *ProvisioningController) State() ProvisioningState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.loadErr != nil {
+		return ProvisioningFailed
+	}
+	return p.state
+}
+
+// Status returns the current progress for the displays.
+func (p *ProvisioningController) Status() *display.ProvisioningStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &display.ProvisioningStatus{
+		State:     p.state.String(),
+		Roles:     p.roles,
+		Step:      p.step,
+		Completed: p.completed,
+		Total:     p.total,
+	}
+	switch {
+	case p.loadErr != nil:
+		s.State = ProvisioningFailed.String()
+		s.Error = p.loadErr.Error()
+	case p.state == ProvisioningFailed:
+		s.Error = p.err.Error()
+		s.RetryAt = p.retryAt
+	}
+	return s
+}
+
+func (p *ProvisioningController) configure(ctx context.Context, tags []string, roles []*Role, digest string) {
+	env := append(os.Environ(), "EDGED_TAGS="+strings.Join(tags, ","))
+	for _, role := range roles {
+		for _, step := range role.Steps {
+			p.mu.Lock()
+			p.step = role.Name + "/" + step.Name
+			p.mu.Unlock()
+			log.Printf("provisioning: running %s/%s", role.Name, step.Name)
+			if err := runRoleStep(ctx, step, append(env, "EDGED_ROLE="+role.Name)); err != nil {
+				p.fail(fmt.Errorf("%s/%s: %v", role.Name, step.Name, err), digest)
+				return
+			}
+			p.mu.Lock()
+			p.completed++
+			p.mu.Unlock()
+		}
+	}
+	if err := p.writeRecord(&provisioningRecord{Tags: tags, Digest: digest, ConfiguredAt: time.Now()}); err != nil {
+		log.Printf("provisioning: error saving state: %v", err)
+	}
+	log.Printf("provisioning: configured roles %v", roleNames(tags))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = Configured
+	p.step = ""
+	p.digest = digest
+	p.failures = 0
+}
+
+// fail records a failed step and when the roles are retried.
+func (p *ProvisioningController) fail(err error, digest string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	backoff := provisioningRetryMin << p.failures
+	if backoff > provisioningRetryMax || backoff <= 0 {
+		backoff = provisioningRetryMax
+	} else {
+		p.failures++
+	}
+	log.Printf("provisioning: %v, retrying in %v", err, backoff)
+	p.state = ProvisioningFailed
+	p.err = err
+	p.digest = digest
+	p.retryAt = time.Now().Add(backoff)
+}
+
+func runRoleStep(ctx context.Context, step RoleStep, env []string) error {
+	if len(step.Command) == 0 {
+		return fmt.Errorf("no command")
+	}
+	timeout := defaultRoleStepTimeout
+	if step.Timeout != "" {
+		t, err := time.ParseDuration(step.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %v", err)
+		}
+		timeout = t
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, step.Command[0], step.Command[1:]...)
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Printf("provisioning: %s: %s", step.Name, strings.TrimSpace(string(out)))
+	}
+	return err
+}
+
+// loadRoles reads the role definition for each tag. Tags without a role are
+// only used for ACLs and are skipped. The returned digest covers the tags and
+// every role definition, so editing a role also counts as a configuration
+// change.
+func (p *ProvisioningController) loadRoles(tags []string) ([]*Role, string, error) {
+	h := sha256.New()
+	var roles []*Role
+	for _, tag := range tags {
+		fmt.Fprintf(h, "%s\n", tag)
+		name := strings.TrimPrefix(tag, "tag:")
+		if role, ok := p.Roles[name]; ok {
+			b, err := json.Marshal(role)
+			if err != nil {
+				return nil, "", err
+			}
+			h.Write(b)
+			roles = append(roles, role)
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(p.RoleDir, name+".yaml"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		h.Write(b)
+		role := &Role{}
+		if err := yaml.Unmarshal(b, role); err != nil {
+			return nil, "", fmt.Errorf("role %s: %v", name, err)
+		}
+		if role.Name == "" {
+			role.Name = name
+		}
+		roles = append(roles, role)
+	}
+	return roles, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (p *ProvisioningController) readRecord() (*provisioningRecord, error) {
+	b, err := ioutil.ReadFile(p.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	rec := &provisioningRecord{}
+	if err := json.Unmarshal(b, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (p *ProvisioningController) writeRecord(rec *provisioningRecord) error {
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.StatePath), 0700); err != nil {
+		return err
+	}
+	tmp := p.StatePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.StatePath)
+}
+
+func roleNames(tags []string) []string {
+	var names []string
+	for _, t := range tags {
+		names = append(names, strings.TrimPrefix(t, "tag:"))
+	}
+	return names
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/views"
+	"testing"
+	"time"
+)
+
+func taggedStatus(tags ...string) *ipnstate.Status {
+	v := views.SliceOf(tags)
+	return &ipnstate.Status{BackendState: "Running", Self: &ipnstate.PeerStatus{Tags: &v}}
+}
+
+// observeUntil calls Observe until p settles in want.
+func observeUntil(t *testing.T, p *ProvisioningController, status *ipnstate.Status, want ProvisioningState) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.Observe(context.Background(), status)
+		if got := p.State(); got == want {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("provisioning is %v (%+v), want %v", got, p.Status(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func writeRole(t *testing.T, dir, name, role string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".yaml"), []byte(role), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProvisioningRecoversFromLoadError(t *testing.T) {
+	dir := t.TempDir()
+	role := "steps:\n  - name: ok\n    command: [\"true\"]\n"
+	writeRole(t, dir, "worker", role)
+	p := NewProvisioningController(dir, dir)
+	status := taggedStatus("tag:worker")
+	observeUntil(t, p, status, Configured)
+
+	writeRole(t, dir, "worker", "steps: [")
+	p.Observe(context.Background(), status)
+	if got := p.Status(); got.State != "Failed" || got.Error == "" {
+		t.Fatalf("status with a broken role = %+v, want Failed with the error", got)
+	}
+
+	// Fixed with the same definition, nothing needs to run again
+	writeRole(t, dir, "worker", role)
+	p.Observe(context.Background(), status)
+	if got := p.Status(); got.State != "Configured" || got.Error != "" {
+		t.Errorf("status once the role loads again = %+v, want Configured without error", got)
+	}
+}
+
+func TestProvisioningRetriesFailedSteps(t *testing.T) {
+	min, max := provisioningRetryMin, provisioningRetryMax
+	provisioningRetryMin, provisioningRetryMax = 20*time.Millisecond, 40*time.Millisecond
+	defer func() { provisioningRetryMin, provisioningRetryMax = min, max }()
+
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "marker")
+	// Fails the first time, like a package mirror that is briefly down
+	writeRole(t, dir, "worker", "steps:\n  - name: flaky\n    command: [\"sh\", \"-c\", \"test -e "+marker+" || { touch "+marker+"; exit 1; }\"]\n")
+	p := NewProvisioningController(dir, dir)
+	status := taggedStatus("tag:worker")
+
+	observeUntil(t, p, status, ProvisioningFailed)
+	s := p.Status()
+	if s.Step != "worker/flaky" || s.RetryAt.IsZero() {
+		t.Errorf("failed status = %+v, want the step and a retry time", s)
+	}
+	observeUntil(t, p, status, Configured)
+	if _, err := p.readRecord(); err != nil {
+		t.Errorf("no provisioning record after the retry succeeded: %v", err)
+	}
+}
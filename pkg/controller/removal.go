@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"strings"
+	"sync"
+	"tailscale.com/ipn"
+	"time"
+)
+
+// removalWindow is how long after a removal signal a drop to NeedsLogin is
+// still put down to it.
+const removalWindow = time.Minute
+
+// removalErrors are the control errors telling a node it no longer exists
+// on the tailnet.
+var removalErrors = []string{"node not found", "machine not found", "node deleted"}
+
+// removalDetector tells the device being removed from the tailnet apart
+// from the other reasons tailscaled drops to NeedsLogin, such as its node key
+// expiring or an operator running `tailscale logout`. It watches the IPN bus
+// for control errors saying the node is gone and netmaps no longer listing
+// it.
+type removalDetector struct {
+	mu        sync.Mutex
+	reason    string
+	at        time.Time
+	expired   bool // the node key expired
+	loggedOut bool // logged out locally, e.g. with the CLI
+}
+
+func (r *removalDetector) handle(n ipn.Notify) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if n.ErrMessage != nil && isRemovalError(*n.ErrMessage) {
+		r.reason, r.at = "control: "+*n.ErrMessage, now
+	}
+	if nm := n.NetMap; nm != nil {
+		r.expired = !nm.Expiry.IsZero() && nm.Expiry.Before(now)
+		if nm.SelfNode == nil {
+			r.reason, r.at = "node missing from the netmap", now
+		}
+	}
+	if n.Prefs != nil {
+		r.loggedOut = n.Prefs.LoggedOut
+	}
+	if n.State != nil && *n.State == ipn.Running {
+		r.reason, r.expired = "", false
+	}
+}
+
+// removed returns why the device is thought to have been removed from the
+// tailnet, or "" if nothing says it was.
+func (r *removalDetector) removed() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reason == "" || r.expired || r.loggedOut || time.Since(r.at) > removalWindow {
+		return ""
+	}
+	return r.reason
+}
+
+func isRemovalError(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, e := range removalErrors {
+		if strings.Contains(msg, e) {
+			return true
+		}
+	}
+	return false
+}
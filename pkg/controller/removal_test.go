@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+	"testing"
+	"time"
+)
+
+func TestRemovalDetector(t *testing.T) {
+	running, needsLogin := ipn.Running, ipn.NeedsLogin
+	errMsg := func(s string) ipn.Notify { return ipn.Notify{ErrMessage: &s} }
+	self := &tailcfg.Node{Name: "edge-1234"}
+	for _, tt := range []struct {
+		name   string
+		notify []ipn.Notify
+		want   bool
+	}{
+		{
+			name:   "deleted from the admin panel",
+			notify: []ipn.Notify{{State: &running}, errMsg("node not found"), {State: &needsLogin}},
+			want:   true,
+		},
+		{
+			name:   "missing from the netmap",
+			notify: []ipn.Notify{{State: &running}, {NetMap: &netmap.NetworkMap{}}, {State: &needsLogin}},
+			want:   true,
+		},
+		{
+			name: "key expired",
+			notify: []ipn.Notify{{State: &running},
+				{NetMap: &netmap.NetworkMap{SelfNode: self, Expiry: time.Now().Add(-time.Minute)}},
+				{State: &needsLogin}},
+		},
+		{
+			name:   "logged out on the CLI",
+			notify: []ipn.Notify{{State: &running}, {Prefs: &ipn.Prefs{LoggedOut: true}}, {State: &needsLogin}},
+		},
+		{
+			name:   "unrelated control error",
+			notify: []ipn.Notify{{State: &running}, errMsg("invalid key: unable to validate API key"), {State: &needsLogin}},
+		},
+		{
+			name:   "back to running",
+			notify: []ipn.Notify{errMsg("node not found"), {State: &running}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &removalDetector{}
+			for _, n := range tt.notify {
+				r.handle(n)
+			}
+			if got := r.removed() != ""; got != tt.want {
+				t.Errorf("removed() = %q, want removal %v", r.removed(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRemovalDetectorWindow(t *testing.T) {
+	r := &removalDetector{}
+	msg := "node not found"
+	r.handle(ipn.Notify{ErrMessage: &msg})
+	r.at = time.Now().Add(-removalWindow - time.Second)
+	if reason := r.removed(); reason != "" {
+		t.Errorf("removed() = %q for a stale signal, want none", reason)
+	}
+}
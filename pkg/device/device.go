@@ -0,0 +1,112 @@
+package device
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// placeholderSerials are values firmware vendors leave in DMI fields that
+// were never filled in; they must not be used to identify a device.
+var placeholderSerials = map[string]bool{
+	"":                        true,
+	"0":                       true,
+	"none":                    true,
+	"default string":          true,
+	"not specified":           true,
+	"not applicable":          true,
+	"to be filled by o.e.m.":  true,
+	"system serial number":    true,
+	"0123456789":              true,
+	"00000000":                true,
+	"0000000000000000":        true,
+	"03000200-0400-0500-0006": true,
+}
+
+// Info identifies the board edged is running on.
+type Info struct {
+	Vendor  string
+	Product string
+	Model   string
+
+	// Serial is the most specific serial number available: the device-tree
+	// serial on boards like the Raspberry Pi, otherwise the DMI product or
+	// board serial.
+	Serial           string
+	DeviceTreeSerial string
+	ProductSerial    string
+	BoardSerial      string
+
+	MachineID string
+	// MAC is the hardware address of the first physical network interface.
+	MAC string
+}
+
+// Gather reads device identifiers from sysfs, procfs and /etc below root,
+// which is "/" on a real device. Missing sources are skipped, since most
+// boards only provide some of them.
+func Gather(root string) (*Info, error) {
+	dmi := filepath.Join(root, "sys/class/dmi/id")
+	i := &Info{
+		Vendor:           readValue(filepath.Join(dmi, "sys_vendor")),
+		Product:          readValue(filepath.Join(dmi, "product_name")),
+		Model:            readValue(filepath.Join(root, "proc/device-tree/model")),
+		DeviceTreeSerial: readValue(filepath.Join(root, "proc/device-tree/serial-number")),
+		ProductSerial:    readValue(filepath.Join(dmi, "product_serial")),
+		BoardSerial:      readValue(filepath.Join(dmi, "board_serial")),
+		MachineID:        readValue(filepath.Join(root, "etc/machine-id")),
+	}
+	for _, s := range []string{i.DeviceTreeSerial, i.ProductSerial, i.BoardSerial} {
+		if !placeholderSerials[strings.ToLower(s)] {
+			i.Serial = s
+			break
+		}
+	}
+	mac, err := primaryMAC(filepath.Join(root, "sys/class/net"))
+	if err != nil {
+		return nil, err
+	}
+	i.MAC = mac
+	return i, nil
+}
+
+// primaryMAC returns the address of the first interface, by name, backed by
+// a real device. Virtual interfaces (bridges, veths, tailscale0) have no
+// device link in sysfs.
+func primaryMAC(netDir string) (string, error) {
+	entries, err := ioutil.ReadDir(netDir)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(netDir, name, "device")); err != nil {
+			continue
+		}
+		addr := readValue(filepath.Join(netDir, name, "address"))
+		if addr != "" && addr != "00:00:00:00:00:00" {
+			return addr, nil
+		}
+	}
+	return "", nil
+}
+
+// readValue returns the trimmed contents of a sysfs, procfs or config file,
+// or "" if it cannot be read. Device-tree strings are NUL terminated.
+func readValue(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(bytes.TrimRight(b, "\x00")))
+}
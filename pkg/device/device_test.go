@@ -0,0 +1,118 @@
+package device
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGather(t *testing.T) {
+	for _, tt := range []struct {
+		root string
+		want Info
+	}{
+		{
+			root: "rpi4",
+			want: Info{
+				Model:            "Raspberry Pi 4 Model B Rev 1.4",
+				Serial:           "10000000abcdef12",
+				DeviceTreeSerial: "10000000abcdef12",
+				MachineID:        "5c3f0e8a2b7d4e91a6c2f1d0b9e8a7c6",
+				MAC:              "dc:a6:32:12:34:56",
+			},
+		},
+		{
+			root: "nuc",
+			want: Info{
+				Vendor:        "Intel Corporation",
+				Product:       "NUC8i5BEH",
+				Serial:        "BTBN83100ABC",
+				ProductSerial: "To Be Filled By O.E.M.",
+				BoardSerial:   "BTBN83100ABC",
+				MachineID:     "0f1e2d3c4b5a69788796a5b4c3d2e1f0",
+				MAC:           "94:c6:91:aa:bb:cc",
+			},
+		},
+		{
+			root: "vm",
+			want: Info{
+				Vendor:        "QEMU",
+				ProductSerial: "0",
+				BoardSerial:   "None",
+				MachineID:     "3f2a9c1b7e6d4c5ab8f90e1d2c3b4a59",
+			},
+		},
+		{
+			root: "bare",
+			want: Info{MAC: "b8:27:eb:01:02:03"},
+		},
+	} {
+		got, err := Gather(filepath.Join("testdata", tt.root))
+		if err != nil {
+			t.Errorf("%s: %v", tt.root, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("%s: Gather() = %+v, want %+v", tt.root, *got, tt.want)
+		}
+	}
+}
+
+func TestGatherEmpty(t *testing.T) {
+	got, err := Gather(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != (Info{}) {
+		t.Errorf("Gather() of an empty root = %+v, want nothing", *got)
+	}
+	if _, err := got.Hostname(DefaultHostnameTemplate); err == nil {
+		t.Error("Hostname() without identifiers = nil error, want one")
+	}
+}
+
+func TestHostname(t *testing.T) {
+	for _, tt := range []struct {
+		root string
+		tmpl string
+		want string
+	}{
+		// The default template falls back from the serial to the
+		// machine-id to the MAC
+		{"rpi4", DefaultHostnameTemplate, "edge-abcdef12"},
+		{"nuc", DefaultHostnameTemplate, "edge-83100abc"},
+		{"vm", DefaultHostnameTemplate, "edge-2c3b4a59"},
+		{"bare", DefaultHostnameTemplate, "edge-01-02-03"},
+		{"nuc", "{{ .Vendor }}-{{ .Product }}", "intel-corporation-nuc8i5beh"},
+		{"rpi4", "pi-{{ .Serial | first 4 | upper }}", "pi-1000"},
+		{"rpi4", "--{{ .MAC | replace \":\" \"\" }}--", "dca632123456"},
+		{"rpi4", strings.Repeat("x", 70), strings.Repeat("x", 63)},
+	} {
+		info, err := Gather(filepath.Join("testdata", tt.root))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := info.Hostname(tt.tmpl)
+		if err != nil {
+			t.Errorf("%s: Hostname(%q): %v", tt.root, tt.tmpl, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: Hostname(%q) = %q, want %q", tt.root, tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestHostnameErrors(t *testing.T) {
+	info := &Info{Serial: "10000000abcdef12"}
+	for _, tmpl := range []string{
+		"edge-{{ .Serial",         // does not parse
+		"edge-{{ .NoSuchField }}", // does not render
+		"{{ .Vendor }}",           // empty
+		"---",                     // nothing left once sanitized
+	} {
+		if got, err := info.Hostname(tmpl); err == nil {
+			t.Errorf("Hostname(%q) = %q, want an error", tmpl, got)
+		}
+	}
+}
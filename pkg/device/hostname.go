@@ -0,0 +1,61 @@
+package device
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// DefaultHostnameTemplate is the suggested hostname template. It names a
+// device after the tail of its serial number, falling back to the machine-id
+// when the board has no usable serial.
+const DefaultHostnameTemplate = `edge-{{ or .Serial .MachineID .MAC | last 8 }}`
+
+var invalidHostnameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+var hostnameFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"last": func(n int, s string) string {
+		if len(s) <= n {
+			return s
+		}
+		return s[len(s)-n:]
+	},
+	"first": func(n int, s string) string {
+		if len(s) <= n {
+			return s
+		}
+		return s[:n]
+	},
+	"replace": func(old, new, s string) string {
+		return strings.ReplaceAll(s, old, new)
+	},
+}
+
+// Hostname renders tmpl against the device info and sanitizes the result
+// into a valid DNS label. The same device always produces the same hostname.
+func (i *Info) Hostname(tmpl string) (string, error) {
+	if i.Serial == "" && i.MachineID == "" && i.MAC == "" {
+		return "", fmt.Errorf("no device identifiers found")
+	}
+	t, err := template.New("hostname").Funcs(hostnameFuncs).Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid hostname template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, i); err != nil {
+		return "", fmt.Errorf("rendering hostname template: %v", err)
+	}
+	h := invalidHostnameChars.ReplaceAllString(strings.ToLower(buf.String()), "-")
+	if len(h) > 63 {
+		h = h[:63]
+	}
+	h = strings.Trim(h, "-")
+	if h == "" {
+		return "", fmt.Errorf("hostname template %q produced an empty hostname", tmpl)
+	}
+	return h, nil
+}
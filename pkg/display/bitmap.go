@@ -0,0 +1,123 @@
+package display
+
+import "github.com/skip2/go-qrcode"
+
+// bitmap is a 1-bit framebuffer for monochrome panels.
+type bitmap struct {
+	width  int
+	height int
+	pix    []bool
+}
+
+func newBitmap(width, height int) *bitmap {
+	return &bitmap{
+		width:  width,
+		height: height,
+		pix:    make([]bool, width*height),
+	}
+}
+
+func (b *bitmap) Set(x, y int, on bool) {
+	if x < 0 || y < 0 || x >= b.width || y >= b.height {
+		return
+	}
+	b.pix[y*b.width+x] = on
+}
+
+func (b *bitmap) At(x, y int) bool {
+	if x < 0 || y < 0 || x >= b.width || y >= b.height {
+		return false
+	}
+	return b.pix[y*b.width+x]
+}
+
+func (b *bitmap) Clear() {
+	for i := range b.pix {
+		b.pix[i] = false
+	}
+}
+
+func (b *bitmap) Fill(x, y, w, h int, on bool) {
+	for yy := y; yy < y+h; yy++ {
+		for xx := x; xx < x+w; xx++ {
+			b.Set(xx, yy, on)
+		}
+	}
+}
+
+// Text draws s with the 5x7 font starting at pixel (x, y) and returns the x
+// coordinate after the last glyph. Text running off the right edge is clipped.
+func (b *bitmap) Text(x, y int, s string) int {
+	for _, r := range s {
+		if x >= b.width {
+			break
+		}
+		g := glyph(r)
+		for col := 0; col < glyphWidth; col++ {
+			for row := 0; row < glyphHeight; row++ {
+				if g[col]&(1<<row) != 0 {
+					b.Set(x+col, y+row, true)
+				}
+			}
+		}
+		x += glyphAdvance
+	}
+	return x
+}
+
+// QRCode draws q at (x, y) scaled to fit within size x size pixels, with a
+// one module lit quiet zone so the code is readable on an emissive panel.
+// It returns the number of pixels used along each side.
+func (b *bitmap) QRCode(x, y, size int, q *qrcode.QRCode) int {
+	q.DisableBorder = true
+	modules := q.Bitmap()
+	n := len(modules) + 2
+	scale := size / n
+	if scale < 1 {
+		scale = 1
+	}
+	b.Fill(x, y, n*scale, n*scale, true)
+	for my, row := range modules {
+		for mx, dark := range row {
+			if dark {
+				b.Fill(x+(mx+1)*scale, y+(my+1)*scale, scale, scale, false)
+			}
+		}
+	}
+	return n * scale
+}
+
+// Pages packs the bitmap into the SSD1306 GDDRAM layout: one byte per column
+// per 8-pixel-high page, least significant bit at the top.
+func (b *bitmap) Pages() []byte {
+	pages := (b.height + 7) / 8
+	out := make([]byte, b.width*pages)
+	for p := 0; p < pages; p++ {
+		for x := 0; x < b.width; x++ {
+			var v byte
+			for bit := 0; bit < 8; bit++ {
+				if b.At(x, p*8+bit) {
+					v |= 1 << bit
+				}
+			}
+			out[p*b.width+x] = v
+		}
+	}
+	return out
+}
+
+// String renders the bitmap as text, one '#' per lit pixel.
+func (b *bitmap) String() string {
+	out := make([]byte, 0, (b.width+1)*b.height)
+	for y := 0; y < b.height; y++ {
+		for x := 0; x < b.width; x++ {
+			if b.At(x, y) {
+				out = append(out, '#')
+			} else {
+				out = append(out, '.')
+			}
+		}
+		out = append(out, '\n')
+	}
+	return string(out)
+}
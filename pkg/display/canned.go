@@ -0,0 +1,87 @@
+package display
+
+import (
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/views"
+	"time"
+)
+
+// CannedTime keeps timestamps in canned frames stable between runs.
+var CannedTime = time.Date(2022, 5, 1, 12, 30, 0, 0, time.UTC)
+
+// Layouts lists every layout, in the order a walkthrough shows them.
+var Layouts = []Layout{
+	Bootstrap,
+	Running,
+	Configuration,
+	Provisioning,
+	Deprovisioning,
+}
+
+// CannedData returns fixed RefreshData that exercises layout, for bring-up
+// tools and golden frames.
+func CannedData(layout Layout) RefreshData {
+	tags := views.SliceOf([]string{"tag:edge", "tag:kiosk"})
+	s := &ipnstate.Status{
+		Version:      "1.24.2",
+		BackendState: "Running",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.101.102.103")},
+		Self: &ipnstate.PeerStatus{
+			HostName: "edge-0a1b2c3d",
+			Online:   true,
+			Tags:     &tags,
+		},
+		CurrentTailnet: &ipnstate.TailnetStatus{Name: "example.com"},
+	}
+	data := RefreshData{TailscaleStatus: s}
+	switch layout {
+	case Bootstrap:
+		s.BackendState = "NeedsLogin"
+		s.AuthURL = "https://login.tailscale.com/a/0123456789ab"
+		s.Self.Online = false
+		s.TailscaleIPs = nil
+		s.CurrentTailnet = nil
+		data.AuthURLExpires = CannedTime.Add(10 * time.Minute)
+	case Running:
+		data.Provisioning = &ProvisioningStatus{State: "Configured", Roles: []string{"kiosk"}}
+		data.Reconcile = &ReconcileStatus{
+			Time:    CannedTime,
+			Applied: true,
+			Changes: []string{"RunSSH: false -> true"},
+		}
+	case Configuration:
+		data.Config = &ConfigStatus{
+			Rows: []ConfigRow{
+				{Label: "Hostname", Value: "edge-0a1b2c3d"},
+				{Label: "Run SSH", Value: "on"},
+				{Label: "Routes", Value: "192.168.1.0/24_"},
+				{Label: "Exit node", Value: "<none>"},
+				{Label: "Control URL", Value: "<default>"},
+				{Label: "Address", Value: "dhcp"},
+				{Label: "Gateway", Value: "<none>"},
+				{Label: "Save"},
+				{Label: "Cancel"},
+			},
+			Cursor:  2,
+			Editing: true,
+		}
+	case Provisioning:
+		data.Provisioning = &ProvisioningStatus{
+			State:     "Configuring",
+			Roles:     []string{"kiosk"},
+			Step:      "kiosk/install-browser",
+			Completed: 1,
+			Total:     3,
+		}
+	case Deprovisioning:
+		s.BackendState = "NeedsLogin"
+		data.Deprovision = &DeprovisionStatus{
+			Phase:     "Wiping",
+			Step:      "remove /var/lib/edged",
+			Completed: 2,
+			Total:     4,
+		}
+	}
+	return data
+}
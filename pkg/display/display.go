@@ -2,7 +2,10 @@ package display
 
 import (
 	ui "github.com/gizak/termui/v3"
+	"log"
 	"reflect"
+	"strings"
+	"time"
 )
 
 type Layout int
@@ -11,8 +14,20 @@ const (
 	Bootstrap = Layout(iota)
 	Running
 	Configuration
+	Deprovisioning
+	Provisioning
 )
 
+func (l Layout) String() string {
+	return [...]string{
+		"Bootstrap",
+		"Running",
+		"Configuration",
+		"Deprovisioning",
+		"Provisioning",
+	}[l]
+}
+
 type Display interface {
 	Init() error
 	SetLayout(layout Layout)
@@ -24,75 +39,257 @@ type Display interface {
 	CleanUp()
 }
 
+// Animated is implemented by displays that change between refreshes, like an
+// LCD scrolling values too wide for it. NextFrame returns when the display
+// next needs a Refresh, or the zero time when it is still.
+type Animated interface {
+	NextFrame() time.Time
+}
+
+var (
+	displayRetryMin = 2 * time.Second
+	displayRetryMax = time.Minute
+)
+
+// member is a display in a Set along with its health. A display that fails
+// to initialise or refresh is degraded and re-initialised with exponential
+// backoff, which also picks up a panel plugged back in.
+type member struct {
+	Display
+	name     string
+	started  bool // initialised successfully at least once
+	err      error
+	failures int
+	retryAt  time.Time
+}
+
+func (m *member) healthy() bool {
+	return m.err == nil
+}
+
+func (m *member) fail(err error) {
+	if m.healthy() {
+		log.Printf("display %s degraded: %v", m.name, err)
+	}
+	m.err = err
+	backoff := displayRetryMin << m.failures
+	if backoff > displayRetryMax || backoff <= 0 {
+		backoff = displayRetryMax
+	} else {
+		m.failures++
+	}
+	m.retryAt = time.Now().Add(backoff)
+}
+
+// Set fans out to several displays. A failing display does not affect the
+// others, it is reported in RefreshData.Degraded until it recovers.
 type Set struct {
 	Display
-	displays map[reflect.Type]Display
+	members []*member
+	layout  Layout
 }
 
 func (ds *Set) Init() (err error) {
-	for _, d := range ds.displays {
-		err = d.Init()
-		if err != nil {
-			return err
+	for _, m := range ds.members {
+		if err := m.Init(); err != nil {
+			m.fail(err)
+			continue
 		}
+		m.started = true
 	}
-	return
+	return nil
 }
 
 func (ds *Set) PollEvents() <-chan ui.Event {
-	//TODO: Expand this wrapper to inject hardware-based events, like a directional joystick on a RPi HAT
-	return ui.PollEvents()
+	for _, m := range ds.members {
+		if _, ok := m.Display.(*Tui); ok && m.started {
+			return ui.PollEvents()
+		}
+	}
+	//Without a terminal, events come from whichever display provides them
+	for _, m := range ds.members {
+		if events := m.PollEvents(); events != nil {
+			return events
+		}
+	}
+	return nil
 }
 
 func (ds *Set) SetLayout(layout Layout) {
-	for _, d := range ds.displays {
-		d.SetLayout(layout)
+	ds.layout = layout
+	for _, m := range ds.members {
+		m.SetLayout(layout)
 	}
 }
 
+// Refresh retries degraded displays that are due, cleaning up what is left of
+// the failed display before initialising it again, and refreshes every
+// healthy one. Display errors are not returned, they are reported in
+// data.Degraded.
 func (ds *Set) Refresh(data RefreshData) (err error) {
-	for _, d := range ds.displays {
-		err = d.Refresh(data)
-		if err != nil {
-			return
+	now := time.Now()
+	for _, m := range ds.members {
+		if m.healthy() || now.Before(m.retryAt) {
+			continue
+		}
+		m.CleanUp()
+		if err := m.Init(); err != nil {
+			m.fail(err)
+			continue
+		}
+		log.Printf("display %s recovered", m.name)
+		m.started = true
+		m.err, m.failures = nil, 0
+		m.SetLayout(ds.layout)
+	}
+	data.Degraded = ds.Degraded()
+	for _, m := range ds.members {
+		if !m.healthy() {
+			continue
+		}
+		if err := m.Refresh(data); err != nil {
+			m.fail(err)
+		}
+	}
+	return nil
+}
+
+// Degraded lists the displays currently failing.
+func (ds *Set) Degraded() []DegradedDisplay {
+	var degraded []DegradedDisplay
+	for _, m := range ds.members {
+		if !m.healthy() {
+			degraded = append(degraded, DegradedDisplay{Name: m.name, Error: m.err.Error(), RetryAt: m.retryAt})
 		}
 	}
-	return
+	return degraded
+}
+
+// NextFrame returns the earliest next frame of the healthy displays, or the
+// zero time when none of them is animating.
+func (ds *Set) NextFrame() (next time.Time) {
+	for _, m := range ds.members {
+		a, ok := m.Display.(Animated)
+		if !ok || !m.healthy() {
+			continue
+		}
+		if t := a.NextFrame(); !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	return next
+}
+
+// Animate refreshes and renders only the animated displays whose next frame
+// is due, from the data of the last Refresh. Still displays, like an OLED,
+// are not redrawn for another display's frame.
+func (ds *Set) Animate(data RefreshData) {
+	now := time.Now()
+	data.Degraded = ds.Degraded()
+	for _, m := range ds.members {
+		a, ok := m.Display.(Animated)
+		if !ok || !m.healthy() {
+			continue
+		}
+		if t := a.NextFrame(); t.IsZero() || now.Before(t) {
+			continue
+		}
+		if err := m.Refresh(data); err != nil {
+			m.fail(err)
+			continue
+		}
+		m.Render()
+	}
 }
 
 func (ds *Set) Render() {
-	for _, d := range ds.displays {
-		d.Render()
+	for _, m := range ds.members {
+		if m.healthy() {
+			m.Render()
+		}
 	}
 }
 
 func (ds *Set) Resize(width int, height int) {
-	for _, d := range ds.displays {
-		d.Resize(width, height)
+	for _, m := range ds.members {
+		m.Resize(width, height)
 	}
 }
 
 func (ds *Set) Clear() {
-	for _, d := range ds.displays {
-		d.Clear()
+	for _, m := range ds.members {
+		if m.healthy() {
+			m.Clear()
+		}
 	}
 }
 
+// CleanUp cleans up every display, including those whose Init failed part
+// way through, e.g. after opening the I2C bus.
 func (ds *Set) CleanUp() {
-	for _, d := range ds.displays {
-		d.CleanUp()
+	for _, m := range ds.members {
+		m.CleanUp()
 	}
 }
 
-func NewSet(displays ...Display) (*Set, error) {
+// NewSet creates a Set of displays, one of each type, and initialises them.
+// Displays that fail to initialise are retried on Refresh.
+func NewSet(displays ...Display) *Set {
 	ds := &Set{}
-	ds.displays = map[reflect.Type]Display{}
+	seen := map[reflect.Type]bool{}
 	for _, d := range displays {
-		ds.displays[reflect.TypeOf(d)] = d
+		t := reflect.TypeOf(d)
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		ds.members = append(ds.members, &member{Display: d, name: displayName(t)})
+	}
+	ds.Init()
+	return ds
+}
+
+// Add initialises d and adds it to the Set, replacing and cleaning up the
+// display of the same type if there is one.
+func (ds *Set) Add(d Display) {
+	m := &member{Display: d, name: displayName(reflect.TypeOf(d))}
+	ds.Remove(m.name)
+	if err := m.Init(); err != nil {
+		m.fail(err)
+	} else {
+		m.started = true
 	}
-	err := ds.Init()
-	if err != nil {
-		return nil, err
+	m.SetLayout(ds.layout)
+	ds.members = append(ds.members, m)
+}
+
+// Remove cleans up the display named name, e.g. "oled", and removes it from
+// the Set.
+func (ds *Set) Remove(name string) bool {
+	for i, m := range ds.members {
+		if m.name != name {
+			continue
+		}
+		m.CleanUp()
+		ds.members = append(ds.members[:i], ds.members[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// Names lists the displays in the Set.
+func (ds *Set) Names() []string {
+	var names []string
+	for _, m := range ds.members {
+		names = append(names, m.name)
+	}
+	return names
+}
+
+// displayName names a display after its type, e.g. "oled" for *Oled.
+func displayName(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
 	}
-	return ds, nil
+	return strings.ToLower(t.Name())
 }
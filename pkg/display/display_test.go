@@ -0,0 +1,141 @@
+package display
+
+import (
+	"errors"
+	ui "github.com/gizak/termui/v3"
+	"github.com/jtcressy-home/edged/pkg/i2c"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fastDisplayRetries makes degraded displays due for a retry straight away.
+func fastDisplayRetries(t *testing.T) {
+	min, max := displayRetryMin, displayRetryMax
+	displayRetryMin, displayRetryMax = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { displayRetryMin, displayRetryMax = min, max })
+}
+
+// flaky is a display that fails to initialise until fixed, recording the
+// calls made to it.
+type flaky struct {
+	fixed bool
+	calls []string
+}
+
+func (d *flaky) Init() error {
+	d.calls = append(d.calls, "Init")
+	if !d.fixed {
+		return errors.New("unplugged")
+	}
+	return nil
+}
+
+func (d *flaky) SetLayout(layout Layout)        {}
+func (d *flaky) PollEvents() <-chan ui.Event    { return nil }
+func (d *flaky) Refresh(data RefreshData) error { return nil }
+func (d *flaky) Render()                        {}
+func (d *flaky) Resize(width, height int)       {}
+func (d *flaky) Clear()                         {}
+func (d *flaky) CleanUp()                       { d.calls = append(d.calls, "CleanUp") }
+
+func TestSetRetry(t *testing.T) {
+	fastDisplayRetries(t)
+	d := &flaky{}
+	ds := NewSet(d)
+	if got := ds.Degraded(); len(got) != 1 || got[0].Name != "flaky" {
+		t.Fatalf("Degraded() = %+v, want the flaky display", got)
+	}
+	d.fixed = true
+	time.Sleep(2 * time.Millisecond)
+	ds.Refresh(RefreshData{TailscaleStatus: runningStatus()})
+	if got := ds.Degraded(); len(got) != 0 {
+		t.Errorf("Degraded() = %+v after recovering, want none", got)
+	}
+	// What is left of the failed Init is cleaned up before retrying it
+	if want := []string{"Init", "CleanUp", "Init"}; !reflect.DeepEqual(d.calls, want) {
+		t.Errorf("calls = %v, want %v", d.calls, want)
+	}
+}
+
+func TestSetLcdReplugged(t *testing.T) {
+	fastDisplayRetries(t)
+	bus := i2c.NewFake()
+	bus.Attach(defaultLcdAddress, NewFakeHD44780(16, 2))
+	lcd := &Lcd{Bus: bus, Cols: 16, Rows: 2}
+	ds := NewSet(lcd)
+	ds.SetLayout(Running)
+	data := RefreshData{TailscaleStatus: runningStatus()}
+
+	bus.Detach(defaultLcdAddress)
+	ds.Refresh(data)
+	ds.Render()
+	ds.Refresh(data) // reports the failed Render
+	if got := ds.Degraded(); len(got) != 1 || got[0].Name != "lcd" {
+		t.Fatalf("Degraded() = %+v with the panel unplugged, want the lcd", got)
+	}
+
+	// A new panel needs initialising before it shows anything
+	panel := NewFakeHD44780(16, 2)
+	bus.Attach(defaultLcdAddress, panel)
+	time.Sleep(2 * time.Millisecond)
+	ds.Refresh(data)
+	ds.Render()
+	if got := ds.Degraded(); len(got) != 0 {
+		t.Fatalf("Degraded() = %+v with the panel plugged back in, want none", got)
+	}
+	if !panel.On() || strings.TrimRight(panel.Row(0), " ") != "Host" {
+		t.Errorf("replugged panel on=%v shows %q, want the Running status", panel.On(), panel.String())
+	}
+}
+
+// counting is a still display counting its refreshes.
+type counting struct {
+	flaky
+	refreshes int
+}
+
+func (d *counting) Refresh(data RefreshData) error {
+	d.refreshes++
+	return nil
+}
+
+func TestSetAnimate(t *testing.T) {
+	bus := i2c.NewFake()
+	panel := NewFakeHD44780(16, 2)
+	bus.Attach(defaultLcdAddress, panel)
+	lcd := &Lcd{Bus: bus, Cols: 16, Rows: 2, PageInterval: time.Millisecond, ScrollInterval: time.Millisecond}
+	still := &counting{flaky: flaky{fixed: true}}
+	ds := NewSet(lcd, still)
+	ds.SetLayout(Running)
+	data := RefreshData{TailscaleStatus: runningStatus()}
+	ds.Refresh(data)
+	ds.Render()
+	first := panel.String()
+
+	time.Sleep(2 * time.Millisecond)
+	ds.Animate(data)
+	if still.refreshes != 1 {
+		t.Errorf("still display refreshed %d times, want only by Refresh", still.refreshes)
+	}
+	if panel.String() == first {
+		t.Errorf("panel still shows %q after its frame was due, want the next page", first)
+	}
+}
+
+func TestHttpReinit(t *testing.T) {
+	d := &Http{Addr: "127.0.0.1:0"}
+	for i := 0; i < 2; i++ {
+		if err := d.Init(); err != nil {
+			t.Fatalf("Init %d: %v", i, err)
+		}
+		if d.srv == nil {
+			t.Fatalf("Init %d left no server running", i)
+		}
+		d.CleanUp()
+		if d.srv != nil {
+			t.Fatalf("CleanUp %d left the server behind, the next Init would not listen again", i)
+		}
+	}
+}
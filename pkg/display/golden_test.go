@@ -0,0 +1,57 @@
+package display
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"tailscale.com/ipn/ipnstate"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden frames in testdata instead of comparing them")
+
+// TestGolden renders every layout with canned data on the Recorder and
+// compares the frames to testdata/<layout>.txt.
+func TestGolden(t *testing.T) {
+	d := &Recorder{}
+	for _, l := range Layouts {
+		d.SetLayout(l)
+		if err := d.Refresh(CannedData(l)); err != nil {
+			t.Fatal(err)
+		}
+		d.Render()
+		got := d.Frame()
+		path := filepath.Join("testdata", strings.ToLower(l.String())+".txt")
+		if *update {
+			if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(want) {
+			t.Errorf("%s frame does not match %s\n--- want\n%s--- got\n%s", l, path, want, got)
+		}
+	}
+}
+
+func TestHealthSummary(t *testing.T) {
+	online := &ipnstate.PeerStatus{Online: true}
+	for _, tt := range []struct {
+		status *ipnstate.Status
+		want   string
+	}{
+		{&ipnstate.Status{Self: online}, "Yes"},
+		{&ipnstate.Status{Self: online, Health: []string{"no DERP home", "dns"}}, "No: no DERP home, dns"},
+		{&ipnstate.Status{Self: &ipnstate.PeerStatus{}}, "No: offline"},
+		{&ipnstate.Status{}, "No: offline"},
+	} {
+		if got := healthSummary(tt.status); got != tt.want {
+			t.Errorf("healthSummary(%+v) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package display
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FakeHD44780 emulates an HD44780 character LCD behind a PCF8574 backpack
+// so it can be attached to an i2c.Fake and the resulting characters
+// inspected. Only the instructions used by Lcd are modelled.
+type FakeHD44780 struct {
+	mu        sync.Mutex
+	cols      int
+	rows      int
+	ddram     [80]byte
+	addr      int
+	fourBit   bool
+	high      byte
+	haveHigh  bool
+	enable    bool
+	on        bool
+	backlight bool
+}
+
+func NewFakeHD44780(cols, rows int) *FakeHD44780 {
+	f := &FakeHD44780{cols: cols, rows: rows}
+	for i := range f.ddram {
+		f.ddram[i] = ' '
+	}
+	return f
+}
+
+func (f *FakeHD44780) Write(b []byte) error {
+	if len(b) == 0 {
+		return fmt.Errorf("pcf8574: empty write")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, v := range b {
+		f.backlight = v&pcfBacklight != 0
+		enable := v&pcfEnable != 0
+		if f.enable && !enable {
+			f.latch(v>>4, v&pcfRS != 0)
+		}
+		f.enable = enable
+	}
+	return nil
+}
+
+// latch handles one falling edge of the enable line.
+func (f *FakeHD44780) latch(nibble byte, rs bool) {
+	if !f.fourBit {
+		// In 8-bit mode only D4-D7 are wired, so every transfer is a
+		// complete instruction with the low bits reading as zero.
+		f.instruction(nibble << 4)
+		return
+	}
+	if !f.haveHigh {
+		f.high = nibble
+		f.haveHigh = true
+		return
+	}
+	f.haveHigh = false
+	v := f.high<<4 | nibble
+	if rs {
+		f.ddram[f.addr%len(f.ddram)] = v
+		f.addr = (f.addr + 1) % len(f.ddram)
+		return
+	}
+	f.instruction(v)
+}
+
+func (f *FakeHD44780) instruction(v byte) {
+	switch {
+	case v&0x80 != 0: // set DDRAM address
+		a := int(v & 0x7F)
+		if a >= 0x40 {
+			a = 40 + a - 0x40
+		}
+		f.addr = a % len(f.ddram)
+	case v&0x40 != 0: // set CGRAM address
+	case v&0x20 != 0: // function set
+		f.fourBit = v&0x10 == 0
+	case v&0x10 != 0: // cursor or display shift
+	case v&0x08 != 0: // display control
+		f.on = v&0x04 != 0
+	case v&0x04 != 0: // entry mode set
+	case v&0x02 != 0: // return home
+		f.addr = 0
+	case v&0x01 != 0: // clear display
+		for i := range f.ddram {
+			f.ddram[i] = ' '
+		}
+		f.addr = 0
+	}
+}
+
+// On reports whether the display has been switched on.
+func (f *FakeHD44780) On() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.on
+}
+
+// Backlight reports whether the backpack's backlight line is high.
+func (f *FakeHD44780) Backlight() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.backlight
+}
+
+// Row returns the visible characters on row r.
+func (f *FakeHD44780) Row(r int) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	start := (r%2)*40 + (r/2)*f.cols
+	return string(f.ddram[start : start+f.cols])
+}
+
+// String renders every visible row, one per line.
+func (f *FakeHD44780) String() string {
+	var out string
+	for r := 0; r < f.rows; r++ {
+		out += f.Row(r) + "\n"
+	}
+	return out
+}
@@ -0,0 +1,336 @@
+package display
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	ui "github.com/gizak/termui/v3"
+	"github.com/skip2/go-qrcode"
+	"html/template"
+	"image/png"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHttpAddr = "localhost:8080"
+	httpQRSize      = 320
+)
+
+// httpStatus is the JSON document served by the kiosk's /status endpoint and
+// pushed to every /events subscriber.
+type httpStatus struct {
+	Layout       string
+	BackendState string
+	AuthURL      string
+	AuthExpires  time.Time
+	Control      string
+	Hostname     string
+	TailscaleIPs []string
+	Tailnet      string
+	Healthy      string
+	Health       []string
+	Notice       []string            `json:",omitempty"`
+	Deprovision  *DeprovisionStatus  `json:",omitempty"`
+	Provisioning *ProvisioningStatus `json:",omitempty"`
+	Reconcile    *ReconcileStatus    `json:",omitempty"`
+	Prefs        string
+	Degraded     []DegradedDisplay `json:",omitempty"`
+	Displays     string
+}
+
+func newHttpStatus(layout Layout, data RefreshData) *httpStatus {
+	s := data.TailscaleStatus
+	st := &httpStatus{
+		Layout:       layout.String(),
+		BackendState: s.BackendState,
+		AuthURL:      s.AuthURL,
+		AuthExpires:  data.AuthURLExpires,
+		Control:      controlServer(data.ControlURL),
+		Hostname:     hostname(s),
+		Tailnet:      tailnetName(s),
+		Healthy:      healthSummary(s),
+		Health:       s.Health,
+		Provisioning: data.Provisioning,
+		Reconcile:    data.Reconcile,
+		Prefs:        reconcileSummary(data.Reconcile),
+		Degraded:     data.Degraded,
+		Displays:     displaysSummary(data.Degraded),
+	}
+	for _, ip := range s.TailscaleIPs {
+		st.TailscaleIPs = append(st.TailscaleIPs, ip.String())
+	}
+	switch layout {
+	case Provisioning:
+		st.Notice = provisioningLines(data.Provisioning)
+	case Configuration:
+		st.Notice = configLines(data.Config)
+	case Deprovisioning:
+		st.Notice = deprovisionLines(data.Deprovision)
+		st.Deprovision = data.Deprovision
+	}
+	return st
+}
+
+// Http is a kiosk display served over HTTP on the local network, so a
+// headless device can be bootstrapped from a laptop by opening its address in
+// a browser. It serves an HTML status page, the login QR code as a PNG, a JSON
+// status document and a server-sent-events stream pushed on every Refresh.
+type Http struct {
+	Addr string
+
+	layout Layout
+	srv    *http.Server
+
+	mu          sync.RWMutex
+	status      *httpStatus
+	subscribers map[chan []byte]struct{}
+	done        chan struct{} // closed on shutdown, ending /events streams
+}
+
+func (d *Http) Init() (err error) {
+	if d.srv != nil {
+		// Already serving, e.g. retried after a failed Refresh.
+		return nil
+	}
+	if d.Addr == "" {
+		d.Addr = defaultHttpAddr
+	}
+	l, err := net.Listen("tcp", d.Addr)
+	if err != nil {
+		return fmt.Errorf("http: %v", err)
+	}
+	done := make(chan struct{})
+	d.mu.Lock()
+	d.subscribers = map[chan []byte]struct{}{}
+	d.done = done
+	d.mu.Unlock()
+	d.srv = &http.Server{
+		Handler: d.Handler(),
+	}
+	// Shutdown waits for handlers to return, and /events never does by
+	// itself.
+	d.srv.RegisterOnShutdown(func() { close(done) })
+	go d.srv.Serve(l)
+	return nil
+}
+
+// Handler returns the kiosk's HTTP routes, independent of any listener.
+func (d *Http) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.serveIndex)
+	mux.HandleFunc("/qr.png", d.serveQR)
+	mux.HandleFunc("/status", d.serveStatus)
+	mux.HandleFunc("/events", d.serveEvents)
+	return mux
+}
+
+func (d *Http) SetLayout(layout Layout) {
+	d.layout = layout
+}
+
+func (d *Http) PollEvents() <-chan ui.Event {
+	return nil
+}
+
+func (d *Http) Refresh(data RefreshData) (err error) {
+	st := newHttpStatus(d.layout, data)
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status = st
+	for ch := range d.subscribers {
+		// Subscribers only care about the latest status, so replace
+		// anything a slow client has not consumed yet.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- b
+	}
+	return nil
+}
+
+// Render is a no-op, clients are updated as soon as Refresh is called.
+func (d *Http) Render() {}
+
+// Resize is a no-op, the browser lays out the page.
+func (d *Http) Resize(width, height int) {}
+
+// Clear is a no-op, there is no persistent surface to clear.
+func (d *Http) Clear() {}
+
+func (d *Http) CleanUp() {
+	if d.srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	d.srv.Shutdown(ctx)
+	d.srv = nil
+}
+
+func (d *Http) current() *httpStatus {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.status
+}
+
+func (d *Http) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	httpIndex.Execute(w, d.current())
+}
+
+func (d *Http) serveQR(w http.ResponseWriter, r *http.Request) {
+	st := d.current()
+	if st == nil || st.AuthURL == "" {
+		http.Error(w, "no auth URL available", http.StatusNotFound)
+		return
+	}
+	q, err := qrcode.New(st.AuthURL, qrcode.Medium)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	png.Encode(w, q.Image(httpQRSize))
+}
+
+func (d *Http) serveStatus(w http.ResponseWriter, r *http.Request) {
+	st := d.current()
+	if st == nil {
+		http.Error(w, "status not available yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+func (d *Http) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan []byte, 1)
+	d.mu.Lock()
+	if d.subscribers == nil {
+		// Served through Handler without Init
+		d.subscribers = map[chan []byte]struct{}{}
+	}
+	d.subscribers[ch] = struct{}{}
+	done := d.done
+	if d.status != nil {
+		if b, err := json.Marshal(d.status); err == nil {
+			ch <- b
+		}
+	}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.subscribers, ch)
+		d.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-done:
+			return
+		case b := <-ch:
+			if _, err := fmt.Fprintf(w, "event: status\ndata: %s\n\n", b); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+var httpIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>edged</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table td { padding: 0.2em 1em 0.2em 0; }
+#qr, #notice { display: none; }
+#notice { border: 2px solid #c00; padding: 0.5em 1em; }
+</style>
+</head>
+<body>
+<h1>edged: <span id="hostname">{{if .}}{{.Hostname}}{{end}}</span></h1>
+<div id="notice"></div>
+<div id="qr">
+<p>Scan to log in to <span id="control">{{if .}}{{.Control}}{{end}}</span>, or open <a id="authurl" href="#"></a></p>
+<img id="qrimg" alt="Tailscale login QR code" width="320" height="320">
+</div>
+<table>
+<tr><td>Status</td><td id="state">{{if .}}{{.BackendState}}{{end}}</td></tr>
+<tr><td>Healthy</td><td id="healthy">{{if .}}{{.Healthy}}{{end}}</td></tr>
+<tr><td>Tailnet</td><td id="tailnet">{{if .}}{{.Tailnet}}{{end}}</td></tr>
+<tr><td>Device IP</td><td id="ips">{{if .}}{{range .TailscaleIPs}}{{.}} {{end}}{{end}}</td></tr>
+<tr><td>Provisioning</td><td id="provisioning">{{if .}}{{with .Provisioning}}{{.State}}{{end}}{{end}}</td></tr>
+<tr><td>Prefs</td><td id="prefs">{{if .}}{{.Prefs}}{{end}}</td></tr>
+<tr><td>Displays</td><td id="displays">{{if .}}{{.Displays}}{{end}}</td></tr>
+</table>
+<script>
+var lastURL = "";
+function update(st) {
+  document.getElementById("hostname").textContent = st.Hostname;
+  document.getElementById("state").textContent = st.BackendState;
+  document.getElementById("control").textContent = st.Control;
+  document.getElementById("healthy").textContent = st.Healthy;
+  document.getElementById("tailnet").textContent = st.Tailnet;
+  document.getElementById("ips").textContent = (st.TailscaleIPs || []).join(" ");
+  document.getElementById("provisioning").textContent = st.Provisioning ? st.Provisioning.State : "";
+  document.getElementById("prefs").textContent = st.Prefs;
+  document.getElementById("displays").textContent = st.Displays;
+  var notice = document.getElementById("notice");
+  if (st.Notice && st.Notice.length) {
+    notice.replaceChildren();
+    st.Notice.forEach(function(l) {
+      var p = document.createElement("p");
+      p.textContent = l;
+      notice.appendChild(p);
+    });
+    notice.style.display = "block";
+  } else {
+    notice.style.display = "none";
+  }
+  var qr = document.getElementById("qr");
+  if (st.Layout === "Bootstrap" && st.AuthURL) {
+    if (st.AuthURL !== lastURL) {
+      lastURL = st.AuthURL;
+      document.getElementById("qrimg").src = "/qr.png?u=" + encodeURIComponent(st.AuthURL);
+      var a = document.getElementById("authurl");
+      a.href = st.AuthURL;
+      a.textContent = st.AuthURL;
+    }
+    qr.style.display = "block";
+  } else {
+    qr.style.display = "none";
+  }
+}
+var es = new EventSource("/events");
+es.addEventListener("status", function(e) { update(JSON.parse(e.data)); });
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,151 @@
+package display
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFakeHttp(t *testing.T) (*Http, *httptest.Server) {
+	t.Helper()
+	d := &Http{}
+	srv := httptest.NewServer(d.Handler())
+	t.Cleanup(srv.Close)
+	return d, srv
+}
+
+func get(t *testing.T, url string) *http.Response {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestHttpStatus(t *testing.T) {
+	d, srv := newFakeHttp(t)
+	if resp := get(t, srv.URL+"/status"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/status before the first Refresh = %s, want 503", resp.Status)
+	}
+
+	d.SetLayout(Running)
+	if err := d.Refresh(RefreshData{TailscaleStatus: runningStatus(), ControlURL: "https://headscale.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	resp := get(t, srv.URL+"/status")
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("/status Content-Type = %q, want application/json", ct)
+	}
+	var st httpStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	want := httpStatus{
+		Layout:       "Running",
+		BackendState: "Running",
+		Control:      "headscale.example.com",
+		Hostname:     "edge-1234",
+		TailscaleIPs: []string{"100.64.0.1"},
+		Tailnet:      "example.com",
+	}
+	if st.Layout != want.Layout || st.BackendState != want.BackendState || st.Control != want.Control ||
+		st.Hostname != want.Hostname || strings.Join(st.TailscaleIPs, " ") != strings.Join(want.TailscaleIPs, " ") || st.Tailnet != want.Tailnet {
+		t.Errorf("/status = %+v, want %+v", st, want)
+	}
+}
+
+func TestHttpQR(t *testing.T) {
+	d, srv := newFakeHttp(t)
+	d.SetLayout(Bootstrap)
+	status := runningStatus()
+	status.BackendState = "NeedsLogin"
+	if err := d.Refresh(RefreshData{TailscaleStatus: status}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := get(t, srv.URL+"/qr.png"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/qr.png without an AuthURL = %s, want 404", resp.Status)
+	}
+
+	status.AuthURL = "https://login.tailscale.com/a/abc123"
+	if err := d.Refresh(RefreshData{TailscaleStatus: status}); err != nil {
+		t.Fatal(err)
+	}
+	resp := get(t, srv.URL+"/qr.png")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("/qr.png with an AuthURL = %s %s, want a PNG", resp.Status, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestHttpEvents(t *testing.T) {
+	d, srv := newFakeHttp(t)
+	d.SetLayout(Running)
+	resp := get(t, srv.URL+"/events")
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("/events Content-Type = %q, want text/event-stream", ct)
+	}
+	events := make(chan httpStatus)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			var st httpStatus
+			if data := strings.TrimPrefix(sc.Text(), "data: "); data != sc.Text() && json.Unmarshal([]byte(data), &st) == nil {
+				events <- st
+			}
+		}
+	}()
+
+	// Each Refresh is pushed to the subscriber
+	for _, state := range []string{"Starting", "Running"} {
+		status := runningStatus()
+		status.BackendState = state
+		if err := d.Refresh(RefreshData{TailscaleStatus: status}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case st := <-events:
+			if st.BackendState != state {
+				t.Errorf("event BackendState = %s, want %s", st.BackendState, state)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event after a Refresh to %s", state)
+		}
+	}
+}
+
+func TestHttpCleanUpEvents(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	d := &Http{Addr: addr}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	get(t, "http://"+addr+"/events")
+	d.mu.RLock()
+	subscribers := len(d.subscribers)
+	d.mu.RUnlock()
+	if subscribers != 1 {
+		t.Fatalf("%d subscribers with /events open, want 1", subscribers)
+	}
+
+	start := time.Now()
+	d.CleanUp()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("CleanUp with /events open took %v", elapsed)
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(d.subscribers) != 0 {
+		t.Errorf("%d subscribers left after CleanUp", len(d.subscribers))
+	}
+}
@@ -1,3 +1,385 @@
 package display
 
-//TODO
+import (
+	"fmt"
+	ui "github.com/gizak/termui/v3"
+	"github.com/jtcressy-home/edged/pkg/i2c"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLcdAddress = 0x27
+	defaultLcdCols    = 16
+	defaultLcdRows    = 2
+	defaultLcdScroll  = 400 * time.Millisecond
+	defaultLcdPage    = 3 * time.Second
+
+	// PCF8574 backpack pin mapping: P0=RS, P1=RW, P2=E, P3=backlight, P4-P7=D4-D7
+	pcfRS        = 0x01
+	pcfEnable    = 0x04
+	pcfBacklight = 0x08
+
+	hd44780Clear       = 0x01
+	hd44780EntryMode   = 0x06 // increment, no shift
+	hd44780DisplayOn   = 0x0C // display on, cursor off, blink off
+	hd44780DisplayOff  = 0x08
+	hd44780FunctionSet = 0x28 // 4-bit bus, 2 lines, 5x8 font
+	hd44780SetDDRAM    = 0x80
+)
+
+// lcdField is one label/value pair shown on the LCD. Each field takes two
+// rows: the label on the first and the (possibly scrolling) value below.
+type lcdField struct {
+	label string
+	value string
+}
+
+// Lcd drives an HD44780 character LCD through a PCF8574 I2C backpack. Both
+// 16x2 and 20x4 panels are supported. Fields are paged and values wider than
+// the panel scroll on the panel's own clock, NextFrame tells the caller when
+// to Refresh again.
+type Lcd struct {
+	// Bus is the I2C bus the backpack is attached to. When nil, Init opens
+	// /dev/i2c-<BusNumber>, so the zero BusNumber is bus 0. A bus opened by
+	// Init is closed by CleanUp and opened afresh on the next Init.
+	Bus       i2c.Bus
+	BusNumber int
+	Address   uint16
+	Cols      int
+	Rows      int
+	// ScrollInterval is the time between scroll steps and PageInterval how
+	// long each page, and both ends of a scrolling value, are held.
+	ScrollInterval time.Duration
+	PageInterval   time.Duration
+
+	ownBus bool
+	layout Layout
+	fields []lcdField
+	page   int
+	scroll int
+	next   time.Time // when the page or scroll position advances
+	lines  []string
+	shown  []string
+	err    error
+}
+
+func (d *Lcd) Init() (err error) {
+	if d.Address == 0 {
+		d.Address = defaultLcdAddress
+	}
+	if d.Cols == 0 {
+		d.Cols = defaultLcdCols
+	}
+	if d.Rows == 0 {
+		d.Rows = defaultLcdRows
+	}
+	if d.ScrollInterval == 0 {
+		d.ScrollInterval = defaultLcdScroll
+	}
+	if d.PageInterval == 0 {
+		d.PageInterval = defaultLcdPage
+	}
+	if d.Rows != 2 && d.Rows != 4 {
+		return fmt.Errorf("lcd: unsupported geometry %dx%d", d.Cols, d.Rows)
+	}
+	if d.Bus == nil {
+		dev, err := i2c.Open(d.BusNumber)
+		if err != nil {
+			return fmt.Errorf("lcd: %w", err)
+		}
+		d.Bus, d.ownBus = dev, true
+	}
+	d.lines = make([]string, d.Rows)
+	d.shown = make([]string, d.Rows)
+
+	// Power-on reset into 4-bit mode, see figure 24 of the HD44780 datasheet
+	time.Sleep(50 * time.Millisecond)
+	for _, n := range []struct {
+		nibble byte
+		wait   time.Duration
+	}{
+		{0x03, 5 * time.Millisecond},
+		{0x03, 200 * time.Microsecond},
+		{0x03, 200 * time.Microsecond},
+		{0x02, 200 * time.Microsecond},
+	} {
+		if err := d.Bus.Write(d.Address, d.nibble(n.nibble, 0)); err != nil {
+			return fmt.Errorf("lcd: init: %w", err)
+		}
+		time.Sleep(n.wait)
+	}
+	for _, cmd := range []byte{hd44780FunctionSet, hd44780DisplayOff, hd44780Clear, hd44780EntryMode, hd44780DisplayOn} {
+		if err := d.command(cmd); err != nil {
+			return fmt.Errorf("lcd: init: %w", err)
+		}
+	}
+	time.Sleep(2 * time.Millisecond)
+	return nil
+}
+
+func (d *Lcd) SetLayout(layout Layout) {
+	if d.layout != layout {
+		d.rewind()
+	}
+	d.layout = layout
+}
+
+func (d *Lcd) PollEvents() <-chan ui.Event {
+	return nil
+}
+
+// Refresh computes the rows for the current page, first advancing the page
+// or scroll position if it is due. Any error from the previous Render is
+// reported here, since Render itself cannot return one.
+func (d *Lcd) Refresh(data RefreshData) (err error) {
+	if d.err != nil {
+		err, d.err = d.err, nil
+		return err
+	}
+	s := data.TailscaleStatus
+	switch d.layout {
+	case Bootstrap:
+		login := "Waiting for URL"
+		if s.AuthURL != "" {
+			login = shortURL(s.AuthURL)
+		}
+		d.setFields(
+			lcdField{"Tailscale", s.BackendState},
+			lcdField{"Login at", login},
+			lcdField{"Control", controlServer(data.ControlURL)},
+		)
+	case Running:
+		d.setFields(
+			lcdField{"Host", hostname(s)},
+			lcdField{"IP", deviceIP(s)},
+			lcdField{"Tailnet", tailnetName(s)},
+			lcdField{"State", s.BackendState},
+			lcdField{"Healthy", healthSummary(s)},
+			lcdField{"Provisioning", provisioningSummary(data.Provisioning)},
+			lcdField{"Prefs", reconcileSummary(data.Reconcile)},
+			lcdField{"Displays", displaysSummary(data.Degraded)},
+		)
+	case Configuration:
+		c := data.Config
+		if c == nil || len(c.Rows) == 0 {
+			d.setFields(lcdField{"Configuration", ""})
+			break
+		}
+		if c.Message != "" {
+			d.setFields(lcdField{"Configuration", c.Message})
+			break
+		}
+		// The selected row and those after it, one per page
+		var fields []lcdField
+		for i := c.Cursor; i < len(c.Rows) && len(fields) < d.Rows/2; i++ {
+			r := c.Rows[i]
+			label, value := "  "+r.Label, r.Value
+			if i == c.Cursor {
+				label = "> " + r.Label
+				if c.Editing {
+					// Keep the end being typed in view
+					label = "* " + r.Label
+					if len(value) > d.Cols {
+						value = value[len(value)-d.Cols:]
+					}
+				}
+			}
+			fields = append(fields, lcdField{label, value})
+		}
+		d.setFields(fields...)
+	case Provisioning:
+		lines := provisioningLines(data.Provisioning)
+		d.setFields(
+			lcdField{lines[0], strings.Join(lines[1:], " ")},
+		)
+	case Deprovisioning:
+		lines := deprovisionLines(data.Deprovision)
+		d.setFields(
+			lcdField{lines[0], strings.Join(lines[1:], " ")},
+		)
+	}
+
+	now := time.Now()
+	if !d.next.IsZero() && !now.Before(d.next) {
+		d.advance()
+	}
+	if d.next.IsZero() || !now.Before(d.next) {
+		d.next = now.Add(d.hold())
+	}
+
+	perPage := d.Rows / 2
+	start := d.page * perPage
+	for i := range d.lines {
+		d.lines[i] = ""
+	}
+	for i := 0; i < perPage && start+i < len(d.fields); i++ {
+		f := d.fields[start+i]
+		d.lines[i*2] = f.label
+		d.lines[i*2+1] = window(f.value, d.scroll, d.Cols)
+	}
+	return
+}
+
+// NextFrame returns when the panel next pages or scrolls, or the zero time
+// when everything fits on a single page.
+func (d *Lcd) NextFrame() time.Time {
+	if len(d.fields) <= d.Rows/2 && d.widest() <= d.Cols {
+		return time.Time{}
+	}
+	return d.next
+}
+
+// advance scrolls the widest value on the current page to its end, then
+// moves on to the next page.
+func (d *Lcd) advance() {
+	if end := d.widest() - d.Cols; d.scroll < end {
+		d.scroll++
+		return
+	}
+	d.scroll = 0
+	d.page++
+	if d.page*(d.Rows/2) >= len(d.fields) {
+		d.page = 0
+	}
+}
+
+// hold is how long the current position is shown: a page and both ends of a
+// scrolling value are held for PageInterval, the steps in between are
+// ScrollInterval apart.
+func (d *Lcd) hold() time.Duration {
+	if d.scroll > 0 && d.scroll < d.widest()-d.Cols {
+		return d.ScrollInterval
+	}
+	return d.PageInterval
+}
+
+// widest returns the length of the widest value on the current page.
+func (d *Lcd) widest() int {
+	perPage := d.Rows / 2
+	widest := 0
+	for i := d.page * perPage; i < (d.page+1)*perPage && i < len(d.fields); i++ {
+		if n := len(d.fields[i].value); n > widest {
+			widest = n
+		}
+	}
+	return widest
+}
+
+// rewind goes back to the first page, shown for a full PageInterval.
+func (d *Lcd) rewind() {
+	d.page, d.scroll = 0, 0
+	d.next = time.Time{}
+}
+
+func (d *Lcd) Render() {
+	for row, line := range d.lines {
+		if line == d.shown[row] {
+			continue
+		}
+		if err := d.writeRow(row, line); err != nil {
+			d.err = err
+			return
+		}
+		d.shown[row] = line
+	}
+}
+
+// Resize is a no-op, the panel geometry is fixed.
+func (d *Lcd) Resize(width, height int) {}
+
+// Clear is a no-op, Render rewrites every changed row padded to full width.
+func (d *Lcd) Clear() {}
+
+func (d *Lcd) CleanUp() {
+	if d.Bus == nil {
+		return
+	}
+	d.command(hd44780Clear)
+	d.command(hd44780DisplayOff)
+	d.Bus.Write(d.Address, []byte{0x00}) // backlight off
+	if d.ownBus {
+		d.Bus.Close()
+		d.Bus, d.ownBus = nil, false
+	}
+}
+
+// setFields replaces the paged fields, restarting from the first page when
+// the set of labels changes underneath the current position.
+func (d *Lcd) setFields(fields ...lcdField) {
+	if len(fields) != len(d.fields) {
+		d.rewind()
+	} else {
+		for i := range fields {
+			if fields[i].label != d.fields[i].label {
+				d.rewind()
+				break
+			}
+		}
+	}
+	d.fields = fields
+}
+
+func (d *Lcd) writeRow(row int, text string) error {
+	return d.writeCodes(row, pad(text, d.Cols))
+}
+
+// writeCodes writes HD44780 character codes to the start of row.
+func (d *Lcd) writeCodes(row int, codes []byte) error {
+	addr := byte(row%2)*0x40 + byte(row/2*d.Cols)
+	if err := d.command(hd44780SetDDRAM | addr); err != nil {
+		return err
+	}
+	var buf []byte
+	for _, c := range codes {
+		buf = append(buf, d.byteSeq(c, pcfRS)...)
+	}
+	return d.Bus.Write(d.Address, buf)
+}
+
+func (d *Lcd) command(cmd byte) error {
+	return d.Bus.Write(d.Address, d.byteSeq(cmd, 0))
+}
+
+// byteSeq encodes b as the two 4-bit transfers the HD44780 expects, each
+// latched by pulsing the enable line.
+func (d *Lcd) byteSeq(b byte, flags byte) []byte {
+	return append(d.nibble(b>>4, flags), d.nibble(b&0x0F, flags)...)
+}
+
+func (d *Lcd) nibble(n byte, flags byte) []byte {
+	v := n<<4 | flags | pcfBacklight
+	return []byte{v | pcfEnable, v}
+}
+
+// window returns the width-character slice of s starting at offset.
+func window(s string, offset, width int) string {
+	if len(s) <= width {
+		return s
+	}
+	if offset > len(s)-width {
+		offset = len(s) - width
+	}
+	return s[offset : offset+width]
+}
+
+// pad truncates or space-pads s to exactly width HD44780 character codes,
+// replacing anything outside printable ASCII.
+func pad(s string, width int) []byte {
+	out := make([]byte, width)
+	for i := range out {
+		out[i] = ' '
+	}
+	i := 0
+	for _, r := range s {
+		if i >= width {
+			break
+		}
+		if r < 0x20 || r > 0x7D {
+			r = '?'
+		}
+		out[i] = byte(r)
+		i++
+	}
+	return out
+}
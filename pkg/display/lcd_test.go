@@ -0,0 +1,189 @@
+package display
+
+import (
+	"github.com/jtcressy-home/edged/pkg/i2c"
+	"strings"
+	"tailscale.com/ipn/ipnstate"
+	"testing"
+	"time"
+)
+
+func newFakeLcd(t *testing.T, cols, rows int) (*Lcd, *FakeHD44780) {
+	t.Helper()
+	bus := i2c.NewFake()
+	panel := NewFakeHD44780(cols, rows)
+	bus.Attach(defaultLcdAddress, panel)
+	d := &Lcd{Bus: bus, Cols: cols, Rows: rows, ScrollInterval: time.Millisecond, PageInterval: 2 * time.Millisecond}
+	if err := d.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	return d, panel
+}
+
+// show refreshes and renders d, returning what the panel shows.
+func show(t *testing.T, d *Lcd, panel *FakeHD44780, data RefreshData) []string {
+	t.Helper()
+	if err := d.Refresh(data); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	d.Render()
+	var rows []string
+	for r := 0; r < d.Rows; r++ {
+		rows = append(rows, strings.TrimRight(panel.Row(r), " "))
+	}
+	return rows
+}
+
+// next waits for the next frame of d and shows it.
+func next(t *testing.T, d *Lcd, panel *FakeHD44780, data RefreshData) []string {
+	t.Helper()
+	at := d.NextFrame()
+	if at.IsZero() {
+		t.Fatal("NextFrame() is zero, want the panel to be animating")
+	}
+	time.Sleep(time.Until(at))
+	return show(t, d, panel, data)
+}
+
+func TestLcdInit(t *testing.T) {
+	for _, tt := range []struct {
+		cols, rows int
+	}{
+		{16, 2},
+		{20, 4},
+	} {
+		d, panel := newFakeLcd(t, tt.cols, tt.rows)
+		if !panel.On() || !panel.Backlight() {
+			t.Errorf("%dx%d: on=%v backlight=%v after Init, want both", tt.cols, tt.rows, panel.On(), panel.Backlight())
+		}
+		if got := strings.TrimSpace(panel.String()); got != "" {
+			t.Errorf("%dx%d: panel shows %q after Init, want it blank", tt.cols, tt.rows, got)
+		}
+		d.CleanUp()
+		if panel.On() || panel.Backlight() {
+			t.Errorf("%dx%d: on=%v backlight=%v after CleanUp, want neither", tt.cols, tt.rows, panel.On(), panel.Backlight())
+		}
+	}
+}
+
+func TestLcdGeometry(t *testing.T) {
+	d := &Lcd{Bus: i2c.NewFake(), Cols: 16, Rows: 3}
+	if err := d.Init(); err == nil {
+		t.Fatal("Init of a 16x3 panel = nil, want an error")
+	}
+}
+
+func TestLcdPages(t *testing.T) {
+	data := RefreshData{TailscaleStatus: runningStatus()}
+	for _, tt := range []struct {
+		cols, rows int
+		want       [][]string
+	}{
+		{16, 2, [][]string{
+			{"Host", "edge-1234"},
+			{"IP", "100.64.0.1"},
+			{"Tailnet", "example.com"},
+		}},
+		{20, 4, [][]string{
+			{"Host", "edge-1234", "IP", "100.64.0.1"},
+			{"Tailnet", "example.com", "State", "Running"},
+		}},
+	} {
+		d, panel := newFakeLcd(t, tt.cols, tt.rows)
+		d.SetLayout(Running)
+		for i, want := range tt.want {
+			step := next
+			if i == 0 {
+				step = show
+			}
+			if got := step(t, d, panel, data); strings.Join(got, "|") != strings.Join(want, "|") {
+				t.Errorf("%dx%d page %d = %q, want %q", tt.cols, tt.rows, i, got, want)
+			}
+		}
+	}
+}
+
+func TestLcdPageTimer(t *testing.T) {
+	d, panel := newFakeLcd(t, 16, 2)
+	d.PageInterval = time.Hour
+	d.SetLayout(Running)
+	data := RefreshData{TailscaleStatus: runningStatus()}
+	show(t, d, panel, data)
+	// Refreshes for status changes do not flip through the pages
+	for i := 0; i < 3; i++ {
+		if got := show(t, d, panel, data); got[0] != "Host" {
+			t.Fatalf("refresh %d shows %q before the page is due, want the first page", i, got)
+		}
+	}
+	if at := time.Until(d.NextFrame()); at < 59*time.Minute {
+		t.Errorf("next frame in %v, want a PageInterval away", at)
+	}
+
+	// Nothing to page or scroll, nothing to wake up for
+	d.SetLayout(Configuration)
+	show(t, d, panel, RefreshData{Config: &ConfigStatus{Message: "Saved"}})
+	if at := d.NextFrame(); !at.IsZero() {
+		t.Errorf("NextFrame() = %v for a single page, want zero", at)
+	}
+}
+
+func TestLcdScroll(t *testing.T) {
+	d, panel := newFakeLcd(t, 16, 2)
+	d.SetLayout(Bootstrap)
+	url := "https://login.tailscale.com/a/0123"
+	data := RefreshData{TailscaleStatus: &ipnstate.Status{BackendState: "NeedsLogin", AuthURL: url}}
+	value := shortURL(url)
+	show(t, d, panel, data) // state
+	for offset := 0; offset <= len(value)-16; offset++ {
+		got := next(t, d, panel, data)
+		if want := []string{"Login at", value[offset : offset+16]}; strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Fatalf("offset %d = %q, want %q", offset, got, want)
+		}
+	}
+	if got := next(t, d, panel, data); got[0] != "Control" {
+		t.Errorf("after scrolling to the end the panel shows %q, want the next page", got)
+	}
+}
+
+func TestLcdBusZero(t *testing.T) {
+	d := &Lcd{BusNumber: 0}
+	err := d.Init()
+	if err == nil {
+		d.CleanUp()
+		t.Skip("/dev/i2c-0 is present")
+	}
+	if !strings.Contains(err.Error(), "/dev/i2c-0") {
+		t.Errorf("Init with BusNumber 0 = %v, want it to open /dev/i2c-0", err)
+	}
+}
+
+func TestLcdPatterns(t *testing.T) {
+	d, panel := newFakeLcd(t, 20, 4)
+	for _, tt := range []struct {
+		name string
+		want []string
+	}{
+		{"blocks", []string{strings.Repeat("\xff", 20), strings.Repeat("\xff", 20), strings.Repeat("\xff", 20), strings.Repeat("\xff", 20)}},
+		{"charset", []string{` !"#$%&'()*+,-./0123`, "456789:;<=>?@ABCDEFG", "HIJKLMNOPQRSTUVWXYZ[", `\]^_` + "`abcdefghijklmno"}},
+		{"rows", []string{"01234567890123456789", "11234567890123456789", "21234567890123456789", "31234567890123456789"}},
+	} {
+		if err := d.DrawPattern(tt.name); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for r, want := range tt.want {
+			if got := panel.Row(r); got != want {
+				t.Errorf("%s: row %d = %q, want %q", tt.name, r, got, want)
+			}
+		}
+	}
+
+	// Render redraws what the pattern overwrote
+	if got := show(t, d, panel, RefreshData{TailscaleStatus: &ipnstate.Status{BackendState: "Starting"}}); strings.Contains(strings.Join(got, ""), "1234567890") {
+		t.Errorf("after a pattern Render shows %q, want the status", got)
+	}
+
+	err := d.DrawPattern("stripes")
+	if want := `lcd: unknown pattern "stripes", want one of blocks,charset,rows`; err == nil || err.Error() != want {
+		t.Errorf("DrawPattern(stripes) = %v, want %s", err, want)
+	}
+}
@@ -1,3 +1,206 @@
 package display
 
-//TODO
+import (
+	"fmt"
+	ui "github.com/gizak/termui/v3"
+	"github.com/jtcressy-home/edged/pkg/i2c"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	defaultOledAddress = 0x3C
+	defaultOledWidth   = 128
+	defaultOledHeight  = 64
+
+	ssd1306Command = 0x00
+	ssd1306Data    = 0x40
+
+	// ssd1306Chunk bounds the payload of a single data write, as many I2C
+	// adapters cannot take a full framebuffer in one transfer.
+	ssd1306Chunk = 32
+)
+
+// Oled drives an SSD1306 monochrome OLED panel over I2C.
+type Oled struct {
+	// Bus is the I2C bus the panel is attached to. When nil, Init opens
+	// /dev/i2c-<BusNumber>, so the zero BusNumber is bus 0. A bus opened by
+	// Init is closed by CleanUp and opened afresh on the next Init.
+	Bus       i2c.Bus
+	BusNumber int
+	Address   uint16
+	Width     int
+	Height    int
+
+	ownBus bool
+	layout Layout
+	fb     *bitmap
+	err    error
+}
+
+func (d *Oled) Init() (err error) {
+	if d.Address == 0 {
+		d.Address = defaultOledAddress
+	}
+	if d.Width == 0 {
+		d.Width = defaultOledWidth
+	}
+	if d.Height == 0 {
+		d.Height = defaultOledHeight
+	}
+	if d.Bus == nil {
+		dev, err := i2c.Open(d.BusNumber)
+		if err != nil {
+			return fmt.Errorf("oled: %w", err)
+		}
+		d.Bus, d.ownBus = dev, true
+	}
+	d.fb = newBitmap(d.Width, d.Height)
+
+	comPins := byte(0x12)
+	if d.Height == 32 {
+		comPins = 0x02
+	}
+	if err := d.command(
+		0xAE,       // display off
+		0xD5, 0x80, // clock divide ratio / oscillator frequency
+		0xA8, byte(d.Height-1), // multiplex ratio
+		0xD3, 0x00, // display offset
+		0x40,       // start line 0
+		0x8D, 0x14, // enable charge pump
+		0x20, 0x00, // horizontal addressing mode
+		0xA1,          // segment remap
+		0xC8,          // COM output scan direction: remapped
+		0xDA, comPins, // COM pins hardware configuration
+		0x81, 0xCF, // contrast
+		0xD9, 0xF1, // pre-charge period
+		0xDB, 0x40, // VCOMH deselect level
+		0xA4, // resume to RAM content
+		0xA6, // normal, not inverted
+		0xAF, // display on
+	); err != nil {
+		return fmt.Errorf("oled: init: %w", err)
+	}
+	return d.flush()
+}
+
+func (d *Oled) SetLayout(layout Layout) {
+	d.layout = layout
+}
+
+func (d *Oled) PollEvents() <-chan ui.Event {
+	return nil
+}
+
+// Refresh redraws the framebuffer from data. Any error from the previous
+// Render is reported here, since Render itself cannot return one.
+func (d *Oled) Refresh(data RefreshData) (err error) {
+	if d.err != nil {
+		err, d.err = d.err, nil
+		return err
+	}
+	s := data.TailscaleStatus
+	d.fb.Clear()
+	switch d.layout {
+	case Bootstrap:
+		if s.AuthURL == "" {
+			d.fb.Text(0, 0, "Tailscale Login")
+			d.fb.Text(0, 2*lineHeight, "Waiting for")
+			d.fb.Text(0, 3*lineHeight, "Auth URL...")
+			d.fb.Text(0, 5*lineHeight, s.BackendState)
+			d.fb.Text(0, 7*lineHeight, controlServer(data.ControlURL))
+			return
+		}
+		q, err := qrcode.New(s.AuthURL, qrcode.Low)
+		if err != nil {
+			return err
+		}
+		x := d.fb.QRCode(0, 0, d.Height, q) + 2
+		d.fb.Text(x, 0, "Scan to")
+		d.fb.Text(x, lineHeight, "log in")
+		d.fb.Text(x, 3*lineHeight, s.BackendState)
+		d.fb.Text(x, 5*lineHeight, "Control:")
+		d.fb.Text(x, 6*lineHeight, controlServer(data.ControlURL))
+	case Running:
+		d.fb.Text(0, 0, hostname(s))
+		d.fb.Text(0, lineHeight, deviceIP(s))
+		d.fb.Text(0, 2*lineHeight, tailnetName(s))
+		if len(data.Degraded) > 0 {
+			d.fb.Text(0, 3*lineHeight, displaysSummary(data.Degraded))
+		}
+		d.fb.Text(0, 4*lineHeight, "State: "+s.BackendState)
+		d.fb.Text(0, 5*lineHeight, "Healthy: "+healthSummary(s))
+		d.fb.Text(0, 6*lineHeight, provisioningSummary(data.Provisioning))
+		d.fb.Text(0, 7*lineHeight, "Prefs: "+reconcileSummary(data.Reconcile))
+	case Configuration:
+		d.fb.Text(0, 0, "Configuration")
+		if c := data.Config; c != nil {
+			// Six rows fit between the title and the message line
+			lines := configLines(&ConfigStatus{Rows: c.Rows, Cursor: c.Cursor, Editing: c.Editing})
+			start := 0
+			if c.Cursor > 5 {
+				start = c.Cursor - 5
+			}
+			for i := 0; i < 6 && start+i < len(lines); i++ {
+				d.fb.Text(0, (i+1)*lineHeight, lines[start+i])
+			}
+			d.fb.Text(0, 7*lineHeight, c.Message)
+		}
+	case Provisioning:
+		for i, l := range provisioningLines(data.Provisioning) {
+			d.fb.Text(0, i*lineHeight, l)
+		}
+	case Deprovisioning:
+		for i, l := range deprovisionLines(data.Deprovision) {
+			d.fb.Text(0, i*lineHeight, l)
+		}
+	}
+	return
+}
+
+func (d *Oled) Render() {
+	if err := d.flush(); err != nil {
+		d.err = err
+	}
+}
+
+// Resize is a no-op, the panel geometry is fixed.
+func (d *Oled) Resize(width, height int) {}
+
+// Clear is a no-op, every Render pushes the complete framebuffer so the
+// panel never shows stale pixels and does not flicker between frames.
+func (d *Oled) Clear() {}
+
+func (d *Oled) CleanUp() {
+	if d.Bus == nil {
+		return
+	}
+	d.command(0xAE)
+	if d.ownBus {
+		d.Bus.Close()
+		d.Bus, d.ownBus = nil, false
+	}
+}
+
+func (d *Oled) command(cmds ...byte) error {
+	return d.Bus.Write(d.Address, append([]byte{ssd1306Command}, cmds...))
+}
+
+func (d *Oled) flush() error {
+	if err := d.command(
+		0x21, 0x00, byte(d.Width-1), // column address range
+		0x22, 0x00, byte(d.Height/8-1), // page address range
+	); err != nil {
+		return err
+	}
+	pages := d.fb.Pages()
+	for i := 0; i < len(pages); i += ssd1306Chunk {
+		end := i + ssd1306Chunk
+		if end > len(pages) {
+			end = len(pages)
+		}
+		if err := d.Bus.Write(d.Address, append([]byte{ssd1306Data}, pages[i:end]...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
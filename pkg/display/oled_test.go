@@ -0,0 +1,216 @@
+package display
+
+import (
+	"github.com/jtcressy-home/edged/pkg/i2c"
+	"inet.af/netaddr"
+	"strings"
+	"tailscale.com/ipn/ipnstate"
+	"testing"
+)
+
+// largestWrite records the size of the largest write to a fake device.
+type largestWrite struct {
+	i2c.Device
+	max int
+}
+
+func (w *largestWrite) Write(b []byte) error {
+	if len(b) > w.max {
+		w.max = len(b)
+	}
+	return w.Device.Write(b)
+}
+
+func newFakeOled(t *testing.T, width, height int) (*Oled, *FakeSSD1306) {
+	t.Helper()
+	bus := i2c.NewFake()
+	panel := NewFakeSSD1306(width, height)
+	bus.Attach(defaultOledAddress, panel)
+	d := &Oled{Bus: bus, Width: width, Height: height}
+	if err := d.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	return d, panel
+}
+
+func runningStatus() *ipnstate.Status {
+	return &ipnstate.Status{
+		BackendState:   "Running",
+		TailscaleIPs:   []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+		Self:           &ipnstate.PeerStatus{HostName: "edge-1234", Online: true},
+		CurrentTailnet: &ipnstate.TailnetStatus{Name: "example.com"},
+	}
+}
+
+func TestOledInit(t *testing.T) {
+	for _, tt := range []struct {
+		width, height int
+	}{
+		{128, 64},
+		{128, 32},
+	} {
+		d, panel := newFakeOled(t, tt.width, tt.height)
+		if !panel.On() {
+			t.Errorf("%dx%d: panel is off after Init", tt.width, tt.height)
+		}
+		if got := strings.Count(panel.String(), "#"); got != 0 {
+			t.Errorf("%dx%d: %d pixels lit after Init, want a blank panel", tt.width, tt.height, got)
+		}
+		d.CleanUp()
+		if panel.On() {
+			t.Errorf("%dx%d: panel is on after CleanUp", tt.width, tt.height)
+		}
+	}
+}
+
+func TestOledRender(t *testing.T) {
+	bus := i2c.NewFake()
+	panel := &largestWrite{Device: NewFakeSSD1306(128, 64)}
+	bus.Attach(defaultOledAddress, panel)
+	d := &Oled{Bus: bus}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	d.SetLayout(Running)
+	if err := d.Refresh(RefreshData{TailscaleStatus: runningStatus()}); err != nil {
+		t.Fatal(err)
+	}
+	d.Render()
+	if err := d.Refresh(RefreshData{TailscaleStatus: runningStatus()}); err != nil {
+		t.Fatalf("Render error reported by Refresh: %v", err)
+	}
+	d.Render()
+
+	want := newBitmap(128, 64)
+	want.Text(0, 0, "edge-1234")
+	want.Text(0, lineHeight, "100.64.0.1")
+	fake := panel.Device.(*FakeSSD1306)
+	for y := 0; y < 2*lineHeight; y++ {
+		for x := 0; x < 128; x++ {
+			if fake.Pixel(x, y) != want.At(x, y) {
+				t.Fatalf("pixel (%d, %d) = %v, want %v\n%s", x, y, fake.Pixel(x, y), want.At(x, y), fake)
+			}
+		}
+	}
+	if got := fake.String(); got != d.fb.String() {
+		t.Errorf("panel differs from the framebuffer:\n%s\nwant:\n%s", got, d.fb)
+	}
+	if panel.max > ssd1306Chunk+1 {
+		t.Errorf("largest write is %d bytes, want at most %d", panel.max, ssd1306Chunk+1)
+	}
+}
+
+func TestOledBootstrapQRCode(t *testing.T) {
+	d, panel := newFakeOled(t, 128, 64)
+	d.SetLayout(Bootstrap)
+	status := &ipnstate.Status{BackendState: "NeedsLogin", AuthURL: "https://login.tailscale.com/a/0123456789"}
+	if err := d.Refresh(RefreshData{TailscaleStatus: status}); err != nil {
+		t.Fatal(err)
+	}
+	d.Render()
+	// The QR code's finder pattern puts a dark square in the top left
+	// corner, inside the quiet zone.
+	lit := 0
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			if panel.Pixel(x, y) {
+				lit++
+			}
+		}
+	}
+	if lit == 0 {
+		t.Errorf("no QR code in the top left corner:\n%s", panel)
+	}
+}
+
+func TestOledNoDevice(t *testing.T) {
+	d := &Oled{Bus: i2c.NewFake()}
+	err := d.Init()
+	if err == nil || !i2c.IsNoDevice(err) {
+		t.Fatalf("Init with nothing on the bus = %v, want a no device error", err)
+	}
+}
+
+func TestOledRenderError(t *testing.T) {
+	bus := i2c.NewFake()
+	d, _ := newFakeOled(t, 128, 64)
+	d.Bus = bus // panel unplugged
+	d.SetLayout(Running)
+	if err := d.Refresh(RefreshData{TailscaleStatus: runningStatus()}); err != nil {
+		t.Fatal(err)
+	}
+	d.Render()
+	if err := d.Refresh(RefreshData{TailscaleStatus: runningStatus()}); err == nil {
+		t.Fatal("Refresh after a failed Render = nil, want the Render error")
+	}
+}
+
+func TestOledBusZero(t *testing.T) {
+	d := &Oled{BusNumber: 0}
+	err := d.Init()
+	if err == nil {
+		d.CleanUp()
+		t.Skip("/dev/i2c-0 is present")
+	}
+	if !strings.Contains(err.Error(), "/dev/i2c-0") {
+		t.Errorf("Init with BusNumber 0 = %v, want it to open /dev/i2c-0", err)
+	}
+}
+
+func TestOledPatterns(t *testing.T) {
+	const width, height = 128, 64
+	d, panel := newFakeOled(t, width, height)
+	lit := func() int { return strings.Count(panel.String(), "#") }
+
+	if err := d.DrawPattern("fill"); err != nil {
+		t.Fatal(err)
+	}
+	if got := lit(); got != width*height {
+		t.Errorf("fill: %d pixels lit, want all %d", got, width*height)
+	}
+
+	if err := d.DrawPattern("checkerboard"); err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if want := (x+y)%2 == 0; panel.Pixel(x, y) != want {
+				t.Fatalf("checkerboard: pixel %d,%d lit=%v, want %v", x, y, !want, want)
+			}
+		}
+	}
+
+	if err := d.DrawPattern("border"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range [][2]int{{0, 0}, {width - 1, 0}, {0, height - 1}, {width - 1, height - 1}, {width / 2, 0}, {0, height / 2}, {7, 7}} {
+		if !panel.Pixel(p[0], p[1]) {
+			t.Errorf("border: pixel %d,%d is off, want the border and top left mark lit", p[0], p[1])
+		}
+	}
+	for _, p := range [][2]int{{8, 8}, {width - 2, height - 2}, {width - 2, 1}} {
+		if panel.Pixel(p[0], p[1]) {
+			t.Errorf("border: pixel %d,%d is lit, want it off", p[0], p[1])
+		}
+	}
+
+	if err := d.DrawPattern("charset"); err != nil {
+		t.Fatal(err)
+	}
+	// The space comes first, drawn blank
+	for y := 0; y < lineHeight; y++ {
+		for x := 0; x < glyphAdvance; x++ {
+			if panel.Pixel(x, y) {
+				t.Fatalf("charset: pixel %d,%d of the space is lit", x, y)
+			}
+		}
+	}
+	if got := lit(); got == 0 || got == width*height {
+		t.Errorf("charset: %d pixels lit, want the glyphs drawn", got)
+	}
+
+	err := d.DrawPattern("stripes")
+	if want := `oled: unknown pattern "stripes", want one of fill,checkerboard,border,charset`; err == nil || err.Error() != want {
+		t.Errorf("DrawPattern(stripes) = %v, want %s", err, want)
+	}
+}
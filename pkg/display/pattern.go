@@ -0,0 +1,108 @@
+package display
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Patterner is implemented by panels that can draw test patterns, used to
+// check the wiring and geometry of a freshly assembled board.
+type Patterner interface {
+	// Patterns lists the names of the supported patterns.
+	Patterns() []string
+	// DrawPattern shows the named pattern straight away.
+	DrawPattern(name string) error
+}
+
+var (
+	oledPatterns = []string{"fill", "checkerboard", "border", "charset"}
+	lcdPatterns  = []string{"blocks", "charset", "rows"}
+)
+
+func (d *Oled) Patterns() []string {
+	return oledPatterns
+}
+
+// DrawPattern draws one of: fill lights every pixel to spot dead ones,
+// checkerboard alternates pixels to spot shorted lines, border outlines the
+// panel with marked corners to check the geometry and orientation, and
+// charset shows every glyph of the font.
+func (d *Oled) DrawPattern(name string) error {
+	d.fb.Clear()
+	switch name {
+	case "fill":
+		d.fb.Fill(0, 0, d.Width, d.Height, true)
+	case "checkerboard":
+		for y := 0; y < d.Height; y++ {
+			for x := 0; x < d.Width; x++ {
+				d.fb.Set(x, y, (x+y)%2 == 0)
+			}
+		}
+	case "border":
+		d.fb.Fill(0, 0, d.Width, 1, true)
+		d.fb.Fill(0, d.Height-1, d.Width, 1, true)
+		d.fb.Fill(0, 0, 1, d.Height, true)
+		d.fb.Fill(d.Width-1, 0, 1, d.Height, true)
+		d.fb.Fill(0, 0, 8, 8, true) // top left, to tell a rotated panel apart
+		d.fb.Text(10, 2*lineHeight, fmt.Sprintf("%dx%d", d.Width, d.Height))
+		d.fb.Text(10, 3*lineHeight, fmt.Sprintf("addr 0x%02x", d.Address))
+	case "charset":
+		perLine := d.Width / glyphAdvance
+		for i, r := 0, rune(0x20); r <= 0x7E; i, r = i+1, r+1 {
+			d.fb.Text(i%perLine*glyphAdvance, i/perLine*lineHeight, string(r))
+		}
+	default:
+		return fmt.Errorf("oled: unknown pattern %q, want one of %s", name, strings.Join(oledPatterns, ","))
+	}
+	return d.flush()
+}
+
+func (d *Lcd) Patterns() []string {
+	return lcdPatterns
+}
+
+// DrawPattern draws one of: blocks fills every cell with a solid block to
+// spot dead segments and check contrast, charset cycles the printable ASCII
+// range, and rows labels each row with its number and a column ruler to
+// check the row addressing of 20x4 panels.
+func (d *Lcd) DrawPattern(name string) error {
+	rows := make([][]byte, d.Rows)
+	switch name {
+	case "blocks":
+		for r := range rows {
+			rows[r] = make([]byte, d.Cols)
+			for c := range rows[r] {
+				rows[r][c] = 0xFF
+			}
+		}
+	case "charset":
+		ch := byte(0x20)
+		for r := range rows {
+			rows[r] = make([]byte, d.Cols)
+			for c := range rows[r] {
+				rows[r][c] = ch
+				if ch++; ch > 0x7D {
+					ch = 0x20
+				}
+			}
+		}
+	case "rows":
+		for r := range rows {
+			ruler := fmt.Sprintf("%d", r)
+			for c := 1; c < d.Cols; c++ {
+				ruler += fmt.Sprintf("%d", c%10)
+			}
+			rows[r] = pad(ruler, d.Cols)
+		}
+	default:
+		return fmt.Errorf("lcd: unknown pattern %q, want one of %s", name, strings.Join(lcdPatterns, ","))
+	}
+	for r, codes := range rows {
+		if err := d.writeCodes(r, codes); err != nil {
+			return err
+		}
+		// Render only rewrites rows that changed since it last drew them.
+		d.shown[r] = ""
+	}
+	return nil
+}
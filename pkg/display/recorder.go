@@ -0,0 +1,164 @@
+package display
+
+import (
+	"fmt"
+	ui "github.com/gizak/termui/v3"
+	"github.com/skip2/go-qrcode"
+	"strings"
+	"sync"
+)
+
+// Frame is a layout as rendered by the Recorder.
+type Frame struct {
+	Layout Layout
+	Text   string
+}
+
+// Recorder is an in-memory display that needs no terminal or hardware. It
+// records every call made to it and renders each layout to a plain-text
+// frame, which makes layouts easy to snapshot and compare.
+type Recorder struct {
+	mu     sync.Mutex
+	layout Layout
+	data   RefreshData
+	calls  []string
+	frames []Frame
+}
+
+func (d *Recorder) record(call string) {
+	d.calls = append(d.calls, call)
+}
+
+func (d *Recorder) Init() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.record("Init")
+	return nil
+}
+
+func (d *Recorder) SetLayout(layout Layout) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.record("SetLayout " + layout.String())
+	d.layout = layout
+}
+
+func (d *Recorder) PollEvents() <-chan ui.Event {
+	return nil
+}
+
+func (d *Recorder) Refresh(data RefreshData) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.record("Refresh")
+	d.data = data
+	return nil
+}
+
+func (d *Recorder) Render() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.record("Render")
+	if d.data.TailscaleStatus == nil {
+		return
+	}
+	d.frames = append(d.frames, Frame{
+		Layout: d.layout,
+		Text:   RenderText(d.layout, d.data),
+	})
+}
+
+func (d *Recorder) Resize(width, height int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.record(fmt.Sprintf("Resize %dx%d", width, height))
+}
+
+func (d *Recorder) Clear() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.record("Clear")
+}
+
+func (d *Recorder) CleanUp() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.record("CleanUp")
+}
+
+// Calls returns the calls made so far, e.g. "SetLayout Running".
+func (d *Recorder) Calls() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string{}, d.calls...)
+}
+
+// Frames returns every frame rendered so far.
+func (d *Recorder) Frames() []Frame {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Frame{}, d.frames...)
+}
+
+// Frame returns the last frame rendered, or "" before the first Render.
+func (d *Recorder) Frame() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.frames) == 0 {
+		return ""
+	}
+	return d.frames[len(d.frames)-1].Text
+}
+
+// RenderText renders layout as plain text, with the login QR code drawn in
+// half-height block characters.
+func RenderText(layout Layout, data RefreshData) string {
+	s := data.TailscaleStatus
+	var b strings.Builder
+	fmt.Fprintf(&b, "== %s ==\n", layout)
+	row := func(label, value string) {
+		fmt.Fprintf(&b, "%-14s %s\n", label+":", value)
+	}
+	switch layout {
+	case Bootstrap:
+		if s.AuthURL != "" {
+			q, err := qrcode.New(s.AuthURL, qrcode.Medium)
+			if err != nil {
+				fmt.Fprintf(&b, "QR code error: %v\n", err)
+			} else {
+				b.WriteString(q.ToSmallString(false))
+			}
+		} else {
+			b.WriteString("Waiting for Auth URL\n")
+		}
+		row("Status", s.BackendState)
+		row("Healthy", healthSummary(s))
+		row("Control", controlServer(data.ControlURL))
+		row("Auth URL", s.AuthURL)
+		if !data.AuthURLExpires.IsZero() {
+			row("Expires", data.AuthURLExpires.Format("15:04:05"))
+		}
+	case Running:
+		row("Status", s.BackendState)
+		row("Healthy", healthSummary(s))
+		row("Tailnet", tailnetName(s))
+		row("Hostname", hostname(s))
+		row("Device IP", deviceIP(s))
+		row("Provisioning", provisioningSummary(data.Provisioning))
+		row("Prefs", reconcileSummary(data.Reconcile))
+		row("Displays", displaysSummary(data.Degraded))
+	case Configuration:
+		for _, l := range configLines(data.Config) {
+			b.WriteString(l + "\n")
+		}
+	case Provisioning:
+		for _, l := range provisioningLines(data.Provisioning) {
+			b.WriteString(l + "\n")
+		}
+	case Deprovisioning:
+		for _, l := range deprovisionLines(data.Deprovision) {
+			b.WriteString(l + "\n")
+		}
+	}
+	return b.String()
+}
@@ -1,7 +1,77 @@
 package display
 
-import "tailscale.com/ipn/ipnstate"
+import (
+	"tailscale.com/ipn/ipnstate"
+	"time"
+)
 
 type RefreshData struct {
 	TailscaleStatus *ipnstate.Status
+	AuthURLExpires  time.Time // when the login QR code goes stale
+	ControlURL      string    // control server logged in to, empty for Tailscale's
+	Deprovision     *DeprovisionStatus
+	Provisioning    *ProvisioningStatus
+	Reconcile       *ReconcileStatus
+	Degraded        []DegradedDisplay // filled in by Set
+	Config          *ConfigStatus
+}
+
+// DeprovisionStatus reports the progress of the poison-pill protocol while it
+// is pending confirmation or wiping the device.
+type DeprovisionStatus struct {
+	Phase     string
+	DryRun    bool
+	Deadline  time.Time // end of the confirmation grace period
+	Step      string    // step currently running
+	Completed int
+	Total     int
+	Error     string
+	RetryAt   time.Time // when a failed wipe is retried
+}
+
+// ProvisioningStatus reports the progress of applying the roles assigned to
+// the device through its ACL tags.
+type ProvisioningStatus struct {
+	State     string
+	Roles     []string
+	Step      string // role/step currently running
+	Completed int
+	Total     int
+	Error     string
+	RetryAt   time.Time // when a failed step is retried
+}
+
+// ReconcileStatus reports the outcome of the last pass enforcing the
+// tailscale preferences file.
+type ReconcileStatus struct {
+	Time    time.Time
+	Applied bool     // tailscaled's prefs were changed to match the file
+	DryRun  bool     // Changes are pending, dry-run does not apply them
+	Changes []string // one "Field: from -> to" entry per changed pref
+	Error   string
+	RetryAt time.Time // when a failed pass is retried
+	// Quarantined prefs are changed back after every apply, e.g. by
+	// tailscaled itself, and are no longer enforced.
+	Quarantined []string
+}
+
+// DegradedDisplay is a display that is failing and will be retried.
+type DegradedDisplay struct {
+	Name    string
+	Error   string
+	RetryAt time.Time
+}
+
+// ConfigStatus is the on-device configuration screen.
+type ConfigStatus struct {
+	Rows    []ConfigRow
+	Cursor  int    // selected row
+	Editing bool   // the selected row's value is being edited
+	Message string // outcome of the last action, e.g. a validation error
+}
+
+// ConfigRow is one setting, or a button when Value is empty.
+type ConfigRow struct {
+	Label string
+	Value string
 }
@@ -0,0 +1,118 @@
+package display
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FakeSSD1306 emulates the parts of an SSD1306 controller used by Oled so it
+// can be attached to an i2c.Fake and the resulting pixels inspected.
+type FakeSSD1306 struct {
+	mu        sync.Mutex
+	width     int
+	height    int
+	ram       []byte
+	on        bool
+	colStart  int
+	colEnd    int
+	pageStart int
+	pageEnd   int
+	col       int
+	page      int
+	pending   []byte
+}
+
+func NewFakeSSD1306(width, height int) *FakeSSD1306 {
+	return &FakeSSD1306{
+		width:   width,
+		height:  height,
+		ram:     make([]byte, width*height/8),
+		colEnd:  width - 1,
+		pageEnd: height/8 - 1,
+	}
+}
+
+// ssd1306Args is the number of argument bytes following each multi-byte
+// command opcode.
+var ssd1306Args = map[byte]int{
+	0x20: 1, 0x21: 2, 0x22: 2, 0x81: 1, 0x8D: 1, 0xA8: 1,
+	0xD3: 1, 0xD5: 1, 0xD9: 1, 0xDA: 1, 0xDB: 1,
+}
+
+func (f *FakeSSD1306) Write(b []byte) error {
+	if len(b) == 0 {
+		return fmt.Errorf("ssd1306: empty write")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch b[0] {
+	case ssd1306Command:
+		f.pending = append(f.pending, b[1:]...)
+		for len(f.pending) > 0 {
+			n := ssd1306Args[f.pending[0]]
+			if len(f.pending) < n+1 {
+				break
+			}
+			f.command(f.pending[0], f.pending[1:n+1])
+			f.pending = f.pending[n+1:]
+		}
+	case ssd1306Data:
+		for _, v := range b[1:] {
+			f.ram[f.page*f.width+f.col] = v
+			f.col++
+			if f.col > f.colEnd {
+				f.col = f.colStart
+				f.page++
+				if f.page > f.pageEnd {
+					f.page = f.pageStart
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("ssd1306: unknown control byte 0x%02x", b[0])
+	}
+	return nil
+}
+
+func (f *FakeSSD1306) command(op byte, args []byte) {
+	switch op {
+	case 0xAE:
+		f.on = false
+	case 0xAF:
+		f.on = true
+	case 0x21:
+		f.colStart, f.colEnd = int(args[0]), int(args[1])
+		f.col = f.colStart
+	case 0x22:
+		f.pageStart, f.pageEnd = int(args[0]), int(args[1])
+		f.page = f.pageStart
+	}
+}
+
+// On reports whether the panel has been switched on.
+func (f *FakeSSD1306) On() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.on
+}
+
+// Pixel reports whether the pixel at (x, y) is lit.
+func (f *FakeSSD1306) Pixel(x, y int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if x < 0 || y < 0 || x >= f.width || y >= f.height {
+		return false
+	}
+	return f.ram[(y/8)*f.width+x]&(1<<(y%8)) != 0
+}
+
+// String renders the panel contents as text, one '#' per lit pixel.
+func (f *FakeSSD1306) String() string {
+	b := newBitmap(f.width, f.height)
+	for y := 0; y < f.height; y++ {
+		for x := 0; x < f.width; x++ {
+			b.Set(x, y, f.Pixel(x, y))
+		}
+	}
+	return b.String()
+}
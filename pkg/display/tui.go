@@ -1,7 +1,6 @@
 package display
 
 import (
-	"fmt"
 	ui "github.com/gizak/termui/v3"
 	"github.com/gizak/termui/v3/widgets"
 	"github.com/skip2/go-qrcode"
@@ -9,7 +8,12 @@ import (
 	"sync"
 )
 
-var initonce sync.Once
+// The terminal is process-wide, termOpen records whether ui.Init succeeded
+// without a ui.Close since, so a Tui can be cleaned up and initialised again.
+var (
+	termMu   sync.Mutex
+	termOpen bool
+)
 
 type Tui struct {
 	layout Layout
@@ -17,18 +21,28 @@ type Tui struct {
 }
 
 func (d *Tui) CleanUp() {
-	ui.Close()
+	termMu.Lock()
+	defer termMu.Unlock()
+	if termOpen {
+		ui.Close()
+		termOpen = false
+	}
 }
 
 func (d *Tui) Init() (err error) {
-	initonce.Do(func() {
-		err = ui.Init()
-	})
+	termMu.Lock()
+	defer termMu.Unlock()
+	if !termOpen {
+		if err := ui.Init(); err != nil {
+			return err
+		}
+		termOpen = true
+	}
 	termWidth, termHeight := ui.TerminalDimensions()
 	grid := ui.NewGrid()
 	grid.SetRect(0, 0, termWidth, termHeight)
-	d.output = append(d.output, grid)
-	return err
+	d.output = []ui.Drawable{grid}
+	return nil
 }
 
 func (d *Tui) SetLayout(layout Layout) {
@@ -63,15 +77,13 @@ func (d *Tui) Refresh(data RefreshData) (err error) {
 		statusTable.Title = "Tailscale Status"
 		statusTable.Rows = [][]string{
 			{"Status", data.TailscaleStatus.BackendState},
-			{"Healthy", func() string {
-				if data.TailscaleStatus.Self.Online && len(data.TailscaleStatus.Health) < 1 {
-					return "Yes"
-				} else {
-					return fmt.Sprintf("No: %v", strings.Join(data.TailscaleStatus.Health, ", "))
-				}
-			}()},
+			{"Healthy", healthSummary(data.TailscaleStatus)},
+			{"Control", controlServer(data.ControlURL)},
 			{"Auth URL", data.TailscaleStatus.AuthURL},
 		}
+		if !data.AuthURLExpires.IsZero() {
+			statusTable.Rows = append(statusTable.Rows, []string{"Expires", data.AuthURLExpires.Format("15:04:05")})
+		}
 		maxRowLabelWidth := 0
 		maxRowValueWidth := 0
 		for _, r := range statusTable.Rows {
@@ -97,13 +109,7 @@ func (d *Tui) Refresh(data RefreshData) (err error) {
 		statusTable.Title = "Tailscale Status"
 		statusTable.Rows = [][]string{
 			{"Status", data.TailscaleStatus.BackendState},
-			{"Healthy", func() string {
-				if data.TailscaleStatus.Self.Online && len(data.TailscaleStatus.Health) < 1 {
-					return "Yes"
-				} else {
-					return fmt.Sprintf("No: %v", strings.Join(data.TailscaleStatus.Health, ", "))
-				}
-			}()},
+			{"Healthy", healthSummary(data.TailscaleStatus)},
 			{"Current Tailnet", data.TailscaleStatus.CurrentTailnet.Name},
 			{"Hostname", data.TailscaleStatus.Self.HostName},
 			{"User Login", data.TailscaleStatus.User[data.TailscaleStatus.Self.UserID].LoginName},
@@ -114,6 +120,9 @@ func (d *Tui) Refresh(data RefreshData) (err error) {
 					return "<none>"
 				}
 			}()},
+			{"Provisioning", provisioningSummary(data.Provisioning)},
+			{"Prefs", reconcileSummary(data.Reconcile)},
+			{"Displays", displaysSummary(data.Degraded)},
 		}
 		statusTable.PaddingRight = 1
 		statusTable.PaddingLeft = 1
@@ -123,8 +132,25 @@ func (d *Tui) Refresh(data RefreshData) (err error) {
 
 		d.output = append(d.output, statusTable)
 	case Configuration:
+		lines := configLines(data.Config)
+		text := widgets.NewParagraph()
+		text.Title = "Configuration"
+		text.Text = strings.Join(lines, "\n") + "\n\nUp/Down to move, Enter to change, Escape to leave"
+		text.SetRect(0, 0, 72, len(lines)+5)
+		d.output = append(d.output, text)
+	case Provisioning:
+		lines := provisioningLines(data.Provisioning)
+		text := widgets.NewParagraph()
+		text.Title = lines[0]
+		text.Text = strings.Join(lines[1:], "\n")
+		text.SetRect(0, 0, 60, len(lines)+2)
+		d.output = append(d.output, text)
+	case Deprovisioning:
+		lines := deprovisionLines(data.Deprovision)
 		text := widgets.NewParagraph()
-		text.Title = "Not Implemented"
+		text.Title = lines[0]
+		text.Text = strings.Join(lines[1:], "\n")
+		text.SetRect(0, 0, 60, len(lines)+2)
 		d.output = append(d.output, text)
 	}
 	return
@@ -1 +1,202 @@
 package display
+
+import (
+	"fmt"
+	"strings"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"time"
+)
+
+func healthSummary(s *ipnstate.Status) string {
+	if len(s.Health) > 0 {
+		return "No: " + strings.Join(s.Health, ", ")
+	}
+	if s.Self == nil || !s.Self.Online {
+		return "No: offline"
+	}
+	return "Yes"
+}
+
+func deviceIP(s *ipnstate.Status) string {
+	if len(s.TailscaleIPs) > 0 {
+		return s.TailscaleIPs[0].String()
+	}
+	return "<none>"
+}
+
+func hostname(s *ipnstate.Status) string {
+	if s.Self != nil {
+		return s.Self.HostName
+	}
+	return "<unknown>"
+}
+
+func tailnetName(s *ipnstate.Status) string {
+	if s.CurrentTailnet != nil {
+		return s.CurrentTailnet.Name
+	}
+	return "<none>"
+}
+
+// shortURL strips the scheme and any trailing slash from u, since a QR code
+// cannot be shown on a character display.
+func shortURL(u string) string {
+	u = strings.TrimPrefix(u, "https://")
+	u = strings.TrimPrefix(u, "http://")
+	return strings.TrimSuffix(u, "/")
+}
+
+// controlServer is the host of the control server the device logs in to.
+func controlServer(controlURL string) string {
+	if controlURL == "" {
+		controlURL = ipn.DefaultControlURL
+	}
+	return shortURL(controlURL)
+}
+
+// deprovisionLines summarises a DeprovisionStatus as short lines of text
+// suitable for any display.
+func deprovisionLines(s *DeprovisionStatus) []string {
+	if s == nil {
+		return []string{"Deprovisioning"}
+	}
+	title := "Deprovisioning"
+	if s.DryRun {
+		title += " (dry run)"
+	}
+	lines := []string{title}
+	switch s.Phase {
+	case "Pending":
+		remaining := time.Until(s.Deadline).Round(time.Second)
+		if remaining < 0 {
+			remaining = 0
+		}
+		lines = append(lines,
+			"Removed from tailnet",
+			fmt.Sprintf("Wiping in %v", remaining),
+			"Press Esc to cancel",
+		)
+	case "Wiping":
+		lines = append(lines,
+			fmt.Sprintf("Step %d/%d", s.Completed+1, s.Total),
+			s.Step,
+		)
+	case "Failed":
+		retry := time.Until(s.RetryAt).Round(time.Second)
+		if retry < 0 {
+			retry = 0
+		}
+		lines = append(lines,
+			fmt.Sprintf("Failed at %d/%d", s.Completed+1, s.Total),
+			s.Step,
+			s.Error,
+			fmt.Sprintf("Retry in %v", retry),
+			"Press Esc to give up",
+		)
+	default:
+		lines = append(lines, s.Phase)
+	}
+	return lines
+}
+
+// provisioningSummary is a one line description of s for status tables.
+func provisioningSummary(s *ProvisioningStatus) string {
+	if s == nil {
+		return "<none>"
+	}
+	switch s.State {
+	case "Configuring":
+		return fmt.Sprintf("Configuring %d/%d", s.Completed, s.Total)
+	case "Failed":
+		return "Failed: " + s.Error
+	}
+	return s.State
+}
+
+// reconcileSummary is a one line description of s for status tables.
+func reconcileSummary(s *ReconcileStatus) string {
+	switch {
+	case s == nil:
+		return "<none>"
+	case s.Error != "" && !s.RetryAt.IsZero():
+		return fmt.Sprintf("Failed, retry %s: %s", s.RetryAt.Format("15:04:05"), s.Error)
+	case s.Error != "":
+		return "Failed: " + s.Error
+	case len(s.Quarantined) > 0:
+		return "Flapping: " + strings.Join(s.Quarantined, ", ")
+	case s.DryRun && len(s.Changes) > 0:
+		return fmt.Sprintf("Dry run: %d pending", len(s.Changes))
+	case s.Applied:
+		return fmt.Sprintf("Applied %d at %s", len(s.Changes), s.Time.Format("15:04"))
+	}
+	return "In sync"
+}
+
+// displaysSummary is a one line description of the degraded displays for
+// status tables.
+func displaysSummary(degraded []DegradedDisplay) string {
+	if len(degraded) == 0 {
+		return "OK"
+	}
+	var names []string
+	for _, d := range degraded {
+		names = append(names, d.Name)
+	}
+	return "Degraded: " + strings.Join(names, ", ")
+}
+
+// configLines renders the configuration screen as one line per row, the
+// selected row marked with '>' or '*' while it is being edited.
+func configLines(s *ConfigStatus) []string {
+	if s == nil {
+		return []string{"Configuration"}
+	}
+	var lines []string
+	for i, r := range s.Rows {
+		mark := "  "
+		if i == s.Cursor {
+			mark = "> "
+			if s.Editing {
+				mark = "* "
+			}
+		}
+		if r.Value == "" {
+			lines = append(lines, mark+"["+r.Label+"]")
+		} else {
+			lines = append(lines, mark+r.Label+": "+r.Value)
+		}
+	}
+	if s.Message != "" {
+		lines = append(lines, s.Message)
+	}
+	return lines
+}
+
+// provisioningLines summarises a ProvisioningStatus as short lines of text
+// suitable for any display.
+func provisioningLines(s *ProvisioningStatus) []string {
+	lines := []string{"Provisioning"}
+	if s == nil {
+		return lines
+	}
+	if len(s.Roles) > 0 {
+		lines = append(lines, "Roles: "+strings.Join(s.Roles, ","))
+	}
+	switch s.State {
+	case "Configuring":
+		lines = append(lines, fmt.Sprintf("Step %d/%d", s.Completed+1, s.Total), s.Step)
+	case "Failed":
+		lines = append(lines, "Failed: "+s.Step, s.Error)
+		if !s.RetryAt.IsZero() {
+			retry := time.Until(s.RetryAt).Round(time.Second)
+			if retry < 0 {
+				retry = 0
+			}
+			lines = append(lines, fmt.Sprintf("Retry in %v", retry))
+		}
+	default:
+		lines = append(lines, s.State)
+	}
+	return lines
+}
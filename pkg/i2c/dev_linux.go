@@ -0,0 +1,58 @@
+package i2c
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// i2cSlave is the I2C_SLAVE ioctl from linux/i2c-dev.h
+const i2cSlave = 0x0703
+
+// Dev is a Bus backed by a Linux /dev/i2c-N character device.
+type Dev struct {
+	mu   sync.Mutex
+	f    *os.File
+	addr uint16
+	set  bool
+}
+
+func Open(bus int) (*Dev, error) {
+	f, err := os.OpenFile(fmt.Sprintf("/dev/i2c-%d", bus), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Dev{f: f}, nil
+}
+
+func (d *Dev) Write(addr uint16, b []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.set || d.addr != addr {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.f.Fd(), i2cSlave, uintptr(addr)); errno != 0 {
+			return fmt.Errorf("i2c: selecting address 0x%02x: %w", addr, errno)
+		}
+		d.addr = addr
+		d.set = true
+	}
+	n, err := d.f.Write(b)
+	if err != nil {
+		return fmt.Errorf("i2c: write to 0x%02x: %w", addr, err)
+	}
+	if n != len(b) {
+		return fmt.Errorf("i2c: short write to 0x%02x: %d of %d bytes", addr, n, len(b))
+	}
+	return nil
+}
+
+func (d *Dev) Close() error {
+	return d.f.Close()
+}
+
+// isNack matches the errors i2c-dev returns when the addressed device does not
+// acknowledge, which varies between adapter drivers.
+func isNack(err error) bool {
+	return errors.Is(err, syscall.EREMOTEIO) || errors.Is(err, syscall.ENXIO)
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package i2c
+
+import "fmt"
+
+// Dev is a Bus backed by a Linux /dev/i2c-N character device.
+type Dev struct{}
+
+func Open(bus int) (*Dev, error) {
+	return nil, fmt.Errorf("i2c: /dev/i2c-%d is only available on linux", bus)
+}
+
+func (d *Dev) Write(addr uint16, b []byte) error {
+	return fmt.Errorf("i2c: not supported on this platform")
+}
+
+func (d *Dev) Close() error {
+	return nil
+}
+
+func isNack(err error) bool {
+	return false
+}
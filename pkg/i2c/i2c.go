@@ -0,0 +1,71 @@
+package i2c
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var errNoDevice = errors.New("no device")
+
+// IsNoDevice reports whether err means that no device acknowledged a write,
+// usually a wiring fault or the wrong address.
+func IsNoDevice(err error) bool {
+	return errors.Is(err, errNoDevice) || isNack(err)
+}
+
+// Bus is a write-only view of an I2C bus, which is all the character and
+// graphic display controllers driven by edged require.
+type Bus interface {
+	Write(addr uint16, b []byte) error
+	Close() error
+}
+
+// Device is a simulated I2C peripheral attached to a Fake bus.
+type Device interface {
+	Write(b []byte) error
+}
+
+// Fake is an in-memory Bus that routes writes to simulated devices by address.
+// Writes to an address with no device attached fail the same way a NACK would.
+type Fake struct {
+	mu      sync.Mutex
+	devices map[uint16]Device
+	closed  bool
+}
+
+func NewFake() *Fake {
+	return &Fake{devices: map[uint16]Device{}}
+}
+
+func (f *Fake) Attach(addr uint16, d Device) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.devices[addr] = d
+}
+
+func (f *Fake) Detach(addr uint16) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.devices, addr)
+}
+
+func (f *Fake) Write(addr uint16, b []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return fmt.Errorf("i2c: write on closed bus")
+	}
+	d, ok := f.devices[addr]
+	if !ok {
+		return fmt.Errorf("i2c: %w at address 0x%02x", errNoDevice, addr)
+	}
+	return d.Write(b)
+}
+
+func (f *Fake) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
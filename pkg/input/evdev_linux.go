@@ -0,0 +1,97 @@
+package input
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	evKey      = 0x01
+	keyPressed = 1
+)
+
+// inputEventSize is sizeof(struct input_event), whose timeval is 8 or 16
+// bytes depending on the architecture.
+var inputEventSize = int(unsafe.Sizeof(syscall.Timeval{})) + 8
+
+// evdevKeys names the key codes from linux/input-event-codes.h found on
+// joysticks, remotes and small keypads.
+var evdevKeys = map[uint16]string{
+	1:     "KEY_ESC",
+	14:    "KEY_BACKSPACE",
+	15:    "KEY_TAB",
+	16:    "KEY_Q",
+	28:    "KEY_ENTER",
+	38:    "KEY_L",
+	57:    "KEY_SPACE",
+	59:    "KEY_F1",
+	60:    "KEY_F2",
+	102:   "KEY_HOME",
+	103:   "KEY_UP",
+	105:   "KEY_LEFT",
+	106:   "KEY_RIGHT",
+	108:   "KEY_DOWN",
+	116:   "KEY_POWER",
+	139:   "KEY_MENU",
+	158:   "KEY_BACK",
+	352:   "KEY_OK",
+	0x100: "BTN_0",
+	0x101: "BTN_1",
+	0x102: "BTN_2",
+	0x103: "BTN_3",
+	0x130: "BTN_A",
+	0x131: "BTN_B",
+	0x13b: "BTN_START",
+	0x13a: "BTN_SELECT",
+}
+
+// Evdev is a Source of key presses from a Linux input device, e.g. the
+// Sense HAT joystick. Keys are named as in linux/input-event-codes.h, or
+// KEY_<code> for codes not in evdevKeys.
+type Evdev struct {
+	Path string // e.g. /dev/input/event0
+}
+
+func (d Evdev) Run(ctx context.Context, events chan<- Event) error {
+	// Non-blocking so Close interrupts a pending Read.
+	f, err := os.OpenFile(d.Path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return fmt.Errorf("evdev: %v", err)
+	}
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	buf := make([]byte, inputEventSize)
+	for {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("evdev: %s: %v", d.Path, err)
+		}
+		// type, code and value follow the timestamp
+		b := buf[inputEventSize-8:]
+		typ := binary.LittleEndian.Uint16(b[0:2])
+		code := binary.LittleEndian.Uint16(b[2:4])
+		value := int32(binary.LittleEndian.Uint32(b[4:8]))
+		if typ != evKey || value != keyPressed {
+			continue
+		}
+		key, ok := evdevKeys[code]
+		if !ok {
+			key = "KEY_" + strconv.Itoa(int(code))
+		}
+		select {
+		case events <- Event{Source: "evdev", Key: key}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package input
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// GPIO v1 uAPI from linux/gpio.h
+	gpioGetLineEventIoctl = 0xC030B404 // _IOWR(0xB4, 0x04, struct gpioevent_request)
+	gpioRequestInput      = 1 << 0
+	gpioRequestActiveLow  = 1 << 2
+	gpioRequestPullUp     = 1 << 5
+	gpioEventBothEdges    = 0x03
+	gpioEventRising       = 0x01
+
+	defaultDebounce = 50 * time.Millisecond
+)
+
+// gpioEventRequest is struct gpioevent_request.
+type gpioEventRequest struct {
+	LineOffset  uint32
+	HandleFlags uint32
+	EventFlags  uint32
+	Consumer    [32]byte
+	Fd          int32
+}
+
+// GPIO is a Source of button presses on lines of a GPIO character device.
+// Buttons are expected to short the line to ground, so lines are requested
+// active-low with the pull-up enabled. The key of each press is the line
+// offset, e.g. "gpio:17".
+type GPIO struct {
+	Chip     string // e.g. /dev/gpiochip0
+	Lines    []int
+	Debounce time.Duration
+}
+
+func (g GPIO) Run(ctx context.Context, events chan<- Event) error {
+	if g.Debounce == 0 {
+		g.Debounce = defaultDebounce
+	}
+	chip, err := os.Open(g.Chip)
+	if err != nil {
+		return fmt.Errorf("gpio: %v", err)
+	}
+	defer chip.Close()
+
+	errs := make(chan error, len(g.Lines))
+	for _, line := range g.Lines {
+		req := gpioEventRequest{
+			LineOffset:  uint32(line),
+			HandleFlags: gpioRequestInput | gpioRequestActiveLow | gpioRequestPullUp,
+			EventFlags:  gpioEventBothEdges,
+		}
+		copy(req.Consumer[:], "edged")
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, chip.Fd(), gpioGetLineEventIoctl, uintptr(unsafe.Pointer(&req)))
+		if errno == syscall.EINVAL {
+			// Kernels before 5.5 cannot set the bias, rely on an external pull-up.
+			req.HandleFlags &^= gpioRequestPullUp
+			_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, chip.Fd(), gpioGetLineEventIoctl, uintptr(unsafe.Pointer(&req)))
+		}
+		if errno != 0 {
+			return fmt.Errorf("gpio: requesting line %d of %s: %v", line, g.Chip, errno)
+		}
+		// Non-blocking so Close interrupts a pending Read.
+		if err := syscall.SetNonblock(int(req.Fd), true); err != nil {
+			return fmt.Errorf("gpio: line %d: %v", line, err)
+		}
+		f := os.NewFile(uintptr(req.Fd), fmt.Sprintf("%s:%d", g.Chip, line))
+		defer f.Close()
+		go func(line int, f *os.File) {
+			errs <- g.watch(ctx, line, f, events)
+		}(line, f)
+	}
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errs:
+		return err
+	}
+}
+
+// watch reports each press on line, ignoring contact bounce.
+func (g GPIO) watch(ctx context.Context, line int, f *os.File, events chan<- Event) error {
+	key := strconv.Itoa(line)
+	var last time.Time
+	buf := make([]byte, 16) // struct gpioevent_data
+	for {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			return fmt.Errorf("gpio: line %d: %v", line, err)
+		}
+		if binary.LittleEndian.Uint32(buf[8:12]) != gpioEventRising {
+			continue
+		}
+		now := time.Now()
+		if now.Sub(last) < g.Debounce {
+			continue
+		}
+		last = now
+		select {
+		case events <- Event{Source: "gpio", Key: key}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
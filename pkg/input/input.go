@@ -0,0 +1,164 @@
+// Package input turns key presses from terminals, GPIO buttons and evdev
+// devices such as HAT joysticks into device-independent events, mapped to
+// controller actions by a KeyMap.
+package input
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Action is something the user asks edged to do.
+type Action string
+
+const (
+	None      = Action("")
+	Quit      = Action("quit")
+	Logout    = Action("logout")
+	Cancel    = Action("cancel")
+	Configure = Action("configure")
+	Up        = Action("up")
+	Down      = Action("down")
+	Left      = Action("left")
+	Right     = Action("right")
+	Select    = Action("select")
+	// Resize is sent by the terminal when it changes size, with the new
+	// size in the event's Width and Height. It cannot be mapped.
+	Resize = Action("resize")
+	// Type and Erase are sent by the terminal for unmapped printable keys
+	// and backspace, for text entry. They cannot be mapped.
+	Type  = Action("type")
+	Erase = Action("erase")
+)
+
+var actions = []Action{Quit, Logout, Cancel, Configure, Up, Down, Left, Right, Select}
+
+// Event is a single key press from any source.
+type Event struct {
+	Source string // "tui", "gpio" or "evdev"
+	Key    string // key on the source, e.g. "<F2>", "17" or "KEY_ENTER"
+	Action Action
+	Width  int
+	Height int
+}
+
+func (e Event) String() string {
+	return e.Source + ":" + e.Key
+}
+
+// KeyMap maps "source:key" to an action.
+type KeyMap map[string]Action
+
+// DefaultKeyMap covers the terminal and the keys of common evdev joysticks
+// and keypads. GPIO buttons depend on the board so are not mapped by default.
+func DefaultKeyMap() KeyMap {
+	return KeyMap{
+		"tui:q":           Quit,
+		"tui:<C-c>":       Quit,
+		"tui:<L-l>":       Logout,
+		"tui:<Escape>":    Cancel,
+		"tui:<F2>":        Configure,
+		"tui:<Up>":        Up,
+		"tui:<Down>":      Down,
+		"tui:<Left>":      Left,
+		"tui:<Right>":     Right,
+		"tui:<Enter>":     Select,
+		"evdev:KEY_ESC":   Cancel,
+		"evdev:KEY_F2":    Configure,
+		"evdev:KEY_UP":    Up,
+		"evdev:KEY_DOWN":  Down,
+		"evdev:KEY_LEFT":  Left,
+		"evdev:KEY_RIGHT": Right,
+		"evdev:KEY_ENTER": Select,
+	}
+}
+
+// ParseKeyMap adds comma separated source:key=action mappings, e.g.
+// "gpio:17=logout,gpio:27=configure", to the default key map. Mapping a key to
+// "none" removes its default.
+func ParseKeyMap(s string) (KeyMap, error) {
+	km := DefaultKeyMap()
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 0 || !strings.Contains(entry[:i], ":") {
+			return nil, fmt.Errorf("invalid key mapping %q, want source:key=action", entry)
+		}
+		key, action := entry[:i], Action(entry[i+1:])
+		if action == "none" {
+			delete(km, key)
+			continue
+		}
+		if !validAction(action) {
+			return nil, fmt.Errorf("invalid key mapping %q, unknown action %q", entry, action)
+		}
+		km[key] = action
+	}
+	return km, nil
+}
+
+func validAction(a Action) bool {
+	for _, v := range actions {
+		if a == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Source produces key presses until ctx is cancelled.
+type Source interface {
+	Run(ctx context.Context, events chan<- Event) error
+}
+
+// Mux merges events from several sources and maps their keys to actions.
+// Keys without an action are dropped.
+type Mux struct {
+	KeyMap KeyMap
+	events chan Event
+}
+
+func NewMux(km KeyMap) *Mux {
+	if km == nil {
+		km = DefaultKeyMap()
+	}
+	return &Mux{KeyMap: km, events: make(chan Event, 8)}
+}
+
+// Events receives the mapped events of every source.
+func (m *Mux) Events() <-chan Event {
+	return m.events
+}
+
+// Run runs src until ctx is cancelled.
+func (m *Mux) Run(ctx context.Context, src Source) {
+	raw := make(chan Event)
+	go func() {
+		if err := src.Run(ctx, raw); err != nil && ctx.Err() == nil {
+			log.Printf("input: %v", err)
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-raw:
+			if a, ok := m.KeyMap[e.String()]; ok {
+				e.Action = a
+			}
+			if e.Action == None {
+				continue
+			}
+			select {
+			case m.events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// GPIO is a Source of button presses on lines of a GPIO character device.
+type GPIO struct {
+	Chip     string
+	Lines    []int
+	Debounce time.Duration
+}
+
+func (g GPIO) Run(ctx context.Context, events chan<- Event) error {
+	return fmt.Errorf("gpio: %s is only available on linux", g.Chip)
+}
+
+// Evdev is a Source of key presses from a Linux input device.
+type Evdev struct {
+	Path string
+}
+
+func (d Evdev) Run(ctx context.Context, events chan<- Event) error {
+	return fmt.Errorf("evdev: %s is only available on linux", d.Path)
+}
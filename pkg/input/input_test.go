@@ -0,0 +1,119 @@
+package input
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeyMap(t *testing.T) {
+	km, err := ParseKeyMap(" gpio:17=logout, evdev:KEY_LEFT=configure,tui:q=none,tui:==quit,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultKeyMap()
+	want["gpio:17"] = Logout
+	want["evdev:KEY_LEFT"] = Configure
+	delete(want, "tui:q")
+	want["tui:="] = Quit
+	if !reflect.DeepEqual(km, want) {
+		t.Errorf("ParseKeyMap = %v, want %v", km, want)
+	}
+
+	if km, err := ParseKeyMap(""); err != nil || !reflect.DeepEqual(km, DefaultKeyMap()) {
+		t.Errorf("ParseKeyMap(\"\") = %v, %v, want the defaults", km, err)
+	}
+}
+
+func TestParseKeyMapErrors(t *testing.T) {
+	for s, want := range map[string]string{
+		"gpio:17=reboot":           `invalid key mapping "gpio:17=reboot", unknown action "reboot"`,
+		"gpio:17=resize":           `invalid key mapping "gpio:17=resize", unknown action "resize"`,
+		"gpio:17=logout,gpio17=up": `invalid key mapping "gpio17=up", want source:key=action`,
+		"gpio:17":                  `invalid key mapping "gpio:17", want source:key=action`,
+	} {
+		if _, err := ParseKeyMap(s); err == nil || err.Error() != want {
+			t.Errorf("ParseKeyMap(%q) error = %v, want %s", s, err, want)
+		}
+	}
+}
+
+func TestDefaultKeyMap(t *testing.T) {
+	tui := map[Action]bool{}
+	for key, a := range DefaultKeyMap() {
+		if !validAction(a) {
+			t.Errorf("%s is mapped to %q, not an action", key, a)
+		}
+		if strings.HasPrefix(key, "gpio:") {
+			t.Errorf("%s is mapped by default, GPIO buttons depend on the board", key)
+		}
+		if strings.HasPrefix(key, "tui:") {
+			tui[a] = true
+		}
+	}
+	// Every action can be reached from the terminal
+	for _, a := range actions {
+		if !tui[a] {
+			t.Errorf("no terminal key for %s", a)
+		}
+	}
+}
+
+// fakeSource sends its events and waits to be cancelled.
+type fakeSource []Event
+
+func (s fakeSource) Run(ctx context.Context, events chan<- Event) error {
+	for _, e := range s {
+		select {
+		case events <- e:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func TestMux(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	km := DefaultKeyMap()
+	km["gpio:17"] = Logout
+	m := NewMux(km)
+	go m.Run(ctx, fakeSource{
+		{Source: "gpio", Key: "17"},
+		{Source: "gpio", Key: "22"}, // unmapped, dropped
+		{Source: "tui", Key: "<F2>"},
+		{Source: "tui", Key: "x", Action: Type},
+		{Source: "tui", Key: "<Resize>", Action: Resize, Width: 80, Height: 24},
+	})
+	go m.Run(ctx, fakeSource{{Source: "evdev", Key: "KEY_ENTER"}})
+
+	var got []Event
+	timeout := time.After(5 * time.Second)
+	for len(got) < 5 {
+		select {
+		case e := <-m.Events():
+			got = append(got, e)
+		case <-timeout:
+			t.Fatalf("received %v, want 5 events", got)
+		}
+	}
+	byKey := map[string]Event{}
+	for _, e := range got {
+		byKey[e.String()] = e
+	}
+	for key, want := range map[string]Action{"gpio:17": Logout, "tui:<F2>": Configure, "tui:x": Type, "tui:<Resize>": Resize, "evdev:KEY_ENTER": Select} {
+		if e, ok := byKey[key]; !ok || e.Action != want {
+			t.Errorf("%s = %+v, want %s", key, e, want)
+		}
+	}
+	if e := byKey["tui:<Resize>"]; e.Width != 80 || e.Height != 24 {
+		t.Errorf("resize to %dx%d, want 80x24", e.Width, e.Height)
+	}
+	if _, ok := byKey["gpio:22"]; ok {
+		t.Error("unmapped gpio:22 was not dropped")
+	}
+}
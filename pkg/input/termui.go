@@ -0,0 +1,42 @@
+package input
+
+import (
+	"context"
+	ui "github.com/gizak/termui/v3"
+	"unicode/utf8"
+)
+
+// Termui is a Source of the keyboard and resize events polled from displays.
+type Termui struct {
+	Events <-chan ui.Event
+}
+
+func (t Termui) Run(ctx context.Context, events chan<- Event) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-t.Events:
+			if !ok {
+				return nil
+			}
+			ev := Event{Source: "tui", Key: e.ID}
+			r, resize := e.Payload.(ui.Resize)
+			switch {
+			case resize:
+				ev.Action, ev.Width, ev.Height = Resize, r.Width, r.Height
+			case e.ID == "<Backspace>" || e.ID == "<C-<Backspace>>":
+				ev.Action = Erase
+			case e.ID == "<Space>":
+				ev.Action, ev.Key = Type, " "
+			case utf8.RuneCountInString(e.ID) == 1:
+				ev.Action = Type
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
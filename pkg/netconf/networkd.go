@@ -0,0 +1,118 @@
+// Package netconf gives a network interface a static address through
+// systemd-networkd, for sites without DHCP.
+package netconf
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"inet.af/netaddr"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Static is the static address of an interface.
+type Static struct {
+	Address netaddr.IPPrefix
+	Gateway netaddr.IP
+	DNS     []netaddr.IP
+}
+
+// Networkd manages a .network file for Interface in Dir. Its name sorts ahead
+// of the image's own files, so while it exists it takes precedence over them,
+// and removing it falls back to their (usually DHCP) configuration.
+type Networkd struct {
+	Dir       string
+	Interface string
+	// Networkctl is the networkctl command Reload runs, "networkctl" if
+	// empty.
+	Networkctl string
+}
+
+func (n *Networkd) path() string {
+	return filepath.Join(n.Dir, "05-edged-"+n.Interface+".network")
+}
+
+// Read returns the static address edged configured, or nil when the
+// interface is left to the image's configuration.
+func (n *Networkd) Read() (*Static, error) {
+	b, err := ioutil.ReadFile(n.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &Static{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(sc.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Address":
+			s.Address, err = netaddr.ParseIPPrefix(value)
+		case "Gateway":
+			s.Gateway, err = netaddr.ParseIP(value)
+		case "DNS":
+			var ip netaddr.IP
+			if ip, err = netaddr.ParseIP(value); err == nil {
+				s.DNS = append(s.DNS, ip)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", n.path(), err)
+		}
+	}
+	return s, sc.Err()
+}
+
+// Write configures the static address s, or removes edged's configuration
+// when s is nil. networkd only applies it after Reload.
+func (n *Networkd) Write(s *Static) error {
+	if s == nil {
+		err := os.Remove(n.path())
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Written by edged, remove to go back to the default configuration.\n")
+	fmt.Fprintf(&b, "[Match]\nName=%s\n\n[Network]\nAddress=%s\n", n.Interface, s.Address)
+	if !s.Gateway.IsZero() {
+		fmt.Fprintf(&b, "Gateway=%s\n", s.Gateway)
+	}
+	for _, ip := range s.DNS {
+		fmt.Fprintf(&b, "DNS=%s\n", ip)
+	}
+	if err := os.MkdirAll(n.Dir, 0755); err != nil {
+		return err
+	}
+	tmp := n.path() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, n.path())
+}
+
+// Reload makes networkd pick up the new configuration and apply it to the
+// interface.
+func (n *Networkd) Reload(ctx context.Context) error {
+	networkctl := n.Networkctl
+	if networkctl == "" {
+		networkctl = "networkctl"
+	}
+	for _, args := range [][]string{{"reload"}, {"reconfigure", n.Interface}} {
+		if out, err := exec.CommandContext(ctx, networkctl, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("networkctl %s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package netconf
+
+import (
+	"context"
+	"inet.af/netaddr"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNetworkdWrite(t *testing.T) {
+	n := &Networkd{Dir: filepath.Join(t.TempDir(), "network"), Interface: "eth0"}
+	if s, err := n.Read(); s != nil || err != nil {
+		t.Fatalf("Read without a file = %v, %v, want nil", s, err)
+	}
+	s := &Static{
+		Address: netaddr.MustParseIPPrefix("192.168.1.10/24"),
+		Gateway: netaddr.MustParseIP("192.168.1.1"),
+		DNS:     []netaddr.IP{netaddr.MustParseIP("1.1.1.1"), netaddr.MustParseIP("9.9.9.9")},
+	}
+	if err := n.Write(s); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(n.Dir, "05-edged-eth0.network"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Written by edged, remove to go back to the default configuration.\n" +
+		"[Match]\nName=eth0\n\n[Network]\nAddress=192.168.1.10/24\nGateway=192.168.1.1\nDNS=1.1.1.1\nDNS=9.9.9.9\n"
+	if string(b) != want {
+		t.Errorf(".network file:\n%s\nwant:\n%s", b, want)
+	}
+	got, err := n.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Errorf("Read = %+v, want %+v", got, s)
+	}
+
+	// Editing the address keeps the DNS servers
+	got.Address, got.Gateway = netaddr.MustParseIPPrefix("10.0.0.5/8"), netaddr.IP{}
+	if err := n.Write(got); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadFile(filepath.Join(n.Dir, "05-edged-eth0.network"))
+	if s := string(b); !strings.Contains(s, "Address=10.0.0.5/8\nDNS=1.1.1.1\nDNS=9.9.9.9\n") || strings.Contains(s, "Gateway=") {
+		t.Errorf(".network file after the edit:\n%s", b)
+	}
+
+	if err := n.Write(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(n.Dir, "05-edged-eth0.network")); !os.IsNotExist(err) {
+		t.Errorf("Write(nil) left the file: %v", err)
+	}
+	if err := n.Write(nil); err != nil {
+		t.Errorf("Write(nil) without a file: %v", err)
+	}
+}
+
+func TestNetworkdReadError(t *testing.T) {
+	n := &Networkd{Dir: t.TempDir(), Interface: "eth0"}
+	err := ioutil.WriteFile(filepath.Join(n.Dir, "05-edged-eth0.network"), []byte("[Network]\nAddress=192.168.1.300/24\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := n.Read(); err == nil || !strings.Contains(err.Error(), "05-edged-eth0.network") {
+		t.Errorf("Read of a bad address = %v, %v, want an error naming the file", s, err)
+	}
+}
+
+func TestNetworkdReload(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	script := filepath.Join(dir, "networkctl")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >>"+log+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	n := &Networkd{Dir: dir, Interface: "eth0", Networkctl: script}
+	if err := n.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(log); string(b) != "reload\nreconfigure eth0\n" {
+		t.Errorf("networkctl ran with:\n%s", b)
+	}
+
+	n.Networkctl = "false"
+	if err := n.Reload(context.Background()); err == nil || !strings.HasPrefix(err.Error(), "networkctl reload: ") {
+		t.Errorf("Reload with a failing networkctl = %v", err)
+	}
+}
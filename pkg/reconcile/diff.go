@@ -0,0 +1,139 @@
+package reconcile
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"tailscale.com/ipn"
+)
+
+// DefaultDenyFields are never managed by edged unless explicitly allowed.
+// LoggedOut is owned by the login flow, reconciling it would undo a logout.
+var DefaultDenyFields = []string{"LoggedOut"}
+
+// FieldFilter restricts which ipn.Prefs fields edged manages. An empty Allow
+// permits every editable field, Deny always takes precedence.
+type FieldFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+// Permits reports whether edged may manage the named field.
+func (f FieldFilter) Permits(field string) bool {
+	for _, d := range f.Deny {
+		if d == field {
+			return false
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	for _, a := range f.Allow {
+		if a == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate rejects field names that are not editable prefs, which would
+// otherwise be silently ignored.
+func (f FieldFilter) Validate() error {
+	editable := map[string]bool{}
+	for _, name := range EditableFields() {
+		editable[name] = true
+	}
+	for _, name := range append(append([]string{}, f.Allow...), f.Deny...) {
+		if !editable[name] {
+			return fmt.Errorf("unknown tailscale prefs field %q", name)
+		}
+	}
+	return nil
+}
+
+// FieldDiff is a single preference that differs between tailscaled and the
+// desired prefs.
+type FieldDiff struct {
+	Field   string
+	Current interface{}
+	Desired interface{}
+}
+
+func (d FieldDiff) String() string {
+	return fmt.Sprintf("%s: %v -> %v", d.Field, d.Current, d.Desired)
+}
+
+// EditableFields returns the names of the ipn.Prefs fields that can be changed
+// through ipn.MaskedPrefs, i.e. those with a matching XxxSet field.
+func EditableFields() []string {
+	var fields []string
+	mt := reflect.TypeOf(ipn.MaskedPrefs{})
+	for i := 0; i < mt.NumField(); i++ {
+		if name := mt.Field(i).Name; strings.HasSuffix(name, "Set") {
+			fields = append(fields, strings.TrimSuffix(name, "Set"))
+		}
+	}
+	return fields
+}
+
+// CalculateMaskedPrefs walks every XxxSet field of ipn.MaskedPrefs, comparing
+// the matching field of c and t. It returns the edit converging c on t for the
+// fields permitted by filter, along with what changed. Slices are compared
+// without regard to order, tailscaled does not preserve it.
+func CalculateMaskedPrefs(c, t *ipn.Prefs, filter FieldFilter) (*ipn.MaskedPrefs, []FieldDiff, error) {
+	mask := &ipn.MaskedPrefs{
+		Prefs: *c,
+	}
+	mv := reflect.ValueOf(mask).Elem()
+	pv := reflect.ValueOf(&mask.Prefs).Elem()
+	cv := reflect.ValueOf(c).Elem()
+	tv := reflect.ValueOf(t).Elem()
+	var diffs []FieldDiff
+	for _, name := range EditableFields() {
+		cf := cv.FieldByName(name)
+		if !cf.IsValid() {
+			return nil, nil, fmt.Errorf("ipn.MaskedPrefs has %sSet but ipn.Prefs has no field %s", name, name)
+		}
+		if !filter.Permits(name) {
+			continue
+		}
+		tf := tv.FieldByName(name)
+		if equalPref(cf, tf) {
+			continue
+		}
+		mv.FieldByName(name + "Set").SetBool(true)
+		pv.FieldByName(name).Set(tf)
+		diffs = append(diffs, FieldDiff{
+			Field:   name,
+			Current: cf.Interface(),
+			Desired: tf.Interface(),
+		})
+	}
+	return mask, diffs, nil
+}
+
+func equalPref(a, b reflect.Value) bool {
+	if a.Kind() != reflect.Slice {
+		return reflect.DeepEqual(a.Interface(), b.Interface())
+	}
+	if a.Len() != b.Len() {
+		return false
+	}
+	as, bs := sortedElems(a), sortedElems(b)
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedElems(v reflect.Value) []string {
+	s := make([]string, v.Len())
+	for i := range s {
+		s[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	sort.Strings(s)
+	return s
+}
@@ -0,0 +1,163 @@
+package reconcile
+
+import (
+	"inet.af/netaddr"
+	"reflect"
+	"strings"
+	"tailscale.com/ipn"
+	"tailscale.com/types/preftype"
+	"testing"
+)
+
+// maskedFields returns the fields whose XxxSet is true in mp.
+func maskedFields(mp *ipn.MaskedPrefs) []string {
+	var fields []string
+	v := reflect.ValueOf(mp).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if strings.HasSuffix(name, "Set") && v.Field(i).Bool() {
+			fields = append(fields, strings.TrimSuffix(name, "Set"))
+		}
+	}
+	return fields
+}
+
+func TestEditableFields(t *testing.T) {
+	fields := map[string]bool{}
+	pt := reflect.TypeOf(ipn.Prefs{})
+	for _, name := range EditableFields() {
+		fields[name] = true
+		if _, ok := pt.FieldByName(name); !ok {
+			t.Errorf("editable field %s is not an ipn.Prefs field", name)
+		}
+	}
+	for _, name := range []string{"ControlURL", "RouteAll", "ExitNodeID", "ExitNodeIP", "Hostname", "AdvertiseRoutes", "AdvertiseTags", "NetfilterMode", "RunSSH", "ShieldsUp", "LoggedOut"} {
+		if !fields[name] {
+			t.Errorf("EditableFields() is missing %s", name)
+		}
+	}
+	if fields["Persist"] {
+		t.Error("EditableFields() includes Persist, which has no PersistSet")
+	}
+}
+
+func TestCalculateMaskedPrefs(t *testing.T) {
+	routes := func(s ...string) []netaddr.IPPrefix {
+		var r []netaddr.IPPrefix
+		for _, p := range s {
+			r = append(r, netaddr.MustParseIPPrefix(p))
+		}
+		return r
+	}
+	for _, tt := range []struct {
+		name    string
+		current func(*ipn.Prefs)
+		desired func(*ipn.Prefs)
+		filter  FieldFilter
+		want    []string // fields changed, in EditableFields order
+	}{
+		{
+			name:    "identical",
+			desired: func(p *ipn.Prefs) {},
+		},
+		{
+			name:    "slices in another order",
+			current: func(p *ipn.Prefs) { p.AdvertiseTags = []string{"tag:a", "tag:b"} },
+			desired: func(p *ipn.Prefs) { p.AdvertiseTags = []string{"tag:b", "tag:a"} },
+		},
+		{
+			name:    "nil and empty slices",
+			current: func(p *ipn.Prefs) { p.AdvertiseRoutes = nil },
+			desired: func(p *ipn.Prefs) { p.AdvertiseRoutes = []netaddr.IPPrefix{} },
+		},
+		{
+			name:    "one field",
+			desired: func(p *ipn.Prefs) { p.RunSSH = true },
+			want:    []string{"RunSSH"},
+		},
+		{
+			name: "several fields",
+			desired: func(p *ipn.Prefs) {
+				p.Hostname = "edge-1"
+				p.AdvertiseRoutes = routes("10.0.0.0/16")
+				p.NetfilterMode = preftype.NetfilterNoDivert
+			},
+			want: []string{"Hostname", "AdvertiseRoutes", "NetfilterMode"},
+		},
+		{
+			name:    "routes changed",
+			current: func(p *ipn.Prefs) { p.AdvertiseRoutes = routes("10.0.0.0/16", "192.168.1.0/24") },
+			desired: func(p *ipn.Prefs) { p.AdvertiseRoutes = routes("192.168.1.0/24") },
+			want:    []string{"AdvertiseRoutes"},
+		},
+		{
+			name:    "denied",
+			desired: func(p *ipn.Prefs) { p.LoggedOut = true; p.RunSSH = true },
+			filter:  FieldFilter{Deny: DefaultDenyFields},
+			want:    []string{"RunSSH"},
+		},
+		{
+			name:    "allowed",
+			desired: func(p *ipn.Prefs) { p.Hostname = "edge-1"; p.RunSSH = true },
+			filter:  FieldFilter{Allow: []string{"Hostname"}},
+			want:    []string{"Hostname"},
+		},
+		{
+			name:    "deny wins over allow",
+			desired: func(p *ipn.Prefs) { p.Hostname = "edge-1"; p.RunSSH = true },
+			filter:  FieldFilter{Allow: []string{"Hostname", "RunSSH"}, Deny: []string{"RunSSH"}},
+			want:    []string{"Hostname"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := ipn.NewPrefs()
+			if tt.current != nil {
+				tt.current(c)
+			}
+			d := c.Clone()
+			tt.desired(d)
+			mp, diffs, err := CalculateMaskedPrefs(c, d, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var changed []string
+			for _, diff := range diffs {
+				changed = append(changed, diff.Field)
+			}
+			if !reflect.DeepEqual(changed, tt.want) {
+				t.Errorf("diff fields = %v, want %v", changed, tt.want)
+			}
+			if got := maskedFields(mp); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("XxxSet fields = %v, want %v", got, tt.want)
+			}
+			for _, diff := range diffs {
+				got := reflect.ValueOf(mp.Prefs).FieldByName(diff.Field).Interface()
+				if !reflect.DeepEqual(got, diff.Desired) {
+					t.Errorf("masked %s = %v, want %v", diff.Field, got, diff.Desired)
+				}
+			}
+
+			// Applying the edit converges the permitted fields
+			c.ApplyEdits(mp)
+			if _, diffs, _ := CalculateMaskedPrefs(c, d, tt.filter); len(diffs) != 0 {
+				t.Errorf("diff after applying the edit = %v, want none", diffs)
+			}
+		})
+	}
+}
+
+func TestFieldFilterValidate(t *testing.T) {
+	for _, tt := range []struct {
+		filter  FieldFilter
+		wantErr bool
+	}{
+		{FieldFilter{}, false},
+		{FieldFilter{Allow: []string{"Hostname", "RunSSH"}, Deny: DefaultDenyFields}, false},
+		{FieldFilter{Allow: []string{"Hostnme"}}, true},
+		{FieldFilter{Deny: []string{"Persist"}}, true},
+	} {
+		if err := tt.filter.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v.Validate() = %v, want error %v", tt.filter, err, tt.wantErr)
+		}
+	}
+}
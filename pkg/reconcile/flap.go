@@ -0,0 +1,78 @@
+package reconcile
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// flapLimit is how many reconciles in a row may find a pref changed back
+	// after applying it before it is quarantined.
+	flapLimit = 3
+	// retryMin and retryMax bound the backoff between retries of a failed
+	// reconcile. retryMin is also how long after an apply it is checked.
+	retryMin = 2 * time.Second
+	retryMax = 5 * time.Minute
+)
+
+// flapDetector notices prefs that tailscaled rewrites after every apply,
+// which would otherwise have the reconciler apply them forever. Such prefs
+// are quarantined: still owned, but no longer enforced until the declared
+// prefs change.
+type flapDetector struct {
+	attempted   map[string]bool // prefs tailscaled accepted on the previous reconcile
+	flaps       map[string]int  // reconciles in a row finding the pref changed back
+	quarantined map[string]bool
+}
+
+// observe records the prefs a reconcile found differing and those of them
+// tailscaled accepted, returning the prefs it quarantined.
+func (f *flapDetector) observe(diff, sent []FieldDiff) []string {
+	flaps := map[string]int{}
+	attempted := map[string]bool{}
+	for _, d := range sent {
+		attempted[d.Field] = true
+	}
+	var newly []string
+	for _, d := range diff {
+		if !f.attempted[d.Field] {
+			continue
+		}
+		flaps[d.Field] = f.flaps[d.Field] + 1
+		if flaps[d.Field] >= flapLimit && !f.quarantined[d.Field] {
+			if f.quarantined == nil {
+				f.quarantined = map[string]bool{}
+			}
+			f.quarantined[d.Field] = true
+			newly = append(newly, d.Field)
+		}
+	}
+	f.flaps, f.attempted = flaps, attempted
+	return newly
+}
+
+// Quarantined returns the quarantined prefs, sorted.
+func (f *flapDetector) Quarantined() []string {
+	var fields []string
+	for name := range f.quarantined {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func (f *flapDetector) reset() {
+	*f = flapDetector{}
+}
+
+// nextBackoff doubles the backoff between retries, from retryMin up to
+// retryMax.
+func nextBackoff(d time.Duration) time.Duration {
+	if d < retryMin {
+		return retryMin
+	}
+	if d *= 2; d > retryMax {
+		return retryMax
+	}
+	return d
+}
@@ -0,0 +1,113 @@
+package reconcile
+
+import (
+	"context"
+	tsutils "github.com/jtcressy-home/edged/pkg/tailscale_utils"
+	"github.com/jtcressy-home/edged/pkg/tstest"
+	"go.uber.org/zap"
+	"reflect"
+	"tailscale.com/ipn"
+	"testing"
+	"time"
+)
+
+func TestNextBackoff(t *testing.T) {
+	var got []time.Duration
+	d := time.Duration(0)
+	for i := 0; i < 10; i++ {
+		d = nextBackoff(d)
+		got = append(got, d)
+	}
+	want := []time.Duration{
+		2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second,
+		64 * time.Second, 128 * time.Second, 256 * time.Second, retryMax, retryMax,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("backoff %v, want %v", got, want)
+	}
+}
+
+func diffs(fields ...string) []FieldDiff {
+	var d []FieldDiff
+	for _, f := range fields {
+		d = append(d, FieldDiff{Field: f})
+	}
+	return d
+}
+
+func TestFlapDetector(t *testing.T) {
+	var f flapDetector
+	// Hostname is changed back after every apply, RouteAll once, and
+	// tailscaled refuses ShieldsUp so it is never applied
+	rounds := []struct {
+		diff, sent []string
+		want       []string
+	}{
+		{[]string{"Hostname", "RouteAll", "ShieldsUp"}, []string{"Hostname", "RouteAll"}, nil},
+		{[]string{"Hostname", "RouteAll", "ShieldsUp"}, []string{"Hostname", "RouteAll"}, nil},
+		{[]string{"Hostname", "ShieldsUp"}, []string{"Hostname"}, nil},
+		{[]string{"Hostname", "ShieldsUp"}, []string{"Hostname"}, []string{"Hostname"}},
+		{[]string{"Hostname", "ShieldsUp"}, nil, nil},
+	}
+	for i, r := range rounds {
+		if got := f.observe(diffs(r.diff...), diffs(r.sent...)); !reflect.DeepEqual(got, r.want) {
+			t.Errorf("round %d quarantined %v, want %v", i+1, got, r.want)
+		}
+	}
+	if got := f.Quarantined(); !reflect.DeepEqual(got, []string{"Hostname"}) {
+		t.Errorf("quarantined %v, want Hostname", got)
+	}
+
+	// A change to the declared prefs releases it
+	f.reset()
+	if got := f.Quarantined(); len(got) != 0 {
+		t.Errorf("quarantined %v after reset, want none", got)
+	}
+	if got := f.observe(diffs("Hostname"), diffs("Hostname")); len(got) != 0 {
+		t.Errorf("quarantined %v straight after reset", got)
+	}
+}
+
+func TestReconcilerQuarantine(t *testing.T) {
+	f, err := tstest.NewLocalAPI(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// tailscaled insists on its own hostname
+	f.RewritePrefs(func(p *ipn.Prefs) { p.Hostname = "tailscaled" })
+	r := NewReconciler(tsutils.NewClient(f.Socket), "", "", t.TempDir(), FieldFilter{}, zap.NewNop())
+	r.Prefs = map[string]interface{}{"Hostname": "edge", "RouteAll": true}
+	ctx := context.Background()
+
+	var delays []time.Duration
+	for i := 0; i <= flapLimit; i++ {
+		delays = append(delays, r.Reconcile(ctx))
+	}
+	// Backing off until the pref is quarantined, then retrying soon without it
+	if want := []time.Duration{retryMin, 2 * retryMin, 4 * retryMin, retryMin}; !reflect.DeepEqual(delays, want) {
+		t.Errorf("retries %v, want %v", delays, want)
+	}
+	if s := r.Status(); !reflect.DeepEqual(s.Quarantined, []string{"Hostname"}) {
+		t.Fatalf("status %+v, want Hostname quarantined", s)
+	}
+	if !f.Prefs().RouteAll {
+		t.Error("RouteAll not applied alongside the flapping Hostname")
+	}
+
+	// Quarantined, the hostname is left alone and the retry converges
+	edits := len(f.Edits())
+	if delay := r.Reconcile(ctx); delay != 0 || len(f.Edits()) != edits {
+		t.Errorf("reconcile with a quarantined pref retried in %v with %d edits, want neither", delay, len(f.Edits())-edits)
+	}
+	if s := r.Status(); s.Error != "" || !reflect.DeepEqual(s.Quarantined, []string{"Hostname"}) {
+		t.Errorf("status %+v, want Hostname still quarantined and no error", s)
+	}
+
+	// Until the prefs change
+	r.flaps.reset()
+	r.Reconcile(ctx)
+	if got := f.Edits(); len(got) != edits+1 || !got[edits].HostnameSet {
+		t.Errorf("hostname not applied again after release, edits %+v", got[edits:])
+	}
+}
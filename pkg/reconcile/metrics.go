@@ -0,0 +1,104 @@
+package reconcile
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the reconcile
+// duration histogram.
+var durationBuckets = [...]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics count reconciles since the daemon started.
+type metrics struct {
+	successes   uint64
+	failures    uint64
+	changes     uint64
+	buckets     [len(durationBuckets)]uint64 // not cumulative
+	durationSum float64
+}
+
+func (m *metrics) observe(d time.Duration, changes int, err error) {
+	if err != nil {
+		m.failures++
+	} else {
+		m.successes++
+	}
+	m.changes += uint64(changes)
+	secs := d.Seconds()
+	m.durationSum += secs
+	for i, le := range durationBuckets {
+		if secs <= le {
+			m.buckets[i]++
+			break
+		}
+	}
+}
+
+// WriteMetrics writes the reconciler's metrics in the Prometheus text
+// exposition format.
+func (r *Reconciler) WriteMetrics(w io.Writer) {
+	r.mu.Lock()
+	m := r.metrics
+	st := *r.loadStatus()
+	r.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP edged_reconcile_total Prefs reconciles by result.")
+	fmt.Fprintln(w, "# TYPE edged_reconcile_total counter")
+	fmt.Fprintf(w, "edged_reconcile_total{result=\"success\"} %d\n", m.successes)
+	fmt.Fprintf(w, "edged_reconcile_total{result=\"error\"} %d\n", m.failures)
+	fmt.Fprintln(w, "# HELP edged_reconcile_changes_total Prefs changed on tailscaled by reconciles.")
+	fmt.Fprintln(w, "# TYPE edged_reconcile_changes_total counter")
+	fmt.Fprintf(w, "edged_reconcile_changes_total %d\n", m.changes)
+
+	fmt.Fprintln(w, "# HELP edged_reconcile_duration_seconds Time taken by prefs reconciles.")
+	fmt.Fprintln(w, "# TYPE edged_reconcile_duration_seconds histogram")
+	var count uint64
+	for i, le := range durationBuckets {
+		count += m.buckets[i]
+		fmt.Fprintf(w, "edged_reconcile_duration_seconds_bucket{le=\"%s\"} %d\n", formatFloat(le), count)
+	}
+	total := m.successes + m.failures
+	fmt.Fprintf(w, "edged_reconcile_duration_seconds_bucket{le=\"+Inf\"} %d\n", total)
+	fmt.Fprintf(w, "edged_reconcile_duration_seconds_sum %s\n", formatFloat(m.durationSum))
+	fmt.Fprintf(w, "edged_reconcile_duration_seconds_count %d\n", total)
+
+	fmt.Fprintln(w, "# HELP edged_reconcile_drift Managed prefs differing from the declared ones after the last reconcile.")
+	fmt.Fprintln(w, "# TYPE edged_reconcile_drift gauge")
+	fmt.Fprintf(w, "edged_reconcile_drift %d\n", len(st.Drift))
+	fmt.Fprintln(w, "# HELP edged_reconcile_quarantined_fields Managed prefs flapping after every apply, no longer enforced.")
+	fmt.Fprintln(w, "# TYPE edged_reconcile_quarantined_fields gauge")
+	fmt.Fprintf(w, "edged_reconcile_quarantined_fields %d\n", len(st.Quarantined))
+	fmt.Fprintln(w, "# HELP edged_reconcile_managed_fields Prefs managed by edged.")
+	fmt.Fprintln(w, "# TYPE edged_reconcile_managed_fields gauge")
+	fmt.Fprintf(w, "edged_reconcile_managed_fields %d\n", len(st.Fields))
+	fmt.Fprintln(w, "# HELP edged_reconcile_last_attempt_timestamp_seconds When prefs were last reconciled.")
+	fmt.Fprintln(w, "# TYPE edged_reconcile_last_attempt_timestamp_seconds gauge")
+	fmt.Fprintf(w, "edged_reconcile_last_attempt_timestamp_seconds %s\n", timestamp(st.LastAttempt))
+	fmt.Fprintln(w, "# HELP edged_reconcile_last_success_timestamp_seconds When prefs were last reconciled without error.")
+	fmt.Fprintln(w, "# TYPE edged_reconcile_last_success_timestamp_seconds gauge")
+	fmt.Fprintf(w, "edged_reconcile_last_success_timestamp_seconds %s\n", timestamp(st.LastSuccess))
+}
+
+// MetricsHandler serves WriteMetrics, for /metrics.
+func (r *Reconciler) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteMetrics(w)
+	})
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// timestamp is t in Unix seconds, 0 if unset.
+func timestamp(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return formatFloat(float64(t.UnixNano()) / 1e9)
+}
@@ -0,0 +1,146 @@
+package reconcile
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	attempt := time.Unix(1792238400, 500000000)
+	type result struct {
+		d       time.Duration
+		changes int
+		err     error
+	}
+	for _, tt := range []struct {
+		name    string
+		results []result
+		status  Status
+		want    string
+	}{
+		{
+			name: "none",
+			want: `# HELP edged_reconcile_total Prefs reconciles by result.
+# TYPE edged_reconcile_total counter
+edged_reconcile_total{result="success"} 0
+edged_reconcile_total{result="error"} 0
+# HELP edged_reconcile_changes_total Prefs changed on tailscaled by reconciles.
+# TYPE edged_reconcile_changes_total counter
+edged_reconcile_changes_total 0
+# HELP edged_reconcile_duration_seconds Time taken by prefs reconciles.
+# TYPE edged_reconcile_duration_seconds histogram
+edged_reconcile_duration_seconds_bucket{le="0.05"} 0
+edged_reconcile_duration_seconds_bucket{le="0.1"} 0
+edged_reconcile_duration_seconds_bucket{le="0.25"} 0
+edged_reconcile_duration_seconds_bucket{le="0.5"} 0
+edged_reconcile_duration_seconds_bucket{le="1"} 0
+edged_reconcile_duration_seconds_bucket{le="2.5"} 0
+edged_reconcile_duration_seconds_bucket{le="5"} 0
+edged_reconcile_duration_seconds_bucket{le="10"} 0
+edged_reconcile_duration_seconds_bucket{le="+Inf"} 0
+edged_reconcile_duration_seconds_sum 0
+edged_reconcile_duration_seconds_count 0
+# HELP edged_reconcile_drift Managed prefs differing from the declared ones after the last reconcile.
+# TYPE edged_reconcile_drift gauge
+edged_reconcile_drift 0
+# HELP edged_reconcile_quarantined_fields Managed prefs flapping after every apply, no longer enforced.
+# TYPE edged_reconcile_quarantined_fields gauge
+edged_reconcile_quarantined_fields 0
+# HELP edged_reconcile_managed_fields Prefs managed by edged.
+# TYPE edged_reconcile_managed_fields gauge
+edged_reconcile_managed_fields 0
+# HELP edged_reconcile_last_attempt_timestamp_seconds When prefs were last reconciled.
+# TYPE edged_reconcile_last_attempt_timestamp_seconds gauge
+edged_reconcile_last_attempt_timestamp_seconds 0
+# HELP edged_reconcile_last_success_timestamp_seconds When prefs were last reconciled without error.
+# TYPE edged_reconcile_last_success_timestamp_seconds gauge
+edged_reconcile_last_success_timestamp_seconds 0
+`,
+		},
+		{
+			// Buckets are cumulative, the 20s reconcile only counts in +Inf
+			name: "drifting and flapping",
+			results: []result{
+				{250 * time.Millisecond, 2, nil},
+				{500 * time.Millisecond, 0, nil},
+				{3 * time.Second, 0, errors.New("timeout")},
+				{20 * time.Second, 1, nil},
+			},
+			status: Status{
+				LastAttempt: attempt,
+				LastSuccess: attempt.Add(-time.Minute),
+				Fields:      []string{"Hostname", "RunSSH", "ShieldsUp"},
+				Drift:       diffs("RunSSH", "ShieldsUp"),
+				Quarantined: []string{"Hostname"},
+			},
+			want: `# HELP edged_reconcile_total Prefs reconciles by result.
+# TYPE edged_reconcile_total counter
+edged_reconcile_total{result="success"} 3
+edged_reconcile_total{result="error"} 1
+# HELP edged_reconcile_changes_total Prefs changed on tailscaled by reconciles.
+# TYPE edged_reconcile_changes_total counter
+edged_reconcile_changes_total 3
+# HELP edged_reconcile_duration_seconds Time taken by prefs reconciles.
+# TYPE edged_reconcile_duration_seconds histogram
+edged_reconcile_duration_seconds_bucket{le="0.05"} 0
+edged_reconcile_duration_seconds_bucket{le="0.1"} 0
+edged_reconcile_duration_seconds_bucket{le="0.25"} 1
+edged_reconcile_duration_seconds_bucket{le="0.5"} 2
+edged_reconcile_duration_seconds_bucket{le="1"} 2
+edged_reconcile_duration_seconds_bucket{le="2.5"} 2
+edged_reconcile_duration_seconds_bucket{le="5"} 3
+edged_reconcile_duration_seconds_bucket{le="10"} 3
+edged_reconcile_duration_seconds_bucket{le="+Inf"} 4
+edged_reconcile_duration_seconds_sum 23.75
+edged_reconcile_duration_seconds_count 4
+# HELP edged_reconcile_drift Managed prefs differing from the declared ones after the last reconcile.
+# TYPE edged_reconcile_drift gauge
+edged_reconcile_drift 2
+# HELP edged_reconcile_quarantined_fields Managed prefs flapping after every apply, no longer enforced.
+# TYPE edged_reconcile_quarantined_fields gauge
+edged_reconcile_quarantined_fields 1
+# HELP edged_reconcile_managed_fields Prefs managed by edged.
+# TYPE edged_reconcile_managed_fields gauge
+edged_reconcile_managed_fields 3
+# HELP edged_reconcile_last_attempt_timestamp_seconds When prefs were last reconciled.
+# TYPE edged_reconcile_last_attempt_timestamp_seconds gauge
+edged_reconcile_last_attempt_timestamp_seconds 1792238400.5
+# HELP edged_reconcile_last_success_timestamp_seconds When prefs were last reconciled without error.
+# TYPE edged_reconcile_last_success_timestamp_seconds gauge
+edged_reconcile_last_success_timestamp_seconds 1792238340.5
+`,
+		},
+	} {
+		r := &Reconciler{status: &tt.status}
+		for _, res := range tt.results {
+			r.metrics.observe(res.d, res.changes, res.err)
+		}
+		var b bytes.Buffer
+		r.WriteMetrics(&b)
+		if got := b.String(); got != tt.want {
+			t.Errorf("%s: metrics differ\n%s", tt.name, lineDiff(got, tt.want))
+		}
+	}
+}
+
+// lineDiff lists the lines of got and want that differ.
+func lineDiff(got, want string) string {
+	g, w := strings.Split(got, "\n"), strings.Split(want, "\n")
+	var out []string
+	for i := 0; i < len(g) || i < len(w); i++ {
+		var gl, wl string
+		if i < len(g) {
+			gl = g[i]
+		}
+		if i < len(w) {
+			wl = w[i]
+		}
+		if gl != wl {
+			out = append(out, "got  "+gl, "want "+wl)
+		}
+	}
+	return strings.Join(out, "\n")
+}
@@ -0,0 +1,160 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"tailscale.com/ipn"
+)
+
+const ownershipStateFile = "prefs-ownership.json"
+
+// ownedField records a pref edged has taken ownership of, much like
+// server-side apply field managers.
+type ownedField struct {
+	// Original is the value before edged first enforced the field, restored
+	// when the field is released.
+	Original json.RawMessage
+	// Applied is the value edged last enforced. A field is only reverted on
+	// release if tailscaled still holds it, otherwise someone else has
+	// changed it since and it is left alone.
+	Applied json.RawMessage
+}
+
+// Ownership tracks which prefs are managed by edged across restarts, so a key
+// removed from the prefs file is released rather than enforced forever.
+type Ownership struct {
+	Path   string
+	Fields map[string]*ownedField
+}
+
+// LoadOwnership reads the ownership record at path. A missing file is an
+// empty record.
+func LoadOwnership(path string) (*Ownership, error) {
+	o := &Ownership{Path: path, Fields: map[string]*ownedField{}}
+	b, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &o.Fields); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return o, nil
+}
+
+// Claim takes ownership of fields not already owned, remembering their
+// current value.
+func (o *Ownership) Claim(fields []string, current *ipn.Prefs) error {
+	for _, name := range fields {
+		if _, ok := o.Fields[name]; ok {
+			continue
+		}
+		v, err := prefValue(current, name)
+		if err != nil {
+			return err
+		}
+		o.Fields[name] = &ownedField{Original: v}
+	}
+	return nil
+}
+
+// Released returns the owned fields that are no longer in fields, sorted.
+func (o *Ownership) Released(fields []string) []string {
+	keep := map[string]bool{}
+	for _, name := range fields {
+		keep[name] = true
+	}
+	var released []string
+	for name := range o.Fields {
+		if !keep[name] {
+			released = append(released, name)
+		}
+	}
+	sort.Strings(released)
+	return released
+}
+
+// Revert sets each released field in target back to its original value and
+// returns the fields that should be reverted. Fields changed by someone else
+// since edged last applied them are not reverted.
+func (o *Ownership) Revert(released []string, current, target *ipn.Prefs) ([]string, error) {
+	var revert []string
+	for _, name := range released {
+		f := o.Fields[name]
+		if f.Applied == nil {
+			continue
+		}
+		cur := reflect.ValueOf(current).Elem().FieldByName(name)
+		if !cur.IsValid() {
+			return nil, fmt.Errorf("ipn.Prefs has no field %s", name)
+		}
+		applied := reflect.New(cur.Type())
+		if err := json.Unmarshal(f.Applied, applied.Interface()); err != nil {
+			return nil, fmt.Errorf("reading %s: %v", name, err)
+		}
+		if !equalPref(cur, applied.Elem()) {
+			continue
+		}
+		field := reflect.ValueOf(target).Elem().FieldByName(name)
+		if err := json.Unmarshal(f.Original, field.Addr().Interface()); err != nil {
+			return nil, fmt.Errorf("restoring %s: %v", name, err)
+		}
+		revert = append(revert, name)
+	}
+	return revert, nil
+}
+
+// Forget drops ownership of fields.
+func (o *Ownership) Forget(fields []string) {
+	for _, name := range fields {
+		delete(o.Fields, name)
+	}
+}
+
+// Applied records the values edged enforced for fields.
+func (o *Ownership) Applied(fields []string, target *ipn.Prefs) error {
+	for _, name := range fields {
+		f, ok := o.Fields[name]
+		if !ok {
+			continue
+		}
+		v, err := prefValue(target, name)
+		if err != nil {
+			return err
+		}
+		f.Applied = v
+	}
+	return nil
+}
+
+// Save replaces the ownership record atomically.
+func (o *Ownership) Save() error {
+	b, err := json.MarshalIndent(o.Fields, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(o.Path), 0700); err != nil {
+		return err
+	}
+	tmp := o.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.Path)
+}
+
+func prefValue(p *ipn.Prefs, name string) (json.RawMessage, error) {
+	field := reflect.ValueOf(p).Elem().FieldByName(name)
+	if !field.IsValid() {
+		return nil, fmt.Errorf("ipn.Prefs has no field %s", name)
+	}
+	return json.Marshal(field.Interface())
+}
@@ -0,0 +1,122 @@
+package reconcile
+
+import (
+	"context"
+	tsutils "github.com/jtcressy-home/edged/pkg/tailscale_utils"
+	"github.com/jtcressy-home/edged/pkg/tstest"
+	"go.uber.org/zap"
+	"path/filepath"
+	"reflect"
+	"tailscale.com/ipn"
+	"testing"
+)
+
+func TestOwnership(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", ownershipStateFile)
+	o, err := LoadOwnership(path)
+	if err != nil || len(o.Fields) != 0 {
+		t.Fatalf("LoadOwnership of a missing file = %+v, %v, want an empty record", o, err)
+	}
+	before := ipn.NewPrefs()
+	before.Hostname, before.ShieldsUp = "original", false
+	if err := o.Claim([]string{"Hostname", "ShieldsUp"}, before); err != nil {
+		t.Fatal(err)
+	}
+	applied := before.Clone()
+	applied.Hostname, applied.ShieldsUp = "edge", true
+	if err := o.Applied([]string{"Hostname", "ShieldsUp"}, applied); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Claiming again after a restart keeps the value from before edged
+	o, err = LoadOwnership(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Claim([]string{"Hostname", "ShieldsUp"}, applied); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(o.Fields["Hostname"].Original); got != `"original"` {
+		t.Errorf("Hostname original = %s after a restart, want \"original\"", got)
+	}
+
+	// Both are dropped from the prefs file, but someone else changed the
+	// hostname since edged applied it
+	released := o.Released(nil)
+	if want := []string{"Hostname", "ShieldsUp"}; !reflect.DeepEqual(released, want) {
+		t.Fatalf("Released = %v, want %v", released, want)
+	}
+	current := applied.Clone()
+	current.Hostname = "manual"
+	target := current.Clone()
+	reverted, err := o.Revert(released, current, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ShieldsUp"}; !reflect.DeepEqual(reverted, want) {
+		t.Errorf("Revert = %v, want only %v", reverted, want)
+	}
+	if target.ShieldsUp || target.Hostname != "manual" {
+		t.Errorf("target ShieldsUp=%v Hostname=%q, want ShieldsUp restored and the hostname left alone", target.ShieldsUp, target.Hostname)
+	}
+	o.Forget(released)
+	if len(o.Fields) != 0 {
+		t.Errorf("fields %v still owned after Forget", o.Fields)
+	}
+}
+
+func TestReconcilerReleasesFields(t *testing.T) {
+	f, err := tstest.NewLocalAPI(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stateDir := t.TempDir()
+	client := tsutils.NewClient(f.Socket)
+	ctx := context.Background()
+	reconcile := func(prefs map[string]interface{}) {
+		t.Helper()
+		// A fresh Reconciler each time, as after a restart
+		r := NewReconciler(client, "", "", stateDir, FieldFilter{}, zap.NewNop())
+		r.Prefs = prefs
+		r.Reconcile(ctx)
+		if s := r.Status(); s.Error != "" {
+			t.Fatalf("reconcile %v: %s", prefs, s.Error)
+		}
+	}
+
+	reconcile(map[string]interface{}{"Hostname": "edge", "ShieldsUp": true, "RunSSH": true})
+	if p := f.Prefs(); p.Hostname != "edge" || !p.ShieldsUp || !p.RunSSH {
+		t.Fatalf("prefs %+v, want all three applied", p)
+	}
+	if _, err := client.EditPrefs(ctx, &ipn.MaskedPrefs{Prefs: ipn.Prefs{Hostname: "manual"}, HostnameSet: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dropping Hostname and ShieldsUp from the file reverts ShieldsUp, but
+	// not the hostname someone else changed meanwhile
+	reconcile(map[string]interface{}{"RunSSH": true})
+	if p := f.Prefs(); p.Hostname != "manual" || p.ShieldsUp || !p.RunSSH {
+		t.Errorf("prefs Hostname=%q ShieldsUp=%v RunSSH=%v, want manual, reverted and still enforced", p.Hostname, p.ShieldsUp, p.RunSSH)
+	}
+	o, err := LoadOwnership(filepath.Join(stateDir, ownershipStateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := o.Fields["RunSSH"]; len(o.Fields) != 1 || !ok {
+		t.Errorf("owned fields %v, want only RunSSH", o.Fields)
+	}
+
+	// Released fields are left alone from then on
+	if _, err := client.EditPrefs(ctx, &ipn.MaskedPrefs{Prefs: ipn.Prefs{ShieldsUp: true}, ShieldsUpSet: true}); err != nil {
+		t.Fatal(err)
+	}
+	edits := len(f.Edits())
+	reconcile(map[string]interface{}{"RunSSH": true})
+	if len(f.Edits()) != edits || !f.Prefs().ShieldsUp {
+		t.Errorf("released ShieldsUp changed back, edits %+v", f.Edits()[edits:])
+	}
+}
@@ -0,0 +1,92 @@
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"github.com/gianarb/planner"
+	tsutils "github.com/jtcressy-home/edged/pkg/tailscale_utils"
+	"tailscale.com/ipn"
+)
+
+// TailscalePlan converges tailscaled's preferences on TargetPrefs. Only the
+// named Fields are managed, every other pref is left alone.
+type TailscalePlan struct {
+	TargetPrefs  *ipn.Prefs
+	Fields       []string
+	client       *tsutils.Client
+	currentPrefs *ipn.Prefs
+	maskedPrefs  *ipn.MaskedPrefs
+	diff         []FieldDiff
+	// applied accumulates the changes made by UpdatePreferences during the
+	// current execution of the plan.
+	applied []FieldDiff
+	// sent are the changes tailscaled accepted, whether or not they stuck.
+	sent []FieldDiff
+}
+
+func (t *TailscalePlan) Create(ctx context.Context) (procedure []planner.Procedure, err error) {
+	t.diff = nil
+	if len(t.Fields) == 0 {
+		return
+	}
+	t.currentPrefs, err = t.client.GetPrefs(ctx)
+	if err != nil {
+		return
+	}
+	mask, diff, err := CalculateMaskedPrefs(t.currentPrefs, t.TargetPrefs, t.filter())
+	if err != nil {
+		return
+	}
+	t.diff = diff
+	if len(diff) > 0 {
+		t.maskedPrefs = mask
+		return []planner.Procedure{&UpdatePreferences{plan: t}}, nil
+	}
+	return
+}
+
+func (t *TailscalePlan) Name() string {
+	return "tailscale_preferences_plan"
+}
+
+func (t *TailscalePlan) filter() FieldFilter {
+	return FieldFilter{Allow: t.Fields}
+}
+
+type UpdatePreferences struct {
+	plan *TailscalePlan
+}
+
+func (u *UpdatePreferences) Name() string {
+	return "update_prefs"
+}
+
+func (u *UpdatePreferences) Do(ctx context.Context) (procedure []planner.Procedure, err error) {
+
+	returnedPrefs, err := u.plan.client.EditPrefs(ctx, u.plan.maskedPrefs)
+	if err != nil {
+		return
+	}
+	u.plan.sent = append(u.plan.sent, u.plan.diff...)
+	fetchedPrefs, err := u.plan.client.GetPrefs(ctx)
+	if err != nil {
+		return
+	}
+	_, diff, err := CalculateMaskedPrefs(returnedPrefs, fetchedPrefs, u.plan.filter())
+	if err != nil {
+		return nil, err
+	}
+	if len(diff) > 0 {
+		return nil, fmt.Errorf("desired preferences failed to apply correctly: %v", diff)
+	}
+	_, diff, err = CalculateMaskedPrefs(fetchedPrefs, u.plan.TargetPrefs, u.plan.filter())
+	if err != nil {
+		return nil, err
+	}
+	if len(diff) > 0 {
+		return nil, fmt.Errorf("desired preferences still differ after apply: %v", diff)
+	}
+	u.plan.currentPrefs = fetchedPrefs
+	u.plan.applied = append(u.plan.applied, u.plan.diff...)
+	return
+}
@@ -0,0 +1,44 @@
+package reconcile
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPlanResultWriteText(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		res  PlanResult
+		want string
+	}{
+		{
+			name: "no changes",
+			res:  PlanResult{Fields: []string{"Hostname", "ShieldsUp"}},
+			want: "Managed fields: Hostname, ShieldsUp\nNo changes.\n",
+		},
+		{
+			name: "changes",
+			res: PlanResult{
+				Fields:  []string{"Hostname", "ShieldsUp"},
+				Changes: []FieldDiff{{Field: "Hostname", Current: "old", Desired: "edge"}, {Field: "ShieldsUp", Current: false, Desired: true}},
+			},
+			want: "Managed fields: Hostname, ShieldsUp\n  ~ Hostname: old -> edge\n  ~ ShieldsUp: false -> true\n",
+		},
+		{
+			name: "released and quarantined",
+			res: PlanResult{
+				Fields:      []string{"Hostname"},
+				Released:    []string{"RunSSH", "ShieldsUp"},
+				Reverted:    []string{"ShieldsUp"},
+				Quarantined: []string{"Hostname"},
+			},
+			want: "Managed fields: Hostname\n  - RunSSH (released)\n  - ShieldsUp (released, reverting)\n  ! Hostname (flapping, not enforced)\n",
+		},
+	} {
+		var b bytes.Buffer
+		tt.res.WriteText(&b)
+		if got := b.String(); got != tt.want {
+			t.Errorf("%s: WriteText:\n%s\nwant:\n%s", tt.name, got, tt.want)
+		}
+	}
+}
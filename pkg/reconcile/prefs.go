@@ -0,0 +1,374 @@
+package reconcile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ghodss/yaml"
+	"github.com/jtcressy-home/edged/pkg/device"
+	"inet.af/netaddr"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/preftype"
+)
+
+// DeviceHostname derives a stable hostname for this device from its board
+// identifiers. Hostname set in the prefs file still takes precedence, since it
+// is merged on top of the derived value.
+func DeviceHostname(tmpl string) (string, error) {
+	info, err := device.Gather("/")
+	if err != nil {
+		return "", err
+	}
+	return info.Hostname(tmpl)
+}
+
+// ExitNodeKey is a friendly pref selecting the exit node by Tailscale IP,
+// hostname or MagicDNS name, "" for none. tailscaled swaps an ExitNodeIP for
+// the node's ExitNodeID as soon as it sees the node, so both it and
+// ExitNodeIP are resolved to an ExitNodeID when reconciling.
+const ExitNodeKey = "ExitNode"
+
+// exitNodeFields are the fields managed by ExitNodeKey.
+var exitNodeFields = []string{"ExitNodeID", "ExitNodeIP"}
+
+// netfilterModes are the friendly names of NetfilterMode, as used by
+// `tailscale up --netfilter-mode`.
+var netfilterModes = map[string]preftype.NetfilterMode{
+	"on":       preftype.NetfilterOn,
+	"nodivert": preftype.NetfilterNoDivert,
+	"off":      preftype.NetfilterOff,
+}
+
+// LoadPrefsFile decodes the preferences in the YAML file along with the
+// fields it declares. Only declared fields are meaningful in the returned
+// prefs, the rest are left at their zero value.
+func LoadPrefsFile(filename string) (*CustomPrefs, []string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return parsePrefs(filename, j)
+}
+
+// ParsePrefs decodes prefs declared inline in the config file, like
+// LoadPrefsFile.
+func ParsePrefs(prefs map[string]interface{}) (*CustomPrefs, []string, error) {
+	j, err := json.Marshal(prefs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parsePrefs("tailscale.prefs", j)
+}
+
+func parsePrefs(name string, j []byte) (*CustomPrefs, []string, error) {
+	cprefs := &CustomPrefs{Prefs: &ipn.Prefs{}}
+	if err := json.Unmarshal(j, cprefs); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return cprefs, cprefs.Declared(), nil
+}
+
+// editableField maps a key to its ipn.Prefs field name, or ExitNodeKey,
+// case-insensitively like encoding/json does.
+func editableField(key string) (string, bool) {
+	for _, f := range append(EditableFields(), ExitNodeKey) {
+		if strings.EqualFold(f, key) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// PrefsError is an invalid pref at Path, e.g. AdvertiseRoutes[2].
+type PrefsError struct {
+	Path string
+	Err  error
+}
+
+func (e *PrefsError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+// CustomPrefs strictly decodes ipn.Prefs from YAML. Only editable prefs are
+// accepted, AdvertiseRoutes are plain CIDR strings, normalized, deduplicated
+// and sorted, NetfilterMode may be on, nodivert or off, and the exit node
+// may be given by name with ExitNodeKey.
+type CustomPrefs struct {
+	*ipn.Prefs
+	// ExitNode is the exit node to resolve to ExitNodeID, if declared.
+	ExitNode string
+
+	declared []string
+}
+
+// Declared returns the ipn.Prefs fields the prefs declare, sorted.
+func (c *CustomPrefs) Declared() []string {
+	return c.declared
+}
+
+func (c *CustomPrefs) UnmarshalJSON(data []byte) error {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	if c.Prefs == nil {
+		c.Prefs = &ipn.Prefs{}
+	}
+	names := make([]string, 0, len(keys))
+	for key := range keys {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	c.ExitNode, c.declared = "", nil
+	exitNodeKey := ""
+	for _, key := range names {
+		raw := keys[key]
+		field, ok := editableField(key)
+		if !ok {
+			return &PrefsError{Path: key, Err: errors.New("not an editable tailscale pref")}
+		}
+		if isExitNodeKey(field) {
+			if exitNodeKey != "" {
+				return &PrefsError{Path: key, Err: fmt.Errorf("conflicts with %s, set only one", exitNodeKey)}
+			}
+			exitNodeKey = key
+		} else if containsField(c.declared, field) {
+			return &PrefsError{Path: key, Err: errors.New("declared twice")}
+		}
+		var err error
+		switch field {
+		case "AdvertiseRoutes":
+			err = c.decodeRoutes(key, raw)
+		case "AdvertiseTags":
+			err = c.decodeTags(key, raw)
+		case "NetfilterMode":
+			err = c.decodeNetfilterMode(key, raw)
+		case ExitNodeKey, "ExitNodeIP", "ExitNodeID":
+			err = c.decodeExitNode(key, field, raw)
+		default:
+			err = decodeStrict(raw, reflect.ValueOf(c.Prefs).Elem().FieldByName(field).Addr().Interface())
+			if err != nil {
+				err = &PrefsError{Path: key, Err: err}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		switch field {
+		case ExitNodeKey, "ExitNodeIP":
+			c.declared = append(c.declared, exitNodeFields...)
+		default:
+			c.declared = append(c.declared, field)
+		}
+	}
+	sort.Strings(c.declared)
+	return nil
+}
+
+// decodeRoutes replaces rather than appends to AdvertiseRoutes, the same
+// prefs are merged with the file again on every reload. Host bits are
+// masked so that 10.0.0.1/24 and 10.0.0.0/24 are the same route.
+func (c *CustomPrefs) decodeRoutes(key string, raw json.RawMessage) error {
+	var strs []string
+	if err := decodeStrict(raw, &strs); err != nil {
+		return &PrefsError{Path: key, Err: errors.New("want a list of CIDRs")}
+	}
+	routes := []netaddr.IPPrefix{}
+	seen := map[netaddr.IPPrefix]bool{}
+	for i, s := range strs {
+		p, err := netaddr.ParseIPPrefix(strings.TrimSpace(s))
+		if err != nil {
+			return &PrefsError{Path: fmt.Sprintf("%s[%d]", key, i), Err: fmt.Errorf("invalid CIDR %q", s)}
+		}
+		p = p.Masked()
+		if !seen[p] {
+			seen[p] = true
+			routes = append(routes, p)
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].IP() != routes[j].IP() {
+			return routes[i].IP().Less(routes[j].IP())
+		}
+		return routes[i].Bits() < routes[j].Bits()
+	})
+	c.AdvertiseRoutes = routes
+	return nil
+}
+
+func (c *CustomPrefs) decodeTags(key string, raw json.RawMessage) error {
+	var tags []string
+	if err := decodeStrict(raw, &tags); err != nil {
+		return &PrefsError{Path: key, Err: errors.New("want a list of tags")}
+	}
+	for i, tag := range tags {
+		if err := tailcfg.CheckTag(tag); err != nil {
+			return &PrefsError{Path: fmt.Sprintf("%s[%d]", key, i), Err: fmt.Errorf("invalid tag %q: %v", tag, err)}
+		}
+	}
+	c.AdvertiseTags = tags
+	return nil
+}
+
+// decodeNetfilterMode also accepts booleans, YAML reads an unquoted on or
+// off as one.
+func (c *CustomPrefs) decodeNetfilterMode(key string, raw json.RawMessage) error {
+	var on bool
+	if err := json.Unmarshal(raw, &on); err == nil {
+		c.NetfilterMode = preftype.NetfilterOff
+		if on {
+			c.NetfilterMode = preftype.NetfilterOn
+		}
+		return nil
+	}
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		mode, ok := netfilterModes[strings.ToLower(name)]
+		if !ok {
+			return &PrefsError{Path: key, Err: fmt.Errorf("invalid mode %q, must be on, nodivert or off", name)}
+		}
+		c.NetfilterMode = mode
+		return nil
+	}
+	if err := decodeStrict(raw, &c.NetfilterMode); err != nil || c.NetfilterMode < preftype.NetfilterOff || c.NetfilterMode > preftype.NetfilterOn {
+		return &PrefsError{Path: key, Err: errors.New("must be on, nodivert or off")}
+	}
+	return nil
+}
+
+func (c *CustomPrefs) decodeExitNode(key, field string, raw json.RawMessage) error {
+	var s string
+	if err := decodeStrict(raw, &s); err != nil {
+		return &PrefsError{Path: key, Err: errors.New("want a string")}
+	}
+	s = strings.TrimSpace(s)
+	switch field {
+	case "ExitNodeID":
+		c.ExitNodeID = tailcfg.StableNodeID(s)
+		return nil
+	case "ExitNodeIP":
+		if s == "" {
+			return nil
+		}
+		if _, err := netaddr.ParseIP(s); err != nil {
+			return &PrefsError{Path: key, Err: fmt.Errorf("invalid IP %q, use %s for a hostname", s, ExitNodeKey)}
+		}
+	default:
+		if _, err := netaddr.ParseIP(s); err != nil && s != "" && !validExitNodeName.MatchString(s) {
+			return &PrefsError{Path: key, Err: fmt.Errorf("invalid exit node %q, want an IP, hostname or MagicDNS name", s)}
+		}
+	}
+	c.ExitNode = s
+	return nil
+}
+
+var validExitNodeName = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*\.?$`)
+
+// decodeStrict unmarshals raw into v, rejecting unknown fields of structs.
+func decodeStrict(raw json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		return fmt.Errorf("want %s, got %s", te.Type, te.Value)
+	}
+	return err
+}
+
+// ResolveExitNode finds the peer named by an ExitNodeKey value in status:
+// by Tailscale IP, hostname or MagicDNS name, case-insensitively.
+func ResolveExitNode(status *ipnstate.Status, name string) (tailcfg.StableNodeID, error) {
+	if name == "" {
+		return "", nil
+	}
+	ip, ipErr := netaddr.ParseIP(name)
+	for _, peer := range status.Peer {
+		if ipErr == nil {
+			for _, pip := range peer.TailscaleIPs {
+				if pip == ip {
+					return peer.ID, nil
+				}
+			}
+			continue
+		}
+		dnsName := strings.TrimSuffix(peer.DNSName, ".")
+		if strings.EqualFold(peer.HostName, name) || strings.EqualFold(dnsName, strings.TrimSuffix(name, ".")) ||
+			strings.EqualFold(strings.Split(dnsName, ".")[0], name) {
+			return peer.ID, nil
+		}
+	}
+	return "", fmt.Errorf("exit node %q is not in the tailnet", name)
+}
+
+// isExitNodeKey reports whether key selects the exit node, of which only
+// one may be set.
+func isExitNodeKey(key string) bool {
+	for _, k := range []string{ExitNodeKey, "ExitNodeIP", "ExitNodeID"} {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdatePrefsFile sets keys in the YAML prefs file, creating it if needed.
+// Keys match existing ones case-insensitively and a nil value removes the
+// key, releasing the pref. Comments in the file are not preserved.
+func UpdatePrefsFile(filename string, edits map[string]interface{}) error {
+	keys := map[string]interface{}{}
+	b, err := ioutil.ReadFile(filename)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := yaml.Unmarshal(b, &keys); err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+		if keys == nil {
+			// An empty file
+			keys = map[string]interface{}{}
+		}
+	}
+	for key, value := range edits {
+		field, ok := editableField(key)
+		if !ok {
+			return fmt.Errorf("%s is not an editable tailscale pref", key)
+		}
+		for k := range keys {
+			if strings.EqualFold(k, field) || (isExitNodeKey(field) && isExitNodeKey(k)) {
+				delete(keys, k)
+			}
+		}
+		if value != nil {
+			keys[field] = value
+		}
+	}
+	out, err := yaml.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, out, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
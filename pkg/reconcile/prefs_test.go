@@ -0,0 +1,159 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/ghodss/yaml"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"tailscale.com/types/preftype"
+	"testing"
+)
+
+func parseYAML(t *testing.T, in string) (*CustomPrefs, []string, error) {
+	t.Helper()
+	j, err := yaml.YAMLToJSON([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsePrefs("prefs.yaml", j)
+}
+
+func TestPrefsErrors(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		path string
+	}{
+		{"Bogus: 1", "Bogus"},
+		{"RouteAll: yes please", "RouteAll"},
+		{"Hostname: {name: edge}", "Hostname"},
+		{"RouteAll: true\nrouteall: false", "routeall"},
+		{"AdvertiseRoutes: 10.0.0.0/24", "AdvertiseRoutes"},
+		{"AdvertiseRoutes: [10.0.0.0/24, bogus, 10.1.0.0/16]", "AdvertiseRoutes[1]"},
+		{"AdvertiseTags: [tag:ok, foo]", "AdvertiseTags[1]"},
+		{"NetfilterMode: sideways", "NetfilterMode"},
+		{"NetfilterMode: 7", "NetfilterMode"},
+		{"ExitNodeIP: exit1", "ExitNodeIP"},
+		{"ExitNode: exit_1!", "ExitNode"},
+		{"ExitNode: exit1\nExitNodeIP: 100.64.0.2", "ExitNodeIP"},
+	} {
+		_, _, err := parseYAML(t, tt.in)
+		var pe *PrefsError
+		if !errors.As(err, &pe) {
+			t.Errorf("%q: error %v, want a PrefsError", tt.in, err)
+			continue
+		}
+		if pe.Path != tt.path {
+			t.Errorf("%q: error at %s (%v), want %s", tt.in, pe.Path, err, tt.path)
+		}
+		if !strings.HasPrefix(err.Error(), "prefs.yaml: "+tt.path+": ") {
+			t.Errorf("%q: error %q does not name the file and path", tt.in, err)
+		}
+	}
+}
+
+func TestPrefsRoutes(t *testing.T) {
+	c, fields, err := parseYAML(t, "AdvertiseRoutes: [10.1.2.3/16, 192.168.1.0/24, 10.1.0.0/16, ' ::1/64', 0.0.0.0/0]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(c.AdvertiseRoutes)
+	if want := `["0.0.0.0/0","10.1.0.0/16","192.168.1.0/24","::/64"]`; string(b) != want {
+		t.Errorf("routes %s, want %s", b, want)
+	}
+	if !reflect.DeepEqual(fields, []string{"AdvertiseRoutes"}) {
+		t.Errorf("fields %v, want AdvertiseRoutes", fields)
+	}
+
+	// Decoding again, as on a reload, replaces the routes
+	if err := json.Unmarshal([]byte(`{"AdvertiseRoutes": ["10.2.0.0/16"]}`), c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.AdvertiseRoutes) != 1 || c.AdvertiseRoutes[0].String() != "10.2.0.0/16" {
+		t.Errorf("routes after decoding again %v, want only 10.2.0.0/16", c.AdvertiseRoutes)
+	}
+
+	// No routes is declared, and differs from not declaring them
+	c, fields, err = parseYAML(t, "AdvertiseRoutes: []")
+	if err != nil || c.AdvertiseRoutes == nil || len(fields) != 1 {
+		t.Errorf("empty routes = %v, fields %v, %v, want an empty declared list", c.AdvertiseRoutes, fields, err)
+	}
+}
+
+func TestPrefsFriendlyValues(t *testing.T) {
+	for _, tt := range []struct {
+		in        string
+		netfilter preftype.NetfilterMode
+		exitNode  string
+		fields    []string
+	}{
+		{"NetfilterMode: nodivert", preftype.NetfilterNoDivert, "", []string{"NetfilterMode"}},
+		{"NetfilterMode: ON", preftype.NetfilterOn, "", []string{"NetfilterMode"}},
+		{"NetfilterMode: 'Off'", preftype.NetfilterOff, "", []string{"NetfilterMode"}},
+		{"NetfilterMode: on", preftype.NetfilterOn, "", []string{"NetfilterMode"}},
+		{"NetfilterMode: off", preftype.NetfilterOff, "", []string{"NetfilterMode"}},
+		{"NetfilterMode: 0", preftype.NetfilterOff, "", []string{"NetfilterMode"}},
+		{"ExitNode: exit1.example.com", preftype.NetfilterOff, "exit1.example.com", exitNodeFields},
+		{"ExitNodeIP: ' 100.64.0.2 '", preftype.NetfilterOff, "100.64.0.2", exitNodeFields},
+		{"RouteAll: true\nHostname: edge\nAdvertiseTags: [tag:edge]", preftype.NetfilterOff, "", []string{"AdvertiseTags", "Hostname", "RouteAll"}},
+	} {
+		c, fields, err := parseYAML(t, tt.in)
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if c.NetfilterMode != tt.netfilter || c.ExitNode != tt.exitNode {
+			t.Errorf("%q: NetfilterMode %v, ExitNode %q, want %v, %q", tt.in, c.NetfilterMode, c.ExitNode, tt.netfilter, tt.exitNode)
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("%q: fields %v, want %v", tt.in, fields, tt.fields)
+		}
+	}
+}
+
+func TestParsePrefsInline(t *testing.T) {
+	_, _, err := ParsePrefs(map[string]interface{}{"Bogus": 1})
+	if err == nil || !strings.HasPrefix(err.Error(), "tailscale.prefs: Bogus: ") {
+		t.Errorf("error %v, want it reported against tailscale.prefs", err)
+	}
+}
+
+func TestUpdatePrefsFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "prefs.yaml")
+	err := ioutil.WriteFile(filename, []byte("hostname: edge1\nRunSSH: false\nShieldsUp: true\nExitNodeIP: 100.64.0.2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = UpdatePrefsFile(filename, map[string]interface{}{
+		"Hostname":        nil,
+		"runssh":          true,
+		"AdvertiseRoutes": []string{"10.0.0.0/24"},
+		"ExitNode":        "exit1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "AdvertiseRoutes:\n- 10.0.0.0/24\nExitNode: exit1\nRunSSH: true\nShieldsUp: true\n"
+	if string(b) != want {
+		t.Errorf("prefs file:\n%s\nwant:\n%s", b, want)
+	}
+	if _, _, err := LoadPrefsFile(filename); err != nil {
+		t.Errorf("updated prefs file does not load: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filename, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdatePrefsFile(filename, map[string]interface{}{"RunSSH": true}); err != nil {
+		t.Errorf("UpdatePrefsFile on an empty file: %v", err)
+	}
+	if err := UpdatePrefsFile(filename, map[string]interface{}{"Bogus": 1}); err == nil {
+		t.Error("UpdatePrefsFile set Bogus, want an error")
+	}
+}
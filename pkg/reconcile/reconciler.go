@@ -0,0 +1,471 @@
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"github.com/gianarb/planner"
+	"github.com/jtcressy-home/edged/pkg/config"
+	"github.com/jtcressy-home/edged/pkg/display"
+	tsutils "github.com/jtcressy-home/edged/pkg/tailscale_utils"
+	goconfig "github.com/peak/go-config"
+	"go.uber.org/zap"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const reconcileTimeout = 10 * time.Second
+
+// Reconciler enforces the tailscale preferences declared in PrefsFile,
+// re-applying them whenever the file changes. Only the fields the file
+// declares are managed; a field removed from the file is released and, if
+// nobody else changed it meanwhile, reverted to its value before edged took
+// it over.
+type Reconciler struct {
+	PrefsFile string
+	// Prefs are declared inline in the config file instead of PrefsFile.
+	// They only change with a restart, so are not watched.
+	Prefs map[string]interface{}
+	// HostnameTemplate derives the hostname from device identifiers, see
+	// device.Info.Hostname. Empty leaves the hostname alone.
+	HostnameTemplate string
+	// ControlURL is enforced unless the file declares one. Empty leaves it
+	// alone.
+	ControlURL    string
+	Filter        FieldFilter
+	OwnershipPath string
+	// StatusPath is where the outcome of every reconcile is persisted, see
+	// Status.
+	StatusPath string
+	// DryRun only logs the changes a reconcile would make.
+	DryRun bool
+	Logger *zap.Logger
+
+	client    *tsutils.Client
+	plan      *TailscalePlan
+	scheduler *planner.Scheduler
+	owned     *Ownership
+	hostname  string
+	flaps     flapDetector
+	backoff   time.Duration
+
+	changes chan struct{}
+
+	mu      sync.Mutex
+	result  *display.ReconcileStatus
+	status  *Status
+	metrics metrics
+}
+
+// NewReconciler creates a Reconciler for the tailscaled client talks to.
+func NewReconciler(client *tsutils.Client, prefsFile, hostnameTemplate, stateDir string, filter FieldFilter, logger *zap.Logger) *Reconciler {
+	scheduler := planner.NewScheduler()
+	scheduler.WithLogger(logger)
+	return &Reconciler{
+		PrefsFile:        prefsFile,
+		HostnameTemplate: hostnameTemplate,
+		Filter:           filter,
+		OwnershipPath:    filepath.Join(stateDir, ownershipStateFile),
+		StatusPath:       StatusPath(stateDir),
+		Logger:           logger,
+		client:           client,
+		plan:             &TailscalePlan{client: client},
+		scheduler:        scheduler,
+		changes:          make(chan struct{}, 1),
+	}
+}
+
+// FromConfig creates a Reconciler for the daemon's configuration, talking to
+// tailscaled with client.
+func FromConfig(c *config.Config, client *tsutils.Client) (*Reconciler, error) {
+	filter := FieldFilter{Allow: c.PrefsAllow, Deny: c.PrefsDeny}
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	r := NewReconciler(client, c.PrefsFile, c.HostnameTemplate, c.StateDir, filter, c.Logger)
+	r.ControlURL = c.ControlURL
+	r.Prefs = c.Prefs
+	r.DryRun = c.DryRun
+	return r, nil
+}
+
+// Run reconciles once at startup and then on every change to PrefsFile until
+// ctx is cancelled. Inline Prefs are not watched. A failed reconcile is
+// retried with backoff, and one that applied changes is checked again
+// shortly after. Watching PrefsFile is retried with backoff too, e.g. while
+// its directory does not exist yet.
+func (r *Reconciler) Run(ctx context.Context) error {
+	var (
+		configChan   <-chan error
+		watchBackoff time.Duration
+		timer        *time.Timer
+	)
+	for {
+		if timer != nil {
+			timer.Stop()
+		}
+		watching := r.Prefs != nil || configChan != nil
+		if !watching {
+			var err error
+			if configChan, err = goconfig.Watch(ctx, r.PrefsFile); err != nil {
+				watchBackoff = nextBackoff(watchBackoff)
+				r.Logger.Error(fmt.Sprintf("error watching %s, retrying in %v: %v", r.PrefsFile, watchBackoff, err))
+			} else {
+				watching, watchBackoff = true, 0
+			}
+		}
+		var retry <-chan time.Time
+		delay := r.Reconcile(ctx)
+		if !watching && (delay == 0 || watchBackoff < delay) {
+			delay = watchBackoff
+		}
+		if delay > 0 {
+			timer = time.NewTimer(delay)
+			retry = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-retry:
+		case e := <-configChan:
+			if e != nil {
+				// Reconciling right away could spin on a broken watch
+				watchBackoff = nextBackoff(watchBackoff)
+				r.Logger.Error(fmt.Sprintf("error watching %s, reconciling again in %v: %v", r.PrefsFile, watchBackoff, e))
+				timer = time.NewTimer(watchBackoff)
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-timer.C:
+				}
+				continue
+			}
+			r.Logger.Info("config changed, reloading...")
+			// The change may well be the fix, start over.
+			r.backoff, watchBackoff = 0, 0
+			r.flaps.reset()
+		}
+	}
+}
+
+// PlanResult describes what a reconcile changed, or would change in dry-run.
+type PlanResult struct {
+	Fields      []string    // prefs managed by edged
+	Changes     []FieldDiff // edits converging tailscaled on the prefs file
+	Released    []string    // fields no longer declared in the prefs file
+	Reverted    []string    // released fields restored to their original value
+	Quarantined []string    // managed fields flapping, no longer enforced
+}
+
+// WriteText prints the plan for humans, one line per change.
+func (p *PlanResult) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Managed fields: %s\n", strings.Join(p.Fields, ", "))
+	for _, d := range p.Changes {
+		fmt.Fprintf(w, "  ~ %s\n", d)
+	}
+	for _, name := range p.Released {
+		if containsField(p.Reverted, name) {
+			fmt.Fprintf(w, "  - %s (released, reverting)\n", name)
+		} else {
+			fmt.Fprintf(w, "  - %s (released)\n", name)
+		}
+	}
+	for _, name := range p.Quarantined {
+		fmt.Fprintf(w, "  ! %s (flapping, not enforced)\n", name)
+	}
+	if len(p.Changes) == 0 && len(p.Released) == 0 {
+		fmt.Fprintln(w, "No changes.")
+	}
+}
+
+// Reconcile loads PrefsFile and converges the fields it declares. In DryRun
+// the changes are only logged. It returns when to reconcile again without
+// waiting for a change, or 0.
+func (r *Reconciler) Reconcile(ctx context.Context) time.Duration {
+	ctx, cancel := context.WithTimeout(ctx, reconcileTimeout)
+	defer cancel()
+	start := time.Now()
+	res, err := r.reconcile(ctx)
+	if res != nil {
+		msg := "updated pref"
+		if r.DryRun {
+			msg = "dry-run, would update pref"
+		}
+		for _, d := range res.Changes {
+			r.Logger.Info(msg,
+				zap.String("field", d.Field),
+				zap.Any("from", d.Current),
+				zap.Any("to", d.Desired),
+			)
+		}
+		for _, name := range res.Released {
+			r.Logger.Info("releasing pref",
+				zap.String("field", name),
+				zap.Bool("revert", containsField(res.Reverted, name)),
+			)
+		}
+	}
+	if err != nil {
+		r.Logger.Error(fmt.Sprintf("error reconciling prefs: %v", err))
+	}
+	var delay time.Duration
+	switch {
+	case err != nil:
+		r.backoff = nextBackoff(r.backoff)
+		delay = r.backoff
+		r.Logger.Info(fmt.Sprintf("retrying prefs reconcile in %v", delay))
+	case !r.DryRun && len(res.Changes) > 0:
+		// tailscaled may rewrite a pref some time after it was applied,
+		// e.g. swapping ExitNodeIP for the node's ID, so check again.
+		r.backoff, delay = 0, retryMin
+	default:
+		r.backoff = 0
+	}
+	r.setResult(res, err, start, delay)
+	return delay
+}
+
+// Plan returns what Reconcile would change without applying anything.
+func (r *Reconciler) Plan(ctx context.Context) (*PlanResult, error) {
+	res, err := r.prepare(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.plan.Create(ctx); err != nil {
+		return nil, err
+	}
+	res.Changes = r.plan.diff
+	return res, nil
+}
+
+func (r *Reconciler) reconcile(ctx context.Context) (*PlanResult, error) {
+	if r.DryRun {
+		return r.Plan(ctx)
+	}
+	res, err := r.prepare(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.plan.applied, r.plan.sent = nil, nil
+	err = r.scheduler.Execute(ctx, r.plan)
+	res.Changes = r.plan.applied
+	for _, name := range r.flaps.observe(r.plan.diff, r.plan.sent) {
+		r.Logger.Warn("pref is changed back after every apply, no longer enforcing it until the prefs change",
+			zap.String("field", name),
+			zap.Int("applies", flapLimit+1),
+		)
+		res.Quarantined = append(res.Quarantined, name)
+		// Leaving it out from now on may well be enough to converge, so
+		// retry soon.
+		r.backoff = 0
+	}
+	sort.Strings(res.Quarantined)
+	if err == nil {
+		r.owned.Forget(res.Released)
+		err = r.owned.Applied(without(res.Fields, res.Quarantined), r.plan.TargetPrefs)
+	}
+	if saveErr := r.owned.Save(); err == nil && saveErr != nil {
+		err = fmt.Errorf("saving prefs ownership: %v", saveErr)
+	}
+	return res, err
+}
+
+// prepare loads PrefsFile, works out which fields are managed, claimed or
+// released and sets up the plan accordingly.
+func (r *Reconciler) prepare(ctx context.Context) (*PlanResult, error) {
+	cprefs, declared, err := r.loadPrefs()
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %v", err)
+	}
+	desired := cprefs.Prefs
+	if cprefs.ExitNode != "" {
+		status, err := r.client.Status(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if desired.ExitNodeID, err = ResolveExitNode(status, cprefs.ExitNode); err != nil {
+			return nil, err
+		}
+	}
+	if r.HostnameTemplate != "" && !containsField(declared, "Hostname") {
+		if hostname, err := r.deviceHostname(); err != nil {
+			r.Logger.Error(fmt.Sprintf("error deriving hostname: %v", err))
+		} else {
+			desired.Hostname = hostname
+			declared = append(declared, "Hostname")
+		}
+	}
+	if r.ControlURL != "" && !containsField(declared, "ControlURL") {
+		desired.ControlURL = r.ControlURL
+		declared = append(declared, "ControlURL")
+	}
+	res := &PlanResult{}
+	for _, name := range declared {
+		if r.Filter.Permits(name) {
+			res.Fields = append(res.Fields, name)
+		}
+	}
+	sort.Strings(res.Fields)
+
+	if r.owned == nil {
+		if r.owned, err = LoadOwnership(r.OwnershipPath); err != nil {
+			return nil, err
+		}
+	}
+	current, err := r.client.GetPrefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res.Released = r.owned.Released(res.Fields)
+	res.Reverted, err = r.owned.Revert(res.Released, current, desired)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.owned.Claim(res.Fields, current); err != nil {
+		return nil, err
+	}
+	for _, name := range r.flaps.Quarantined() {
+		if containsField(res.Fields, name) {
+			res.Quarantined = append(res.Quarantined, name)
+		}
+	}
+	r.plan.TargetPrefs = desired
+	r.plan.Fields = append(without(res.Fields, res.Quarantined), res.Reverted...)
+	return res, nil
+}
+
+// loadPrefs returns the declared prefs, inline or from PrefsFile.
+func (r *Reconciler) loadPrefs() (*CustomPrefs, []string, error) {
+	if r.Prefs != nil {
+		return ParsePrefs(r.Prefs)
+	}
+	return LoadPrefsFile(r.PrefsFile)
+}
+
+// deviceHostname derives the hostname once, device identifiers do not change
+// while running.
+func (r *Reconciler) deviceHostname() (string, error) {
+	if r.hostname == "" {
+		hostname, err := DeviceHostname(r.HostnameTemplate)
+		if err != nil {
+			return "", err
+		}
+		r.Logger.Info(fmt.Sprintf("derived hostname %s from device identifiers", hostname))
+		r.hostname = hostname
+	}
+	return r.hostname, nil
+}
+
+// without returns fields except those in drop.
+func without(fields, drop []string) []string {
+	var keep []string
+	for _, f := range fields {
+		if !containsField(drop, f) {
+			keep = append(keep, f)
+		}
+	}
+	return keep
+}
+
+func containsField(fields []string, name string) bool {
+	for _, f := range fields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Changes receives a value after every reconcile, so its Status can be
+// shown. Changes are coalesced while the receiver is busy.
+func (r *Reconciler) Changes() <-chan struct{} {
+	return r.changes
+}
+
+// Status returns the result of the last reconcile, or nil if none has run.
+func (r *Reconciler) Status() *display.ReconcileStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.result
+}
+
+// setResult records the outcome of the reconcile started at start for the
+// displays, the status file and metrics.
+func (r *Reconciler) setResult(res *PlanResult, err error, start time.Time, retry time.Duration) {
+	s := &display.ReconcileStatus{
+		Time:   time.Now(),
+		DryRun: r.DryRun,
+	}
+	if retry > 0 && err != nil {
+		s.RetryAt = s.Time.Add(retry)
+	}
+	if res != nil {
+		s.Quarantined = res.Quarantined
+		s.Applied = !r.DryRun && len(res.Changes) > 0
+		for _, d := range res.Changes {
+			s.Changes = append(s.Changes, d.String())
+		}
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.result = s
+
+	st := r.loadStatus()
+	st.LastAttempt, st.Duration, st.DryRun, st.Error = start, time.Since(start), r.DryRun, ""
+	changes := 0
+	st.Quarantined = nil
+	if res != nil {
+		st.Fields = res.Fields
+		st.Quarantined = res.Quarantined
+		switch {
+		case r.DryRun:
+			st.Drift = res.Changes
+		case err != nil:
+			st.Drift = unapplied(r.plan.diff, res.Changes)
+		default:
+			st.Drift = nil
+			changes = len(res.Changes)
+		}
+	}
+	if err != nil {
+		st.Error = err.Error()
+	} else {
+		st.LastSuccess = start
+		if !r.DryRun && res != nil && len(res.Changes) > 0 {
+			st.Applied = res.Changes
+		}
+	}
+	r.metrics.observe(st.Duration, changes, err)
+	if r.StatusPath != "" {
+		if err := st.Save(r.StatusPath); err != nil {
+			r.Logger.Error(fmt.Sprintf("error saving reconcile status: %v", err))
+		}
+	}
+	select {
+	case r.changes <- struct{}{}:
+	default:
+	}
+}
+
+// unapplied returns the diffs not in applied.
+func unapplied(diff, applied []FieldDiff) []FieldDiff {
+	var left []FieldDiff
+	for _, d := range diff {
+		found := false
+		for _, a := range applied {
+			if a.Field == d.Field {
+				found = true
+			}
+		}
+		if !found {
+			left = append(left, d)
+		}
+	}
+	return left
+}
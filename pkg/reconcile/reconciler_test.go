@@ -0,0 +1,61 @@
+package reconcile
+
+import (
+	"context"
+	tsutils "github.com/jtcressy-home/edged/pkg/tailscale_utils"
+	"github.com/jtcressy-home/edged/pkg/tstest"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReconcilerRunWatchesLateFile(t *testing.T) {
+	f, err := tstest.NewLocalAPI(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// The prefs file's directory is only created once edged is running
+	dir := filepath.Join(t.TempDir(), "edged")
+	prefsFile := filepath.Join(dir, "prefs.yaml")
+	r := NewReconciler(tsutils.NewClient(f.Socket), prefsFile, "", t.TempDir(), FieldFilter{}, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(prefsFile, []byte("ShieldsUp: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(retryMin + 5*time.Second)
+	for !f.Prefs().ShieldsUp {
+		if time.Now().After(deadline) {
+			t.Fatalf("prefs file never applied, status %+v", r.Status())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Later changes are picked up by the watch
+	if err := ioutil.WriteFile(prefsFile, []byte("ShieldsUp: false\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(time.Second)
+	for f.Prefs().ShieldsUp {
+		if time.Now().After(deadline) {
+			t.Fatalf("change to the prefs file never applied, status %+v", r.Status())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,132 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const statusStateFile = "reconcile-status.json"
+
+// Status is the outcome of reconciling the prefs, persisted after every
+// attempt so whether a node is converged can be told from outside the daemon.
+type Status struct {
+	LastAttempt time.Time
+	LastSuccess time.Time     `json:",omitempty"`
+	Duration    time.Duration // of the last attempt
+	DryRun      bool          `json:",omitempty"`
+	Fields      []string      // prefs managed by edged
+	// Applied is the diff applied by the last attempt that changed anything.
+	Applied []FieldDiff `json:",omitempty"`
+	// Drift are the differences from the declared prefs left after the last
+	// attempt: pending in dry-run, or not applied because of Error.
+	Drift []FieldDiff `json:",omitempty"`
+	// Quarantined are managed prefs changed back after every apply, no
+	// longer enforced until the declared prefs change.
+	Quarantined []string `json:",omitempty"`
+	Error       string   `json:",omitempty"`
+}
+
+// Converged reports whether tailscaled held the declared prefs after the
+// last attempt.
+func (s *Status) Converged() bool {
+	return s.Error == "" && len(s.Drift) == 0 && len(s.Quarantined) == 0
+}
+
+// LoadStatus reads the status persisted at path, see StatusPath.
+func LoadStatus(path string) (*Status, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Status{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// StatusPath is where the reconciler persists its Status in stateDir.
+func StatusPath(stateDir string) string {
+	return filepath.Join(stateDir, statusStateFile)
+}
+
+// Save writes the status to path atomically.
+func (s *Status) Save(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// WriteText prints the status for humans, as of now.
+func (s *Status) WriteText(w io.Writer, now time.Time) {
+	state := "converged"
+	switch {
+	case s.Error != "":
+		state = "error"
+	case len(s.Quarantined) > 0:
+		state = "flapping, " + strings.Join(s.Quarantined, ", ") + " not enforced"
+	case len(s.Drift) > 0 && s.DryRun:
+		state = fmt.Sprintf("drifted, %d pending in dry-run", len(s.Drift))
+	case len(s.Drift) > 0:
+		state = fmt.Sprintf("drifted, %d pending", len(s.Drift))
+	}
+	fmt.Fprintf(w, "Prefs:          %s\n", state)
+	fmt.Fprintf(w, "Last attempt:   %s (%s ago), took %s\n", s.LastAttempt.Format(time.RFC3339), ago(now, s.LastAttempt), s.Duration.Round(time.Millisecond))
+	if s.LastSuccess.IsZero() {
+		fmt.Fprintf(w, "Last success:   never\n")
+	} else {
+		fmt.Fprintf(w, "Last success:   %s (%s ago)\n", s.LastSuccess.Format(time.RFC3339), ago(now, s.LastSuccess))
+	}
+	fmt.Fprintf(w, "Managed fields: %s\n", strings.Join(s.Fields, ", "))
+	if len(s.Applied) > 0 {
+		fmt.Fprintln(w, "Last applied:")
+		for _, d := range s.Applied {
+			fmt.Fprintf(w, "  ~ %s\n", d)
+		}
+	}
+	if len(s.Drift) > 0 {
+		fmt.Fprintln(w, "Drift:")
+		for _, d := range s.Drift {
+			fmt.Fprintf(w, "  ~ %s\n", d)
+		}
+	}
+	if s.Error != "" {
+		fmt.Fprintf(w, "Error:          %s\n", s.Error)
+	}
+}
+
+func ago(now, t time.Time) time.Duration {
+	return now.Sub(t).Round(time.Second)
+}
+
+// loadStatus returns the persisted status, so LastSuccess survives a
+// restart, or an empty one.
+func (r *Reconciler) loadStatus() *Status {
+	if r.status == nil {
+		s, err := LoadStatus(r.StatusPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			r.Logger.Error(fmt.Sprintf("error loading reconcile status: %v", err))
+		}
+		if s == nil {
+			s = &Status{}
+		}
+		r.status = s
+	}
+	return r.status
+}
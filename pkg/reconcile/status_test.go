@@ -0,0 +1,117 @@
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	tsutils "github.com/jtcressy-home/edged/pkg/tailscale_utils"
+	"github.com/jtcressy-home/edged/pkg/tstest"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusRoundTrip(t *testing.T) {
+	path := StatusPath(filepath.Join(t.TempDir(), "state"))
+	if _, err := LoadStatus(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("LoadStatus of a missing file = %v, want ErrNotExist", err)
+	}
+	attempt := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	want := &Status{
+		LastAttempt: attempt,
+		LastSuccess: attempt.Add(-time.Hour),
+		Duration:    150 * time.Millisecond,
+		Fields:      []string{"Hostname", "ShieldsUp"},
+		Applied:     []FieldDiff{{Field: "Hostname", Current: "old", Desired: "edge"}},
+		Drift:       []FieldDiff{{Field: "ShieldsUp", Current: false, Desired: true}},
+		Error:       "tailscaled refused ShieldsUp",
+	}
+	if err := want.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadStatus(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadStatus = %+v, want %+v", got, want)
+	}
+	// Saved atomically, without leaving the temporary file behind
+	if files, _ := os.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Errorf("files next to the status %v, want only %s", files, statusStateFile)
+	}
+}
+
+func TestStatusConverged(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		status Status
+		want   bool
+		state  string
+	}{
+		{"converged", Status{Fields: []string{"Hostname"}}, true, "Prefs:          converged"},
+		{"error", Status{Error: "tailscaled unreachable"}, false, "Prefs:          error"},
+		{"drift", Status{Drift: diffs("Hostname")}, false, "Prefs:          drifted, 1 pending"},
+		{"dry-run", Status{DryRun: true, Drift: diffs("Hostname", "RunSSH")}, false, "Prefs:          drifted, 2 pending in dry-run"},
+		{"quarantined", Status{Quarantined: []string{"Hostname"}}, false, "Prefs:          flapping, Hostname not enforced"},
+	} {
+		if got := tt.status.Converged(); got != tt.want {
+			t.Errorf("%s: Converged() = %v, want %v", tt.name, got, tt.want)
+		}
+		var b bytes.Buffer
+		tt.status.WriteText(&b, time.Now())
+		if first := strings.SplitN(b.String(), "\n", 2)[0]; first != tt.state {
+			t.Errorf("%s: WriteText starts %q, want %q", tt.name, first, tt.state)
+		}
+	}
+}
+
+func TestReconcilerStatusFile(t *testing.T) {
+	f, err := tstest.NewLocalAPI(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stateDir := t.TempDir()
+	path := StatusPath(stateDir)
+	newReconciler := func(shieldsUp interface{}, dryRun bool) *Reconciler {
+		r := NewReconciler(tsutils.NewClient(f.Socket), "", "", stateDir, FieldFilter{}, zap.NewNop())
+		r.Prefs = map[string]interface{}{"ShieldsUp": shieldsUp}
+		r.DryRun = dryRun
+		return r
+	}
+	load := func() *Status {
+		t.Helper()
+		s, err := LoadStatus(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// Dry-run leaves the change pending
+	newReconciler(true, true).Reconcile(context.Background())
+	s := load()
+	if s.Converged() || len(s.Drift) != 1 || s.Drift[0].Field != "ShieldsUp" || len(s.Applied) != 0 {
+		t.Errorf("dry-run status %+v, want ShieldsUp pending", s)
+	}
+
+	// Applying converges
+	newReconciler(true, false).Reconcile(context.Background())
+	s = load()
+	if !s.Converged() || len(s.Applied) != 1 || s.LastSuccess != s.LastAttempt {
+		t.Errorf("status %+v, want converged after applying ShieldsUp", s)
+	}
+	success := s.LastSuccess
+
+	// A failure after a restart keeps the last success
+	newReconciler("maybe", false).Reconcile(context.Background())
+	s = load()
+	if s.Converged() || s.Error == "" || !s.LastSuccess.Equal(success) {
+		t.Errorf("status %+v after failing, want an error and the last success kept", s)
+	}
+}
@@ -0,0 +1,300 @@
+package tailscale_utils
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/ghodss/yaml"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+const (
+	// NoCloudKey is the meta-data key of a pre-auth key in a NoCloud seed.
+	NoCloudKey = "edged-authkey"
+	// CmdlineParam is the kernel command line parameter of a pre-auth key.
+	CmdlineParam = "edged.authkey"
+)
+
+// AuthKeySource is somewhere a pre-auth key for unattended enrollment may
+// be left, e.g. by whoever flashed the SD card.
+type AuthKeySource interface {
+	// AuthKey returns the key, or "" if there is none.
+	AuthKey() (string, error)
+	// Remove destroys the key once it has been used.
+	Remove() error
+	String() string
+}
+
+// ParseAuthKeySources parses comma separated kind:path sources, e.g.
+// "file:/boot/edged-authkey,nocloud:/boot,cmdline:/boot/cmdline.txt".
+func ParseAuthKeySources(s string) ([]AuthKeySource, error) {
+	var sources []AuthKeySource
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kind, path, ok := strings.Cut(entry, ":")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid auth key source %q, want kind:path", entry)
+		}
+		switch kind {
+		case "file":
+			sources = append(sources, KeyFile{Path: path})
+		case "nocloud":
+			sources = append(sources, NoCloudSeed{Dir: path})
+		case "cmdline":
+			sources = append(sources, KernelCmdline{Path: path})
+		default:
+			return nil, fmt.Errorf("invalid auth key source %q, kind must be file, nocloud or cmdline", entry)
+		}
+	}
+	return sources, nil
+}
+
+// KeyFile is a file holding nothing but the key, e.g. on the FAT boot
+// partition.
+type KeyFile struct {
+	Path string
+}
+
+func (f KeyFile) AuthKey() (string, error) {
+	b, err := ioutil.ReadFile(f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(b)), err
+}
+
+func (f KeyFile) Remove() error {
+	if err := shred(f.Path); err != nil {
+		return err
+	}
+	return os.Remove(f.Path)
+}
+
+func (f KeyFile) String() string {
+	return f.Path
+}
+
+// NoCloudSeed is a cloud-init NoCloud seed directory, or a mounted CIDATA
+// volume, whose meta-data sets NoCloudKey.
+type NoCloudSeed struct {
+	Dir string
+}
+
+func (s NoCloudSeed) path() string {
+	return filepath.Join(s.Dir, "meta-data")
+}
+
+func (s NoCloudSeed) AuthKey() (string, error) {
+	b, err := ioutil.ReadFile(s.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var md map[string]interface{}
+	if err := yaml.Unmarshal(b, &md); err != nil {
+		return "", fmt.Errorf("%s: %v", s.path(), err)
+	}
+	key, _ := md[NoCloudKey].(string)
+	return strings.TrimSpace(key), nil
+}
+
+// Remove replaces meta-data with a copy without the key, leaving the rest to
+// cloud-init. A value spanning several lines, like a block scalar, goes with
+// the key. If meta-data does not read back the same without it, it is left
+// alone and the key has to be removed by hand. The key is blanked out in the
+// original file first, see blank.
+func (s NoCloudSeed) Remove() error {
+	b, err := ioutil.ReadFile(s.path())
+	if err != nil {
+		return err
+	}
+	var keep, blanked []string
+	inKey := false
+	for _, l := range strings.SplitAfter(string(b), "\n") {
+		if strings.HasPrefix(l, NoCloudKey+":") {
+			inKey = true
+		} else if inKey && !(strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t") || strings.TrimSpace(l) == "") {
+			// The value continues on indented and blank lines
+			inKey = false
+		}
+		if inKey {
+			blanked = append(blanked, blankLine(l))
+			continue
+		}
+		keep = append(keep, l)
+		blanked = append(blanked, l)
+	}
+	rest := []byte(strings.Join(keep, ""))
+
+	var before, after map[string]interface{}
+	if err := yaml.Unmarshal(b, &before); err != nil {
+		return fmt.Errorf("%s: %v", s.path(), err)
+	}
+	delete(before, NoCloudKey)
+	err = yaml.Unmarshal(rest, &after)
+	if err != nil || len(before)+len(after) > 0 && !reflect.DeepEqual(before, after) {
+		return fmt.Errorf("%s: cannot remove %s without changing the rest, remove it by hand", s.path(), NoCloudKey)
+	}
+	if err := blank(s.path(), []byte(strings.Join(blanked, ""))); err != nil {
+		return err
+	}
+	return replaceFile(s.path(), rest)
+}
+
+// blankLine replaces everything but the line ending with spaces.
+func blankLine(l string) string {
+	text := strings.TrimRight(l, "\r\n")
+	return strings.Repeat(" ", len(text)) + l[len(text):]
+}
+
+func (s NoCloudSeed) String() string {
+	return s.path()
+}
+
+// KernelCmdline is the CmdlineParam parameter on the kernel command line,
+// read from /proc/cmdline or the bootloader's file, e.g. cmdline.txt on a
+// Raspberry Pi.
+type KernelCmdline struct {
+	Path string
+}
+
+func (c KernelCmdline) AuthKey() (string, error) {
+	b, err := ioutil.ReadFile(c.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	for _, param := range strings.Fields(string(b)) {
+		if strings.HasPrefix(param, CmdlineParam+"=") {
+			return strings.TrimPrefix(param, CmdlineParam+"="), nil
+		}
+	}
+	return "", err
+}
+
+// Remove drops the parameter from the bootloader's file, replacing it
+// atomically so that the board still boots if power is lost part way. The
+// parameter is blanked out in the original file first, see blank.
+// /proc/cmdline cannot be changed, the key stays there until the next boot.
+func (c KernelCmdline) Remove() error {
+	if strings.HasPrefix(c.Path, "/proc/") {
+		return fmt.Errorf("%s is read-only, remove %s from the bootloader's command line", c.Path, CmdlineParam)
+	}
+	b, err := ioutil.ReadFile(c.Path)
+	if err != nil {
+		return err
+	}
+	var keep []string
+	for _, param := range strings.Fields(string(b)) {
+		if !strings.HasPrefix(param, CmdlineParam+"=") {
+			keep = append(keep, param)
+		}
+	}
+	blanked := append([]byte(nil), b...)
+	start := -1
+	for i := 0; i <= len(b); i++ {
+		if i < len(b) && !strings.ContainsRune(" \t\r\n", rune(b[i])) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 && strings.HasPrefix(string(b[start:i]), CmdlineParam+"=") {
+			copy(blanked[start:i], strings.Repeat(" ", i-start))
+		}
+		start = -1
+	}
+	if err := blank(c.Path, blanked); err != nil {
+		return err
+	}
+	return replaceFile(c.Path, []byte(strings.Join(keep, " ")+"\n"))
+}
+
+func (c KernelCmdline) String() string {
+	return c.Path
+}
+
+// shred overwrites the file at path with random data, in place, so that on
+// a simple filesystem like FAT the key does not linger in blocks that are
+// freed when it is removed. Flash wear levelling may still keep old copies.
+// It is only fit for a file nothing else needs, like a key file.
+func shred(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, rand.Reader, fi.Size()); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// blank overwrites the file at path in place with content of the same length,
+// the file with the key replaced by spaces, so that on a simple filesystem
+// like FAT the key does not linger in the blocks freed when the file is then
+// replaced. Spaces keep the file valid if power is lost before that, unlike
+// the random data of shred.
+func blank(path string, content []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(content, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// replaceFile replaces the file at path with content through a temporary
+// file in the same directory, so that a power cut leaves either the old or
+// the new file and never a partial one, which for a bootloader's file would
+// stop the board from booting.
+func replaceFile(path string, content []byte) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Chmod(fi.Mode().Perm())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
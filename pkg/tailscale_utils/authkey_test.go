@@ -0,0 +1,179 @@
+package tailscale_utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestParseAuthKeySources(t *testing.T) {
+	sources, err := ParseAuthKeySources("file:/boot/edged-authkey, nocloud:/boot,cmdline:/boot/cmdline.txt,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range sources {
+		got = append(got, s.String())
+	}
+	if want := "/boot/edged-authkey /boot/meta-data /boot/cmdline.txt"; strings.Join(got, " ") != want {
+		t.Errorf("sources = %v, want %s", got, want)
+	}
+	for _, s := range []string{"/boot/edged-authkey", "file:", "usb:/media"} {
+		if _, err := ParseAuthKeySources(s); err == nil {
+			t.Errorf("ParseAuthKeySources(%q) = nil error, want one", s)
+		}
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	f := KeyFile{Path: filepath.Join(t.TempDir(), "edged-authkey")}
+	if key, err := f.AuthKey(); key != "" || err != nil {
+		t.Errorf("AuthKey() of a missing file = %q, %v, want nothing", key, err)
+	}
+	writeFile(t, f.Path, "tskey-abc\n")
+	if key, err := f.AuthKey(); key != "tskey-abc" || err != nil {
+		t.Errorf("AuthKey() = %q, %v, want tskey-abc", key, err)
+	}
+	if err := f.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(f.Path); !os.IsNotExist(err) {
+		t.Errorf("key file still there after Remove: %v", err)
+	}
+}
+
+func TestNoCloudSeed(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		metaData string
+		key      string
+		want     string // meta-data after Remove
+	}{
+		{
+			name:     "plain",
+			metaData: "instance-id: edge-1\nedged-authkey: tskey-abc\nlocal-hostname: edge\n",
+			key:      "tskey-abc",
+			want:     "instance-id: edge-1\nlocal-hostname: edge\n",
+		},
+		{
+			name:     "quoted and last",
+			metaData: "instance-id: edge-1\nedged-authkey: \"tskey-abc\"",
+			key:      "tskey-abc",
+			want:     "instance-id: edge-1\n",
+		},
+		{
+			name:     "literal block",
+			metaData: "edged-authkey: |\n  tskey-abc\n\ninstance-id: edge-1\n",
+			key:      "tskey-abc",
+			want:     "instance-id: edge-1\n",
+		},
+		{
+			name:     "folded block",
+			metaData: "instance-id: edge-1\nedged-authkey: >-\n    tskey-\n    abc\nlocal-hostname: edge\n",
+			key:      "tskey- abc",
+			want:     "instance-id: edge-1\nlocal-hostname: edge\n",
+		},
+		{
+			name:     "only the key",
+			metaData: "edged-authkey: tskey-abc\n",
+			key:      "tskey-abc",
+			want:     "",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NoCloudSeed{Dir: t.TempDir()}
+			writeFile(t, s.path(), tt.metaData)
+			if key, err := s.AuthKey(); key != tt.key || err != nil {
+				t.Errorf("AuthKey() = %q, %v, want %q", key, err, tt.key)
+			}
+			original := linkOriginal(t, s.path())
+			if err := s.Remove(); err != nil {
+				t.Fatal(err)
+			}
+			if got := readFile(t, s.path()); got != tt.want {
+				t.Errorf("meta-data after Remove = %q, want %q", got, tt.want)
+			}
+			checkBlanked(t, original, tt.metaData)
+		})
+	}
+}
+
+func TestNoCloudSeedRefuses(t *testing.T) {
+	s := NoCloudSeed{Dir: t.TempDir()}
+	// The key in a flow mapping cannot be dropped line by line
+	metaData := "{instance-id: edge-1, edged-authkey: tskey-abc}\n"
+	writeFile(t, s.path(), metaData)
+	if key, _ := s.AuthKey(); key != "tskey-abc" {
+		t.Fatalf("AuthKey() = %q, want tskey-abc", key)
+	}
+	if err := s.Remove(); err == nil {
+		t.Error("Remove() = nil error, want a refusal")
+	}
+	if got := readFile(t, s.path()); got != metaData {
+		t.Errorf("meta-data changed to %q after refusing, want it untouched", got)
+	}
+}
+
+func TestKernelCmdline(t *testing.T) {
+	c := KernelCmdline{Path: filepath.Join(t.TempDir(), "cmdline.txt")}
+	writeFile(t, c.Path, "console=tty1 root=/dev/mmcblk0p2 edged.authkey=tskey-abc rootwait\n")
+	if key, err := c.AuthKey(); key != "tskey-abc" || err != nil {
+		t.Errorf("AuthKey() = %q, %v, want tskey-abc", key, err)
+	}
+	original := linkOriginal(t, c.Path)
+	if err := c.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(t, c.Path), "console=tty1 root=/dev/mmcblk0p2 rootwait\n"; got != want {
+		t.Errorf("cmdline after Remove = %q, want %q", got, want)
+	}
+	if got, want := readFile(t, original), "console=tty1 root=/dev/mmcblk0p2                         rootwait\n"; got != want {
+		t.Errorf("original cmdline after Remove = %q, want %q", got, want)
+	}
+	// Replaced through a temporary file that is not left behind
+	if files, _ := ioutil.ReadDir(filepath.Dir(c.Path)); len(files) != 1 || files[0].Mode().Perm() != 0600 {
+		t.Errorf("files after Remove = %v, want only cmdline.txt with its mode kept", files)
+	}
+	if err := (KernelCmdline{Path: "/proc/cmdline"}).Remove(); err == nil {
+		t.Error("Remove() from /proc/cmdline = nil error, want it refused")
+	}
+}
+
+// linkOriginal hard links the file at path from another directory, to check
+// what is left in the original once it is replaced.
+func linkOriginal(t *testing.T, path string) string {
+	t.Helper()
+	link := filepath.Join(t.TempDir(), "original")
+	if err := os.Link(path, link); err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
+
+// checkBlanked checks that the original file, first written with content,
+// kept its length but not the key.
+func checkBlanked(t *testing.T, original, content string) {
+	t.Helper()
+	got := readFile(t, original)
+	if len(got) != len(content) || strings.Contains(got, "tskey") || strings.Contains(got, NoCloudKey) {
+		t.Errorf("original file after Remove = %q, want %q with the key blanked out", got, content)
+	}
+}
@@ -0,0 +1,392 @@
+package tailscale_utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"tailscale.com/ipn"
+	"time"
+)
+
+const (
+	// DefaultAuthURLTTL is how long an AuthURL is shown before a fresh one is
+	// requested. Control does not say when a URL expires, so this errs on the
+	// short side.
+	DefaultAuthURLTTL = 10 * time.Minute
+
+	loginCheckEvery = 5 * time.Second
+	prefsTimeout    = 5 * time.Second
+	// authKeyTimeout is how long a pre-auth key login may take before the
+	// key is given up on, e.g. when control is unreachable.
+	authKeyTimeout = time.Minute
+)
+
+// AuthURL is an interactive login URL and the time it should be considered
+// stale. The zero AuthURL means there is no login pending.
+type AuthURL struct {
+	URL     string
+	Expires time.Time
+}
+
+// LoginManager drives tailscaled's login over the IPN bus. Whenever
+// tailscaled needs a login, it logs in with a pre-auth key if one of
+// AuthKeys has one, otherwise it requests an interactive login and
+// publishes the resulting AuthURL.
+type LoginManager struct {
+	TTL time.Duration
+	// ControlURL is the control server to log in to, like `tailscale up
+	// --login-server`. Empty keeps tailscaled's. Once running, change it
+	// with SetControlURL.
+	ControlURL string
+	// AuthKeys are checked in order for a pre-auth key. A key is removed
+	// once it has been used, and not tried again if control rejects it.
+	AuthKeys []AuthKeySource
+	// KeysPath records the used and rejected pre-auth keys, so that a key
+	// that could not be removed, e.g. from /proc/cmdline, is not tried again
+	// after a restart. Empty remembers them until edged exits.
+	KeysPath string
+
+	w         *Watcher
+	mu        sync.Mutex
+	state     ipn.State
+	current   AuthURL
+	requested bool
+	paused    bool
+	updates   chan AuthURL
+
+	key        string // pre-auth key being logged in with
+	keySource  AuthKeySource
+	keyStarted time.Time
+	keyErr     string     // last error since the key's Start
+	spent      *spentKeys // loaded from KeysPath on first use
+}
+
+// spentKeys are the pre-auth keys not to try again, by the SHA-256 of the
+// key so that the keys themselves are not kept, with when they were spent.
+type spentKeys struct {
+	Used     map[string]time.Time `json:"used,omitempty"`
+	Rejected map[string]time.Time `json:"rejected,omitempty"`
+}
+
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewLoginManager creates a LoginManager driven by w's notifications. It
+// must be called before w is Run.
+func NewLoginManager(w *Watcher) *LoginManager {
+	m := &LoginManager{
+		TTL:     DefaultAuthURLTTL,
+		w:       w,
+		updates: make(chan AuthURL, 1),
+	}
+	w.OnConnect(func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.requested = false
+		m.key, m.keySource = "", nil
+	})
+	w.OnNotify(m.handle)
+	return m
+}
+
+// AuthURLs receives the AuthURL every time it changes. Only the latest value
+// is kept if the receiver falls behind.
+func (m *LoginManager) AuthURLs() <-chan AuthURL {
+	return m.updates
+}
+
+// Current returns the AuthURL currently shown to the user.
+func (m *LoginManager) Current() AuthURL {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.current
+}
+
+// State returns the last state reported by tailscaled.
+func (m *LoginManager) State() ipn.State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// SetControlURL changes the control server to log in to. A login pending
+// on the previous one is started again on url.
+func (m *LoginManager) SetControlURL(url string) {
+	m.mu.Lock()
+	if url == m.ControlURL {
+		m.mu.Unlock()
+		return
+	}
+	m.ControlURL = url
+	if m.key == "" {
+		m.requested = false
+		if m.current.URL != "" {
+			m.publishLocked(AuthURL{})
+		}
+	}
+	m.mu.Unlock()
+	m.maybeLogin()
+}
+
+// SetPaused stops new logins from being requested, e.g. while the device is
+// being deprovisioned.
+func (m *LoginManager) SetPaused(paused bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paused = paused
+}
+
+// Run expires stale AuthURLs and retries logins that could not be requested
+// until ctx is cancelled.
+func (m *LoginManager) Run(ctx context.Context) error {
+	check := time.NewTicker(loginCheckEvery)
+	defer check.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-check.C:
+			m.maybeLogin()
+		}
+	}
+}
+
+func (m *LoginManager) handle(n ipn.Notify) {
+	var used AuthKeySource
+	m.mu.Lock()
+	if n.ErrMessage != nil && m.key != "" {
+		// Only an error followed by tailscaled needing a login again is
+		// the key's, others, e.g. from DNS or health checks, are not
+		m.keyErr = *n.ErrMessage
+	}
+	if n.State != nil && m.key != "" {
+		switch {
+		case *n.State == ipn.Running:
+			log.Printf("login: logged in with pre-auth key from %s", m.keySource)
+			m.spendLocked(m.key, false)
+			used = m.keySource
+			m.key, m.keySource = "", nil
+		case *n.State == ipn.NeedsLogin && m.keyErr != "":
+			m.rejectKeyLocked(m.keyErr)
+		case *n.State != ipn.NeedsLogin:
+			m.keyErr = ""
+		}
+	}
+	if n.State != nil {
+		if *n.State != ipn.NeedsLogin {
+			m.requested = false
+			if m.current.URL != "" {
+				m.publishLocked(AuthURL{})
+			}
+		}
+		m.state = *n.State
+	}
+	if n.BrowseToURL != nil && *n.BrowseToURL != m.current.URL {
+		m.publishLocked(AuthURL{URL: *n.BrowseToURL, Expires: time.Now().Add(m.TTL)})
+	}
+	if n.LoginFinished != nil && m.current.URL != "" {
+		m.publishLocked(AuthURL{})
+	}
+	m.mu.Unlock()
+	if used != nil {
+		if err := used.Remove(); err != nil {
+			log.Printf("login: error removing pre-auth key: %v", err)
+		}
+	}
+	m.maybeLogin()
+}
+
+// maybeLogin logs in when tailscaled needs it and no login is pending, or
+// the pending one has gone stale.
+func (m *LoginManager) maybeLogin() {
+	m.mu.Lock()
+	if m.current.URL != "" && time.Now().After(m.current.Expires) {
+		log.Printf("login: auth URL expired, requesting a new one")
+		m.requested = false
+		m.publishLocked(AuthURL{})
+	}
+	if m.key != "" && time.Since(m.keyStarted) > authKeyTimeout {
+		m.rejectKeyLocked("timed out")
+	}
+	if m.paused || m.requested || m.state != ipn.NeedsLogin {
+		m.mu.Unlock()
+		return
+	}
+	m.requested = true
+	m.mu.Unlock()
+	if src, key := m.nextAuthKey(); key != "" {
+		if err := m.loginWithKey(src, key); err != nil {
+			log.Printf("login: error logging in with pre-auth key: %v", err)
+			m.mu.Lock()
+			m.requested = false
+			m.key, m.keySource = "", nil
+			m.mu.Unlock()
+		}
+		return
+	}
+	err := m.setControlURL()
+	if err == nil {
+		log.Printf("login: starting interactive login")
+		err = m.w.Send(ipn.Command{StartLoginInteractive: &ipn.NoArgs{}})
+	}
+	if err != nil {
+		log.Printf("login: error starting interactive login: %v", err)
+		m.mu.Lock()
+		m.requested = false
+		m.mu.Unlock()
+	}
+}
+
+// nextAuthKey returns the first pre-auth key that has not been rejected.
+func (m *LoginManager) nextAuthKey() (AuthKeySource, string) {
+	for _, src := range m.AuthKeys {
+		key, err := src.AuthKey()
+		if err != nil {
+			log.Printf("login: error reading pre-auth key from %s: %v", src, err)
+			continue
+		}
+		if key == "" {
+			continue
+		}
+		m.mu.Lock()
+		spent := m.spentLocked().has(key)
+		m.mu.Unlock()
+		if !spent {
+			return src, key
+		}
+	}
+	return nil, ""
+}
+
+// loginWithKey starts tailscaled with key, like `tailscale up --authkey`.
+func (m *LoginManager) loginWithKey(src AuthKeySource, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), prefsTimeout)
+	defer cancel()
+	prefs, err := m.w.Client().GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if m.ControlURL != "" {
+		prefs.ControlURL = m.ControlURL
+	}
+	m.key, m.keySource, m.keyStarted, m.keyErr = key, src, time.Now(), ""
+	m.mu.Unlock()
+	prefs.WantRunning = true
+	log.Printf("login: logging in to %s with pre-auth key from %s", prefs.ControlURLOrDefault(), src)
+	return m.w.Send(ipn.Command{Start: &ipn.StartArgs{Opts: ipn.Options{UpdatePrefs: prefs, AuthKey: key}}})
+}
+
+// rejectKeyLocked gives up on the pending pre-auth key, falling back to an
+// interactive login.
+func (m *LoginManager) rejectKeyLocked(reason string) {
+	log.Printf("login: pre-auth key from %s failed: %s, falling back to interactive login", m.keySource, reason)
+	m.spendLocked(m.key, true)
+	m.key, m.keySource, m.keyErr = "", nil, ""
+	m.requested = false
+}
+
+// setControlURL restarts tailscaled's backend on ControlURL if it is set up
+// for another control server, as the login has to be started there.
+func (m *LoginManager) setControlURL() error {
+	m.mu.Lock()
+	controlURL := m.ControlURL
+	m.mu.Unlock()
+	if controlURL == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), prefsTimeout)
+	defer cancel()
+	prefs, err := m.w.Client().GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	if prefs.ControlURL == controlURL {
+		return nil
+	}
+	log.Printf("login: switching control server from %s to %s", prefs.ControlURLOrDefault(), controlURL)
+	prefs.ControlURL = controlURL
+	return m.w.Send(ipn.Command{Start: &ipn.StartArgs{Opts: ipn.Options{UpdatePrefs: prefs}}})
+}
+
+// spentLocked returns the spent keys, reading them from KeysPath the first
+// time. An unreadable record is logged and started afresh.
+func (m *LoginManager) spentLocked() *spentKeys {
+	if m.spent != nil {
+		return m.spent
+	}
+	m.spent = &spentKeys{}
+	if m.KeysPath != "" {
+		b, err := ioutil.ReadFile(m.KeysPath)
+		if err == nil {
+			err = json.Unmarshal(b, m.spent)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("login: error reading spent pre-auth keys: %v", err)
+		}
+	}
+	if m.spent.Used == nil {
+		m.spent.Used = map[string]time.Time{}
+	}
+	if m.spent.Rejected == nil {
+		m.spent.Rejected = map[string]time.Time{}
+	}
+	return m.spent
+}
+
+// spendLocked records key as used or rejected, never to be tried again.
+func (m *LoginManager) spendLocked(key string, rejected bool) {
+	s := m.spentLocked()
+	if rejected {
+		s.Rejected[keyHash(key)] = time.Now()
+	} else {
+		s.Used[keyHash(key)] = time.Now()
+	}
+	if m.KeysPath == "" {
+		return
+	}
+	if err := s.write(m.KeysPath); err != nil {
+		log.Printf("login: error recording spent pre-auth key: %v", err)
+	}
+}
+
+func (s *spentKeys) has(key string) bool {
+	h := keyHash(key)
+	_, used := s.Used[h]
+	_, rejected := s.Rejected[h]
+	return used || rejected
+}
+
+// write replaces the record at path atomically.
+func (s *spentKeys) write(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (m *LoginManager) publishLocked(u AuthURL) {
+	m.current = u
+	select {
+	case <-m.updates:
+	default:
+	}
+	m.updates <- u
+}
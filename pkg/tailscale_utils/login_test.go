@@ -0,0 +1,280 @@
+package tailscale_utils
+
+import (
+	"context"
+	"errors"
+	"github.com/jtcressy-home/edged/pkg/tstest"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"tailscale.com/ipn"
+	"testing"
+	"time"
+)
+
+// memKey is a pre-auth key source in memory. A sticky key cannot be
+// removed, like one on /proc/cmdline.
+type memKey struct {
+	mu      sync.Mutex
+	key     string
+	sticky  bool
+	removed bool
+}
+
+func (k *memKey) AuthKey() (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.removed {
+		return "", nil
+	}
+	return k.key, nil
+}
+
+func (k *memKey) Remove() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.sticky {
+		return errors.New("read-only")
+	}
+	k.removed = true
+	return nil
+}
+
+func (k *memKey) Removed() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.removed
+}
+
+func (k *memKey) String() string {
+	return "memory"
+}
+
+// startLogin runs a LoginManager against a fake tailscaled, logging in on a
+// fake control server.
+func startLogin(t *testing.T, keys ...AuthKeySource) (*tstest.LocalAPI, *tstest.Control, *LoginManager) {
+	t.Helper()
+	return startLoginWith(t, "", keys...)
+}
+
+// startLoginWith is startLogin recording spent keys at keysPath.
+func startLoginWith(t *testing.T, keysPath string, keys ...AuthKeySource) (*tstest.LocalAPI, *tstest.Control, *LoginManager) {
+	t.Helper()
+	f := newLocalAPI(t)
+	c, m := startLoginOn(t, f, keysPath, keys...)
+	return f, c, m
+}
+
+// startLoginOn is startLoginWith against f, e.g. set up to hold keys.
+func startLoginOn(t *testing.T, f *tstest.LocalAPI, keysPath string, keys ...AuthKeySource) (*tstest.Control, *LoginManager) {
+	t.Helper()
+	c := tstest.NewControl(f)
+	t.Cleanup(c.Close)
+
+	w := NewWatcher(NewClient(f.Socket))
+	m := NewLoginManager(w)
+	m.ControlURL = c.URL
+	m.AuthKeys = keys
+	m.KeysPath = keysPath
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go w.Run(ctx)
+	go m.Run(ctx)
+	return c, m
+}
+
+// waitForAuthURL waits for m to publish an interactive login URL.
+func waitForAuthURL(t *testing.T, m *LoginManager) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case u := <-m.AuthURLs():
+			if u.URL != "" {
+				return u.URL
+			}
+		case <-timeout:
+			t.Fatalf("no login URL published, current %+v", m.Current())
+		}
+	}
+}
+
+func waitForState(t *testing.T, f *tstest.LocalAPI, state ipn.State) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for f.State() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("tailscaled is %v, want %v", f.State(), state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// approve completes the login at url as an admin would on control.
+func approve(t *testing.T, url string) {
+	t.Helper()
+	resp, err := http.Post(url, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("approving %s: %s", url, resp.Status)
+	}
+}
+
+// commands counts the interactive logins and pre-auth key logins sent to f.
+func commands(f *tstest.LocalAPI) (interactive int, keys []string) {
+	for _, cmd := range f.Commands() {
+		switch {
+		case cmd.StartLoginInteractive != nil:
+			interactive++
+		case cmd.Start != nil && cmd.Start.Opts.AuthKey != "":
+			keys = append(keys, cmd.Start.Opts.AuthKey)
+		}
+	}
+	return interactive, keys
+}
+
+func TestLoginInteractive(t *testing.T) {
+	f, c, m := startLogin(t)
+	url := waitForAuthURL(t, m)
+	if want := c.URL + tstest.RegisterPath + "fake"; url != want {
+		t.Errorf("login URL = %s, want %s on the control server", url, want)
+	}
+	if p := f.Prefs(); p.ControlURL != c.URL {
+		t.Errorf("tailscaled's ControlURL = %q, want %q", p.ControlURL, c.URL)
+	}
+	approve(t, url)
+	waitForState(t, f, ipn.Running)
+	if u := m.Current(); u.URL != "" {
+		t.Errorf("login URL %s still shown once logged in", u.URL)
+	}
+}
+
+func TestLoginAuthKey(t *testing.T) {
+	key := &memKey{key: "tskey-good"}
+	f, _, _ := startLogin(t, key)
+	waitForState(t, f, ipn.Running)
+	if n, keys := commands(f); n != 0 || len(keys) != 1 {
+		t.Errorf("%d interactive logins and keys %v, want only the key", n, keys)
+	}
+	if p := f.Prefs(); p.ControlURL == "" {
+		t.Error("logged in with the key without setting the control server")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !key.Removed() {
+		if time.Now().After(deadline) {
+			t.Fatal("used pre-auth key was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoginRejectedKey(t *testing.T) {
+	key := &memKey{key: "tskey-expired"}
+	f, c, m := startLogin(t, key)
+	f.RejectAuthKeys(key.key)
+
+	// Control rejects the key, so the login falls back to the QR code
+	url := waitForAuthURL(t, m)
+	if want := c.URL + tstest.RegisterPath + "fake"; url != want {
+		t.Errorf("login URL = %s, want %s", url, want)
+	}
+	approve(t, url)
+	waitForState(t, f, ipn.Running)
+	if key.Removed() {
+		t.Error("rejected pre-auth key was removed, want it left for the operator to replace")
+	}
+
+	// Removed from the tailnet, a fresh login is requested without trying
+	// the rejected key again
+	if err := f.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	waitForAuthURL(t, m)
+	if n, keys := commands(f); n != 2 || len(keys) != 1 {
+		t.Errorf("%d interactive logins and keys %v, want 2 logins after trying the key once", n, keys)
+	}
+}
+
+func TestLoginKeyUnrelatedError(t *testing.T) {
+	key := &memKey{key: "tskey-slow"}
+	f := newLocalAPI(t)
+	f.HoldAuthKeys(key.key)
+	_, m := startLoginOn(t, f, "", key)
+	deadline := time.Now().Add(5 * time.Second)
+	for _, keys := commands(f); len(keys) == 0; _, keys = commands(f) {
+		if time.Now().After(deadline) {
+			t.Fatal("never logged in with the pre-auth key")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An error while control is still checking the key is not the key's
+	if err := f.Error("dns: resolver unreachable"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.ReleaseAuthKeys(); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, f, ipn.Running)
+	if n, _ := commands(f); n != 0 {
+		t.Errorf("%d interactive logins, want the key kept after an unrelated error", n)
+	}
+	if u := m.Current(); u.URL != "" {
+		t.Errorf("login URL %s shown while logging in with a key", u.URL)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for !key.Removed() {
+		if time.Now().After(deadline) {
+			t.Fatal("pre-auth key was not removed after logging in with it")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRelogin(t *testing.T) {
+	f, _, m := startLogin(t)
+	approve(t, waitForAuthURL(t, m))
+	waitForState(t, f, ipn.Running)
+
+	for _, drop := range []func() error{f.Remove, f.Expire} {
+		if err := drop(); err != nil {
+			t.Fatal(err)
+		}
+		approve(t, waitForAuthURL(t, m))
+		waitForState(t, f, ipn.Running)
+	}
+	if n, _ := commands(f); n != 3 {
+		t.Errorf("%d interactive logins, want one each time a login was needed", n)
+	}
+}
+
+func TestSpentKeysPersist(t *testing.T) {
+	keysPath := filepath.Join(t.TempDir(), "authkeys.json")
+	used := &memKey{key: "tskey-used", sticky: true}
+	rejected := &memKey{key: "tskey-rejected"}
+
+	// The first boot logs in with the key that is left on the device
+	f, _, m := startLoginWith(t, keysPath, rejected, used)
+	f.RejectAuthKeys(rejected.key)
+	waitForState(t, f, ipn.Running)
+	if _, keys := commands(f); len(keys) != 2 {
+		t.Fatalf("keys tried %v, want both", keys)
+	}
+	if u := m.Current(); u.URL != "" {
+		t.Errorf("login URL %s shown after logging in with a key", u.URL)
+	}
+
+	// After a restart neither key is tried again
+	f, _, m = startLoginWith(t, keysPath, rejected, used)
+	waitForAuthURL(t, m)
+	if _, keys := commands(f); len(keys) != 0 {
+		t.Errorf("keys tried after a restart %v, want none", keys)
+	}
+	if b := readFile(t, keysPath); strings.Contains(b, "tskey") {
+		t.Errorf("spent keys recorded in the clear: %s", b)
+	}
+}
@@ -0,0 +1,168 @@
+package tailscale_utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/safesocket"
+)
+
+// Client talks to tailscaled's LocalAPI on its unix socket. The tailscale
+// client package keeps the socket in package globals, so each Client has
+// its own socket and connections instead, letting the daemon, reloads and
+// tests each point at a different tailscaled.
+type Client struct {
+	mu     sync.Mutex
+	socket string
+	conns  map[*trackedConn]bool
+	hc     *http.Client
+}
+
+func NewClient(socket string) *Client {
+	c := &Client{socket: socket, conns: map[*trackedConn]bool{}}
+	c.hc = &http.Client{Transport: &http.Transport{DialContext: c.dial}}
+	return c
+}
+
+// Socket returns the path of tailscaled's socket.
+func (c *Client) Socket() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.socket
+}
+
+// SetSocket points the client at tailscaled's socket at socket. Connections
+// are kept alive between requests, so those to the previous socket are
+// closed.
+func (c *Client) SetSocket(socket string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if socket == c.socket {
+		return
+	}
+	c.socket = socket
+	for tc := range c.conns {
+		tc.Conn.Close()
+		delete(c.conns, tc)
+	}
+}
+
+func (c *Client) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	socket := c.Socket()
+	conn, err := connect(socket)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if socket != c.socket {
+		conn.Close()
+		return nil, fmt.Errorf("tailscaled socket changed from %s", socket)
+	}
+	tc := &trackedConn{Conn: conn, client: c}
+	c.conns[tc] = true
+	return tc, nil
+}
+
+// connect opens a connection to tailscaled's socket at exactly socket,
+// never falling back to another tailscaled like safesocket's default
+// strategy does, so the LocalAPI and the IPN bus are the same tailscaled's.
+func connect(socket string) (net.Conn, error) {
+	return safesocket.Connect(safesocket.ExactPath(socket))
+}
+
+// Status returns tailscaled's status.
+func (c *Client) Status(ctx context.Context) (*ipnstate.Status, error) {
+	body, err := c.send(ctx, "GET", "/localapi/v0/status", http.StatusOK, nil)
+	if err != nil {
+		return nil, err
+	}
+	status := new(ipnstate.Status)
+	if err := json.Unmarshal(body, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// GetPrefs returns tailscaled's current prefs.
+func (c *Client) GetPrefs(ctx context.Context) (*ipn.Prefs, error) {
+	body, err := c.send(ctx, "GET", "/localapi/v0/prefs", http.StatusOK, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodePrefs(body)
+}
+
+// EditPrefs changes the prefs set in mp and returns the resulting prefs.
+func (c *Client) EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	b, err := json.Marshal(mp)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.send(ctx, "PATCH", "/localapi/v0/prefs", http.StatusOK, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return decodePrefs(body)
+}
+
+// Logout logs tailscaled out of the tailnet.
+func (c *Client) Logout(ctx context.Context) error {
+	_, err := c.send(ctx, "POST", "/localapi/v0/logout", http.StatusNoContent, nil)
+	return err
+}
+
+func (c *Client) send(ctx context.Context, method, path string, wantStatus int, body io.Reader) ([]byte, error) {
+	// The host is ignored by dial, it only has to be valid
+	req, err := http.NewRequestWithContext(ctx, method, "http://local-tailscaled.sock"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != wantStatus {
+		var e struct{ Error string }
+		if json.Unmarshal(b, &e) == nil && e.Error != "" {
+			return nil, errors.New(e.Error)
+		}
+		return nil, fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(b))
+	}
+	return b, nil
+}
+
+func decodePrefs(body []byte) (*ipn.Prefs, error) {
+	var p ipn.Prefs
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("invalid prefs JSON: %w", err)
+	}
+	return &p, nil
+}
+
+// trackedConn is a client connection to tailscaled, forgotten once closed.
+type trackedConn struct {
+	net.Conn
+	client *Client
+}
+
+func (c *trackedConn) Close() error {
+	c.client.mu.Lock()
+	delete(c.client.conns, c)
+	c.client.mu.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,99 @@
+package tailscale_utils
+
+import (
+	"context"
+	"github.com/jtcressy-home/edged/pkg/tstest"
+	"tailscale.com/ipn"
+	"testing"
+	"time"
+)
+
+func newLocalAPI(t *testing.T) *tstest.LocalAPI {
+	t.Helper()
+	f, err := tstest.NewLocalAPI(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestClientsKeepTheirSockets(t *testing.T) {
+	running, loggedOut := newLocalAPI(t), newLocalAPI(t)
+	if err := running.SetState(ipn.Running); err != nil {
+		t.Fatal(err)
+	}
+	a, b := NewClient(running.Socket), NewClient(loggedOut.Socket)
+	ctx := context.Background()
+	for _, tt := range []struct {
+		c    *Client
+		want string
+	}{{a, "Running"}, {b, "NeedsLogin"}, {a, "Running"}} {
+		status, err := tt.c.Status(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.BackendState != tt.want {
+			t.Errorf("status from %s = %s, want %s", tt.c.Socket(), status.BackendState, tt.want)
+		}
+	}
+
+	// Moving one client leaves the other alone
+	b.SetSocket(running.Socket)
+	if err := b.Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if running.Logouts() != 1 || loggedOut.Logouts() != 0 {
+		t.Errorf("logouts %d and %d, want the moved client's on the running tailscaled", running.Logouts(), loggedOut.Logouts())
+	}
+	if _, err := a.EditPrefs(ctx, &ipn.MaskedPrefs{Prefs: ipn.Prefs{Hostname: "edge"}, HostnameSet: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := running.Prefs().Hostname; got != "edge" {
+		t.Errorf("hostname %q after EditPrefs, want edge", got)
+	}
+	if p, err := b.GetPrefs(ctx); err != nil || p.Hostname != "edge" {
+		t.Errorf("GetPrefs after SetSocket = %+v, %v, want the running tailscaled's", p, err)
+	}
+}
+
+func TestWatcherFollowsSocket(t *testing.T) {
+	first, second := newLocalAPI(t), newLocalAPI(t)
+	w := NewWatcher(NewClient(first.Socket))
+	states := make(chan ipn.State, 10)
+	w.OnNotify(func(n ipn.Notify) {
+		if n.State != nil {
+			states <- *n.State
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+	waitForNotify := func(want ipn.State) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case got := <-states:
+				if got == want {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no %v notification from %s", want, w.Client().Socket())
+			}
+		}
+	}
+	waitForNotify(ipn.NeedsLogin)
+
+	// Notifications and commands move with the client
+	second.SetState(ipn.Running)
+	w.SetSocket(second.Socket)
+	waitForNotify(ipn.Running)
+	if err := w.Send(ipn.Command{Logout: &ipn.NoArgs{}}); err != nil {
+		t.Fatal(err)
+	}
+	waitForNotify(ipn.NeedsLogin)
+	if first.Logouts() != 0 || second.Logouts() != 1 {
+		t.Errorf("logouts %d and %d, want the command sent to the new socket", first.Logouts(), second.Logouts())
+	}
+}
@@ -0,0 +1,191 @@
+package tailscale_utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"tailscale.com/ipn"
+	"time"
+)
+
+const watchRetryDelay = 5 * time.Second
+
+var errNotConnected = errors.New("not connected to tailscaled")
+
+// Watcher is a connection to tailscaled's IPN notification bus on its unix
+// socket. It fans notifications out to handlers and reconnects whenever the
+// connection is lost, e.g. when tailscaled restarts.
+type Watcher struct {
+	client    *Client
+	mu        sync.Mutex
+	conn      net.Conn
+	version   string
+	handlers  []func(ipn.Notify)
+	onConnect []func()
+	changes   chan struct{}
+	reconnect chan struct{}
+}
+
+// NewWatcher creates a Watcher for the tailscaled client talks to.
+func NewWatcher(client *Client) *Watcher {
+	return &Watcher{
+		client:    client,
+		changes:   make(chan struct{}, 1),
+		reconnect: make(chan struct{}, 1),
+	}
+}
+
+// OnNotify registers fn to be called with every notification. It must be
+// called before Run. Right after connecting, handlers receive a notification
+// synthesized from the current status since the bus only reports changes.
+func (w *Watcher) OnNotify(fn func(ipn.Notify)) {
+	w.handlers = append(w.handlers, fn)
+}
+
+// OnConnect registers fn to be called every time the bus is (re)connected,
+// before any notification is delivered. It must be called before Run.
+func (w *Watcher) OnConnect(fn func()) {
+	w.onConnect = append(w.onConnect, fn)
+}
+
+// Changes receives a value whenever tailscaled's state, prefs, netmap or
+// login URL changes, or it reports an error. Changes are coalesced while the receiver is busy.
+func (w *Watcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+// Client returns the client for the tailscaled being watched.
+func (w *Watcher) Client() *Client {
+	return w.client
+}
+
+// SetSocket moves the watcher and its client to tailscaled's socket at
+// socket, dropping the current connection. Both connect to exactly that
+// socket, so notifications come from the tailscaled the client talks to.
+func (w *Watcher) SetSocket(socket string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if socket == w.client.Socket() {
+		return
+	}
+	w.client.SetSocket(socket)
+	select {
+	case w.reconnect <- struct{}{}:
+	default:
+	}
+	if w.conn != nil {
+		w.conn.Close()
+	}
+}
+
+// Send writes a command to tailscaled.
+func (w *Watcher) Send(cmd ipn.Command) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return errNotConnected
+	}
+	cmd.Version = w.version
+	cmd.AllowVersionSkew = true
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return ipn.WriteMsg(w.conn, b)
+}
+
+// Run watches the bus until ctx is cancelled.
+func (w *Watcher) Run(ctx context.Context) error {
+	for {
+		err := w.watch(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Printf("ipn-bus: lost connection to tailscaled: %v", err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(watchRetryDelay):
+		case <-w.reconnect:
+		}
+	}
+}
+
+func (w *Watcher) watch(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn, err := connect(w.client.Socket())
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	status, err := w.client.Status(ctx)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.conn = conn
+	w.version = status.Version
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		w.conn = nil
+		w.mu.Unlock()
+	}()
+
+	for _, fn := range w.onConnect {
+		fn()
+	}
+	state := stateFromString(status.BackendState)
+	initial := ipn.Notify{Version: status.Version, State: &state}
+	if status.AuthURL != "" {
+		initial.BrowseToURL = &status.AuthURL
+	}
+	w.dispatch(initial)
+
+	for {
+		b, err := ipn.ReadMsg(conn)
+		if err != nil {
+			return err
+		}
+		var n ipn.Notify
+		if err := json.Unmarshal(b, &n); err != nil {
+			// The framing is intact, so skip a notification this version
+			// of edged cannot decode rather than reconnecting.
+			log.Printf("ipn-bus: error decoding notification: %v", err)
+			continue
+		}
+		if n.ErrMessage != nil {
+			log.Printf("ipn-bus: tailscaled error: %s", *n.ErrMessage)
+		}
+		w.dispatch(n)
+	}
+}
+
+func (w *Watcher) dispatch(n ipn.Notify) {
+	for _, fn := range w.handlers {
+		fn(n)
+	}
+	if n.State != nil || n.BrowseToURL != nil || n.Prefs != nil || n.NetMap != nil || n.LoginFinished != nil || n.ErrMessage != nil {
+		select {
+		case w.changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func stateFromString(s string) ipn.State {
+	for st := ipn.NoState; st <= ipn.Running; st++ {
+		if st.String() == s {
+			return st
+		}
+	}
+	return ipn.NoState
+}
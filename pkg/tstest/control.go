@@ -0,0 +1,74 @@
+package tstest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// RegisterPath is where a control server serves its login pages, followed
+// by the key of the node logging in.
+const RegisterPath = "/register/"
+
+// Control is a stand-in for a self-hosted control server such as Headscale.
+// It serves the login page the fake tailscaled sends devices to, and
+// approving the login there completes it on the LocalAPI.
+type Control struct {
+	URL string
+
+	srv *httptest.Server
+	api *LocalAPI
+
+	mu     sync.Mutex
+	visits []string
+}
+
+// NewControl starts a control server completing logins on api.
+func NewControl(api *LocalAPI) *Control {
+	c := &Control{api: api}
+	mux := http.NewServeMux()
+	mux.HandleFunc(RegisterPath, c.register)
+	c.srv = httptest.NewServer(mux)
+	c.URL = c.srv.URL
+	return c
+}
+
+// Close shuts the server down.
+func (c *Control) Close() {
+	c.srv.Close()
+}
+
+// Visits returns the node keys whose login page was requested.
+func (c *Control) Visits() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.visits...)
+}
+
+// Approve completes the pending login, as an admin would with
+// `headscale nodes register`.
+func (c *Control) Approve() error {
+	return c.api.Login()
+}
+
+// register serves the login page on GET and approves the login on POST.
+func (c *Control) register(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, RegisterPath)
+	switch r.Method {
+	case "GET":
+		c.mu.Lock()
+		c.visits = append(c.visits, key)
+		c.mu.Unlock()
+		fmt.Fprintf(w, "<html><body><p>Register node %s</p><form method=\"POST\"><button>Approve</button></form></body></html>\n", key)
+	case "POST":
+		if err := c.Approve(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "Node %s registered\n", key)
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,105 @@
+package tstest
+
+import (
+	"fmt"
+	ui "github.com/gizak/termui/v3"
+	"github.com/jtcressy-home/edged/pkg/display"
+	"sync"
+	"time"
+)
+
+// Display is a display.Display that records the layouts it is asked to
+// render, so tests can follow the controller's mode changes.
+type Display struct {
+	Events chan ui.Event
+
+	mu       sync.Mutex
+	layout   display.Layout
+	layouts  []display.Layout
+	last     display.RefreshData
+	renders  int
+	rendered chan struct{}
+}
+
+func NewDisplay() *Display {
+	return &Display{
+		Events:   make(chan ui.Event),
+		rendered: make(chan struct{}, 1),
+	}
+}
+
+func (d *Display) Init() error {
+	return nil
+}
+
+func (d *Display) SetLayout(layout display.Layout) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.layout = layout
+}
+
+func (d *Display) PollEvents() <-chan ui.Event {
+	return d.Events
+}
+
+func (d *Display) Refresh(data display.RefreshData) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.last = data
+	return nil
+}
+
+// Render records the current layout, consecutive renders of the same
+// layout are recorded once.
+func (d *Display) Render() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.renders++
+	if n := len(d.layouts); n == 0 || d.layouts[n-1] != d.layout {
+		d.layouts = append(d.layouts, d.layout)
+	}
+	select {
+	case d.rendered <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Display) Resize(width, height int) {}
+
+func (d *Display) Clear() {}
+
+func (d *Display) CleanUp() {}
+
+// Layouts returns every distinct layout rendered so far, in order.
+func (d *Display) Layouts() []display.Layout {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]display.Layout{}, d.layouts...)
+}
+
+// Last returns the data of the last Refresh.
+func (d *Display) Last() display.RefreshData {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.last
+}
+
+// WaitForLayout waits until layout has been rendered, or fails after
+// timeout.
+func (d *Display) WaitForLayout(layout display.Layout, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		d.mu.Lock()
+		n := len(d.layouts)
+		current := n > 0 && d.layouts[n-1] == layout
+		d.mu.Unlock()
+		if current {
+			return nil
+		}
+		select {
+		case <-d.rendered:
+		case <-deadline:
+			return fmt.Errorf("timed out waiting for layout %v, rendered %v", layout, d.Layouts())
+		}
+	}
+}
@@ -0,0 +1,609 @@
+// Package tstest provides fakes for exercising edged without a real
+// tailscaled or display hardware.
+package tstest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"inet.af/netaddr"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/empty"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/views"
+	"time"
+)
+
+const (
+	// DefaultLoginURL is handed out by the fake when a login is started.
+	DefaultLoginURL = "https://login.tailscale.com/a/fake"
+	// Version is reported as the fake tailscaled's version.
+	Version = "1.24.2-fake"
+)
+
+// LocalAPI is a fake tailscaled listening on a unix socket. Like tailscaled
+// it serves both the HTTP LocalAPI and the framed IPN bus on the same
+// socket, telling them apart by the first bytes of each connection.
+//
+// Tests script the backend through SetState, Login, Remove and friends,
+// and inspect what edged did through Prefs, Commands and Logouts.
+type LocalAPI struct {
+	Socket string
+
+	ln   net.Listener
+	http *http.Server
+	hln  *connListener
+
+	mu       sync.Mutex
+	state    ipn.State
+	prefs    *ipn.Prefs
+	authURL  string
+	loginURL string
+	tags     []string
+	ips      []netaddr.IP
+	peers    map[key.NodePublic]*ipnstate.PeerStatus
+	tailnet  string
+	health   []string
+	commands []ipn.Command
+	logouts  int
+	edits    []*ipn.MaskedPrefs
+	rewrite  func(*ipn.Prefs)
+	rejected map[string]bool
+	held     map[string]bool
+	buses    map[net.Conn]*bus
+}
+
+// bus is an IPN bus client. Notifications are queued for it while f.mu is
+// held and written by its own goroutine, so a client that is slow to read
+// never blocks the fake.
+type bus struct {
+	queue [][]byte
+	wake  chan struct{}
+	done  chan struct{}
+}
+
+// NewLocalAPI starts a fake tailscaled on a socket in dir, in NeedsLogin
+// state with default prefs.
+func NewLocalAPI(dir string) (*LocalAPI, error) {
+	sock := filepath.Join(dir, "tailscaled.sock")
+	os.Remove(sock)
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	f := &LocalAPI{
+		Socket:   sock,
+		ln:       ln,
+		hln:      newConnListener(ln.Addr()),
+		state:    ipn.NeedsLogin,
+		prefs:    ipn.NewPrefs(),
+		loginURL: DefaultLoginURL,
+		tailnet:  "example.com",
+		ips:      []netaddr.IP{netaddr.MustParseIP("100.64.0.1")},
+		buses:    map[net.Conn]*bus{},
+		rejected: map[string]bool{},
+		held:     map[string]bool{},
+		peers:    map[key.NodePublic]*ipnstate.PeerStatus{},
+	}
+	f.prefs.WantRunning = true
+	f.http = &http.Server{Handler: f.handler()}
+	go f.http.Serve(f.hln)
+	go f.accept()
+	return f, nil
+}
+
+// Close stops the fake and disconnects every client.
+func (f *LocalAPI) Close() error {
+	err := f.ln.Close()
+	f.http.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for c := range f.buses {
+		c.Close()
+	}
+	return err
+}
+
+// SetState moves the backend to state and notifies the IPN bus.
+func (f *LocalAPI) SetState(state ipn.State) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.setStateLocked(state)
+}
+
+// State returns the backend state.
+func (f *LocalAPI) State() ipn.State {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+// SetLoginURL sets the AuthURL handed out when a login is started. By
+// default it is on the control server in the prefs, if one is set.
+func (f *LocalAPI) SetLoginURL(url string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.loginURL = url
+}
+
+// RejectAuthKeys makes logins with any of keys fail, as control does for
+// invalid or expired pre-auth keys. Other keys log in straight away.
+func (f *LocalAPI) RejectAuthKeys(keys ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, k := range keys {
+		f.rejected[k] = true
+	}
+}
+
+// HoldAuthKeys leaves logins with any of keys waiting on control until
+// ReleaseAuthKeys.
+func (f *LocalAPI) HoldAuthKeys(keys ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, k := range keys {
+		f.held[k] = true
+	}
+}
+
+// ReleaseAuthKeys lets logins with held keys through, logging in the one
+// waiting, if any.
+func (f *LocalAPI) ReleaseAuthKeys() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.held = map[string]bool{}
+	if f.state != ipn.NoState {
+		return nil
+	}
+	return f.loginLocked()
+}
+
+// Error reports msg on the IPN bus without changing state, like the errors
+// tailscaled passes on from e.g. DNS or health checks.
+func (f *LocalAPI) Error(msg string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.broadcastLocked(ipn.Notify{ErrMessage: &msg})
+}
+
+// SetTags sets the ACL tags reported for the device.
+func (f *LocalAPI) SetTags(tags ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tags = tags
+}
+
+// AddPeer adds a node to the tailnet, e.g. an exit node, returning its
+// stable ID.
+func (f *LocalAPI) AddPeer(hostname string, ip netaddr.IP) tailcfg.StableNodeID {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := tailcfg.StableNodeID(fmt.Sprintf("n%dCNTRL", len(f.peers)+1))
+	f.peers[key.NewNode().Public()] = &ipnstate.PeerStatus{
+		ID:             id,
+		HostName:       hostname,
+		DNSName:        hostname + "." + f.tailnet + ".",
+		TailscaleIPs:   []netaddr.IP{ip},
+		ExitNodeOption: true,
+		Online:         true,
+	}
+	return id
+}
+
+// SetHealth sets the health warnings reported in the status.
+func (f *LocalAPI) SetHealth(health ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.health = health
+}
+
+// Login completes a pending login as if the QR code had been scanned.
+func (f *LocalAPI) Login() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.loginLocked()
+}
+
+// RemovedError is the control error reported when the device is removed.
+const RemovedError = "node not found"
+
+// Remove drops the device back to NeedsLogin without a local logout after
+// control reports it no longer knows the node, which is what happens when
+// it is deleted from the tailnet admin panel.
+func (f *LocalAPI) Remove() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	msg := RemovedError
+	if err := f.broadcastLocked(ipn.Notify{ErrMessage: &msg}); err != nil {
+		return err
+	}
+	return f.setStateLocked(ipn.NeedsLogin)
+}
+
+// Expire drops the device back to NeedsLogin as its node key expires, with
+// a netmap whose key expiry is in the past.
+func (f *LocalAPI) Expire() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.broadcastLocked(ipn.Notify{NetMap: &netmap.NetworkMap{
+		SelfNode: &tailcfg.Node{Name: f.prefs.Hostname},
+		Expiry:   time.Now().Add(-time.Minute),
+	}})
+	if err != nil {
+		return err
+	}
+	return f.setStateLocked(ipn.NeedsLogin)
+}
+
+// Prefs returns a copy of the current prefs.
+func (f *LocalAPI) Prefs() *ipn.Prefs {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.prefs.Clone()
+}
+
+// SetPrefs replaces the prefs, as if changed with `tailscale set`.
+func (f *LocalAPI) SetPrefs(p *ipn.Prefs) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prefs = p.Clone()
+	return f.broadcastLocked(ipn.Notify{Prefs: f.prefs.Clone()})
+}
+
+// RewritePrefs has the fake change its prefs after every edit, like
+// tailscaled overriding a pref it does not accept. nil stops it.
+func (f *LocalAPI) RewritePrefs(fn func(*ipn.Prefs)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rewrite = fn
+}
+
+// Edits returns every EditPrefs request received.
+func (f *LocalAPI) Edits() []*ipn.MaskedPrefs {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*ipn.MaskedPrefs{}, f.edits...)
+}
+
+// Commands returns every IPN bus command received.
+func (f *LocalAPI) Commands() []ipn.Command {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]ipn.Command{}, f.commands...)
+}
+
+// Logouts returns the number of Logout requests received.
+func (f *LocalAPI) Logouts() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.logouts
+}
+
+// Status returns the status served on /localapi/v0/status.
+func (f *LocalAPI) Status() *ipnstate.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.statusLocked()
+}
+
+func (f *LocalAPI) statusLocked() *ipnstate.Status {
+	st := &ipnstate.Status{
+		Version:      Version,
+		BackendState: f.state.String(),
+		AuthURL:      f.authURL,
+		Health:       f.health,
+		Self: &ipnstate.PeerStatus{
+			HostName: f.prefs.Hostname,
+			Online:   f.state == ipn.Running,
+		},
+	}
+	if st.Self.HostName == "" {
+		st.Self.HostName = "fake"
+	}
+	if f.state == ipn.Running {
+		st.TailscaleIPs = f.ips
+		st.CurrentTailnet = &ipnstate.TailnetStatus{Name: f.tailnet}
+		st.Peer = map[key.NodePublic]*ipnstate.PeerStatus{}
+		for k, p := range f.peers {
+			st.Peer[k] = p
+		}
+		if len(f.tags) > 0 {
+			tags := views.SliceOf(f.tags)
+			st.Self.Tags = &tags
+		}
+	}
+	return st
+}
+
+func (f *LocalAPI) setStateLocked(state ipn.State) error {
+	if state != ipn.NeedsLogin {
+		f.authURL = ""
+	}
+	f.state = state
+	return f.broadcastLocked(ipn.Notify{State: &state})
+}
+
+func (f *LocalAPI) loginLocked() error {
+	f.prefs.LoggedOut = false
+	f.authURL = ""
+	if err := f.broadcastLocked(ipn.Notify{LoginFinished: &empty.Message{}}); err != nil {
+		return err
+	}
+	return f.setStateLocked(ipn.Running)
+}
+
+// broadcastLocked queues n for every IPN bus client. The writes happen on
+// each client's goroutine, after f.mu is released.
+func (f *LocalAPI) broadcastLocked(n ipn.Notify) error {
+	n.Version = Version
+	msg, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("tstest: notify: %w", err)
+	}
+	for _, b := range f.buses {
+		b.queue = append(b.queue, msg)
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// writeBus writes the notifications queued for b to c until either is
+// closed.
+func (f *LocalAPI) writeBus(c net.Conn, b *bus) {
+	for {
+		select {
+		case <-b.wake:
+		case <-b.done:
+			return
+		}
+		f.mu.Lock()
+		queue := b.queue
+		b.queue = nil
+		f.mu.Unlock()
+		for _, msg := range queue {
+			if err := ipn.WriteMsg(c, msg); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+func (f *LocalAPI) accept() {
+	for {
+		c, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.serveConn(c)
+	}
+}
+
+// serveConn hands HTTP connections to the LocalAPI server and treats
+// anything else as an IPN bus client, the same way tailscaled does.
+func (f *LocalAPI) serveConn(c net.Conn) {
+	br := bufio.NewReader(c)
+	// IPN bus clients may not write anything until they have a command to
+	// send, so give up waiting for an HTTP request line after a second.
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	peek, _ := br.Peek(4)
+	c.SetReadDeadline(time.Time{})
+	pc := &peekedConn{Conn: c, r: br}
+	switch string(peek) {
+	case "GET ", "POST", "PUT ", "PATC", "DELE", "HEAD":
+		f.hln.push(pc)
+	default:
+		f.serveBus(pc)
+	}
+}
+
+func (f *LocalAPI) serveBus(c net.Conn) {
+	b := &bus{wake: make(chan struct{}, 1), done: make(chan struct{})}
+	f.mu.Lock()
+	f.buses[c] = b
+	f.mu.Unlock()
+	go f.writeBus(c, b)
+	defer func() {
+		f.mu.Lock()
+		delete(f.buses, c)
+		f.mu.Unlock()
+		close(b.done)
+		c.Close()
+	}()
+	for {
+		b, err := ipn.ReadMsg(c)
+		if err != nil {
+			return
+		}
+		var cmd ipn.Command
+		if err := json.Unmarshal(b, &cmd); err != nil {
+			return
+		}
+		if err := f.command(cmd); err != nil {
+			return
+		}
+	}
+}
+
+func (f *LocalAPI) command(cmd ipn.Command) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, cmd)
+	if cmd.Version != Version && !cmd.AllowVersionSkew {
+		msg := fmt.Sprintf("version mismatch: %q != %q", cmd.Version, Version)
+		return f.broadcastLocked(ipn.Notify{ErrMessage: &msg})
+	}
+	switch {
+	case cmd.StartLoginInteractive != nil:
+		if f.state != ipn.NeedsLogin {
+			return nil
+		}
+		f.authURL = f.loginURL
+		if f.prefs.ControlURL != "" && f.loginURL == DefaultLoginURL {
+			// Like a real control server, log in on the one configured
+			f.authURL = f.prefs.ControlURL + RegisterPath + "fake"
+		}
+		url := f.authURL
+		return f.broadcastLocked(ipn.Notify{BrowseToURL: &url})
+	case cmd.Start != nil:
+		if p := cmd.Start.Opts.UpdatePrefs; p != nil {
+			f.prefs = p.Clone()
+			if err := f.broadcastLocked(ipn.Notify{Prefs: f.prefs.Clone()}); err != nil {
+				return err
+			}
+		}
+		key := cmd.Start.Opts.AuthKey
+		if key == "" {
+			return nil
+		}
+		// Like tailscaled, the backend starts over without saying so
+		// until control answers
+		f.state = ipn.NoState
+		switch {
+		case f.rejected[key]:
+			msg := "invalid key: unable to validate API key"
+			if err := f.broadcastLocked(ipn.Notify{ErrMessage: &msg}); err != nil {
+				return err
+			}
+			return f.setStateLocked(ipn.NeedsLogin)
+		case f.held[key]:
+			return nil
+		}
+		return f.loginLocked()
+	case cmd.Logout != nil:
+		return f.logoutLocked()
+	}
+	return nil
+}
+
+func (f *LocalAPI) logoutLocked() error {
+	f.logouts++
+	f.prefs.LoggedOut = true
+	return f.setStateLocked(ipn.NeedsLogin)
+}
+
+func (f *LocalAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/localapi/v0/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, f.Status())
+	})
+	mux.HandleFunc("/localapi/v0/prefs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			writeJSON(w, f.Prefs())
+		case "PATCH":
+			mp := &ipn.MaskedPrefs{}
+			b, err := ioutil.ReadAll(r.Body)
+			if err == nil {
+				err = json.Unmarshal(b, mp)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			f.mu.Lock()
+			f.edits = append(f.edits, mp)
+			f.prefs.ApplyEdits(mp)
+			if f.rewrite != nil {
+				f.rewrite(f.prefs)
+			}
+			p := f.prefs.Clone()
+			err = f.broadcastLocked(ipn.Notify{Prefs: p.Clone()})
+			f.mu.Unlock()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, p)
+		default:
+			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/localapi/v0/logout", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "want POST", http.StatusMethodNotAllowed)
+			return
+		}
+		f.mu.Lock()
+		err := f.logoutLocked()
+		f.mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Tailscale-Version", Version)
+	json.NewEncoder(w).Encode(v)
+}
+
+// peekedConn is a net.Conn whose first bytes have already been buffered.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// connListener is a net.Listener fed with connections already accepted
+// elsewhere.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}